@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/registry"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+// runDoctor implements the "doctor" subcommand, which reads copy specs from the
+// file named in args (or standard input), then prints whether we can access
+// each registry repository that they name, as checked by the same harmless
+// requests that precede copies, along with the capabilities of each registry.
+// It returns the process exit code.
+func runDoctor(args []string) int {
+	if len(args) > 1 {
+		log.Printf("[main] doctor takes at most one copy spec file")
+		return 2
+	}
+
+	var specReader io.Reader
+	if len(args) == 0 {
+		specReader = newStdinWarningReader()
+	} else {
+		specFile, err := os.Open(args[0])
+		if err != nil {
+			log.Printf("[main] cannot open %s: %v", args[0], err)
+			return 2
+		}
+		defer specFile.Close()
+		specReader = specFile
+	}
+	specs, err := readAllCopySpecs(specReader)
+	if err != nil {
+		log.Printf("[main] invalid copy spec: %v", err)
+		return 2
+	}
+
+	type access struct {
+		repo  image.Repository
+		scope registry.Scope
+	}
+	var (
+		accesses   []access
+		registries []image.Registry
+		probeRepos = make(map[image.Registry]image.Repository)
+		canPush    = make(map[image.Registry]bool)
+	)
+	addAccess := func(repo image.Repository, scope registry.Scope) {
+		if repo.Transport != image.RegistryTransport || slices.Contains(accesses, access{repo, scope}) {
+			return
+		}
+		accesses = append(accesses, access{repo, scope})
+		if !slices.Contains(registries, repo.Registry) {
+			registries = append(registries, repo.Registry)
+		}
+	}
+	for _, spec := range specs {
+		addAccess(spec.Src.Repository, registry.PullScope)
+		addAccess(spec.Dst.Repository, registry.PushScope)
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tACCESS\tAUTH")
+	for _, a := range accesses {
+		status := "ok"
+		if err := registry.CheckAccess(a.repo, a.scope == registry.PushScope); err != nil {
+			status = "failed: " + strings.ReplaceAll(err.Error(), "\n", " ")
+			failed = true
+		} else {
+			// Prefer repositories we can push to for probes, since they can probe
+			// every capability.
+			if _, ok := probeRepos[a.repo.Registry]; !ok || a.scope == registry.PushScope && !canPush[a.repo.Registry] {
+				probeRepos[a.repo.Registry] = a.repo
+				canPush[a.repo.Registry] = a.scope == registry.PushScope
+			}
+		}
+		access := "pull"
+		if a.scope == registry.PushScope {
+			access = "push"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", a.repo, access, status)
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := []string{"REGISTRY"}
+	for _, capability := range registry.AllCapabilities {
+		header = append(header, strings.ToUpper(string(capability)))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, reg := range registries {
+		row := []string{string(reg)}
+		repo, ok := probeRepos[reg]
+		for _, capability := range registry.AllCapabilities {
+			switch {
+			case !ok:
+				row = append(row, "-")
+			case slices.Contains(registry.PushCapabilities, capability) && !canPush[reg]:
+				row = append(row, "-")
+			default:
+				support, err := registry.Probe(repo, capability)
+				if err != nil {
+					log.Verbosef("[doctor]\tprobing %s for %s: %v", reg, capability, err)
+				}
+				row = append(row, support.String())
+			}
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+
+	if failed {
+		return 1
+	}
+	return 0
+}
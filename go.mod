@@ -5,7 +5,6 @@ go 1.25rc2
 require (
 	github.com/containerd/platforms v0.2.1
 	github.com/deckarep/golang-set/v2 v2.7.0
-	github.com/gammazero/deque v1.0.0
 	github.com/google/go-containerregistry v0.20.3
 	github.com/mitchellh/copystructure v1.2.0
 	github.com/opencontainers/go-digest v1.0.0
@@ -0,0 +1,397 @@
+// Package bundle moves sets of images across air gaps in incremental bundles.
+//
+// A bundle is a tarball containing an OCI image layout along with a
+// bundle.json file, which lists the copy specs that the bundle satisfies and
+// the inventory of every blob (including manifests) that the bundle and its
+// predecessors contain. An export can omit everything in the inventory of a
+// previous bundle, so that a chain of bundles only carries each blob once. An
+// import merges a chain of bundles into a single layout on the local
+// filesystem, and copies each image in the layout to its destination.
+package bundle
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/copy"
+	"github.com/ahamlinman/magic-mirror/internal/image/layout"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+const (
+	manifestFile = "bundle.json"
+	blobsDir     = "blobs"
+)
+
+// Manifest is the content of a bundle's bundle.json file.
+type Manifest struct {
+	// Previous is the digest of the bundle.json file of the bundle that this
+	// bundle follows, if any.
+	Previous digest.Digest `json:"previous,omitempty"`
+
+	// Specs lists the copy specs that the bundle satisfies, along with the tag
+	// of the image in the bundle's layout that each spec copies to its
+	// destination.
+	Specs []Entry `json:"specs"`
+
+	// Inventory lists the digests of all blobs in this bundle and every bundle
+	// before it in the chain.
+	Inventory []digest.Digest `json:"inventory"`
+}
+
+// Entry describes a single image in a bundle.
+type Entry struct {
+	Tag  string    `json:"tag"`
+	Spec copy.Spec `json:"spec"`
+}
+
+// Export copies the source images of specs (with any transforms applied) into
+// a new bundle at path. If previous is not empty, the bundle will omit blobs
+// in the inventory of the bundle at that path, and can only be imported along
+// with it. The copies into the bundle follow opts, except that Export
+// determines the known blobs itself.
+func Export(concurrency int, opts copy.Options, path, previous string, specs []copy.Spec) error {
+	var (
+		manifest Manifest
+		known    []digest.Digest
+	)
+	if previous != "" {
+		prevManifest, prevDigest, err := readManifest(previous)
+		if err != nil {
+			return err
+		}
+		manifest.Previous = prevDigest
+		known = prevManifest.Inventory
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(path), ".tmp-bundle-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	stagingRepo := image.Repository{
+		Transport: image.OCILayoutTransport,
+		Registry:  image.Registry(staging),
+	}
+
+	seen := make(map[image.Image]bool)
+	exportSpecs := make([]copy.Spec, 0, len(specs))
+	for _, spec := range specs {
+		tag := entryTag(spec.Dst)
+		exportSpec := spec
+		exportSpec.Dst = image.Image{Repository: stagingRepo, Tag: tag}
+		exportSpecs = append(exportSpecs, exportSpec)
+		if !seen[spec.Dst] {
+			seen[spec.Dst] = true
+			manifest.Specs = append(manifest.Specs, Entry{Tag: tag, Spec: spec})
+		}
+	}
+	opts.KnownBlobs = map[image.Repository][]digest.Digest{stagingRepo: known}
+	if err := copy.CopyAllWithOptions(concurrency, opts, exportSpecs...); err != nil {
+		return err
+	}
+
+	omit := make(map[digest.Digest]bool)
+	for _, dgst := range known {
+		omit[dgst] = true
+	}
+	staged, err := stagedBlobs(staging)
+	if err != nil {
+		return err
+	}
+	inventory := maps.Clone(omit)
+	var included int
+	for _, dgst := range staged {
+		if !inventory[dgst] {
+			inventory[dgst] = true
+			included++
+		}
+	}
+	manifest.Inventory = slices.Sorted(maps.Keys(inventory))
+
+	if err := writeBundle(path, staging, manifest, omit); err != nil {
+		return err
+	}
+	log.Printf("[bundle] exported %d images with %d new blobs to %s", len(manifest.Specs), included, path)
+	return nil
+}
+
+// entryTag returns the tag of the image in a bundle's layout for the provided
+// destination.
+func entryTag(dst image.Image) string {
+	sum := sha256.Sum256([]byte(dst.String()))
+	return "dst-" + hex.EncodeToString(sum[:])[:40]
+}
+
+// stagedBlobs returns the digests of every blob in the layout at dir.
+func stagedBlobs(dir string) ([]digest.Digest, error) {
+	var dgsts []digest.Digest
+	root := filepath.Join(dir, blobsDir)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		alg := filepath.Base(filepath.Dir(p))
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg), d.Name())
+		if dgst.Validate() == nil {
+			dgsts = append(dgsts, dgst)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return dgsts, err
+}
+
+// writeBundle writes the layout at dir to a bundle tarball at path, omitting
+// the blobs with the digests in omit.
+func writeBundle(path, dir string, manifest Manifest, omit map[digest.Digest]bool) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if dgst, ok := blobDigest(name); ok && omit[dgst] {
+			return nil
+		}
+		return writeFile(tw, name, p)
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: manifestFile, Mode: 0o644, Size: int64(len(encoded))}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(encoded); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func writeFile(tw *tar.Writer, name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: stat.Size()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// blobDigest returns the digest of the blob at the provided path within a
+// layout, if the path refers to a blob.
+func blobDigest(name string) (digest.Digest, bool) {
+	dir, encoded := path.Split(name)
+	parent, alg := path.Split(path.Clean(dir))
+	if parent != blobsDir+"/" {
+		return "", false
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded)
+	return dgst, dgst.Validate() == nil
+}
+
+// Import copies the images that the last bundle in a chain of bundles lists in
+// its specs to their destinations, given the paths to the bundles in the order
+// they were exported. Specs in earlier bundles are ignored, so every bundle
+// must list the full set of specs to import along with it, as it does when
+// each export in the chain starts from the full set. The chain must contain
+// every blob in the inventory of its last bundle, which generally means that
+// it must start with a bundle that has no predecessor. Blobs and manifests
+// that already exist at a destination are not copied again. The copies to the
+// destinations follow opts.
+func Import(concurrency int, opts copy.Options, paths []string) error {
+	staging, err := os.MkdirTemp("", "magic-mirror-bundle-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	var (
+		manifest   Manifest
+		prevDigest digest.Digest
+	)
+	for i, p := range paths {
+		m, dgst, err := extract(p, staging)
+		if err != nil {
+			return err
+		}
+		if i > 0 && m.Previous != prevDigest {
+			return fmt.Errorf("bundle %s does not follow %s", p, paths[i-1])
+		}
+		manifest, prevDigest = m, dgst
+	}
+
+	stagingLayout := layout.Open(staging)
+	var missing int
+	for _, dgst := range manifest.Inventory {
+		if ok, err := stagingLayout.HasBlob(dgst); err != nil {
+			return err
+		} else if !ok {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("bundle chain ending with %s is missing %d blobs; import it along with the earlier bundles in its chain", paths[len(paths)-1], missing)
+	}
+
+	stagingRepo := image.Repository{
+		Transport: image.OCILayoutTransport,
+		Registry:  image.Registry(staging),
+	}
+	specs := make([]copy.Spec, len(manifest.Specs))
+	for i, entry := range manifest.Specs {
+		// The export already applied any transforms.
+		specs[i] = entry.Spec
+		specs[i].Src = image.Image{Repository: stagingRepo, Tag: entry.Tag, Digest: entry.Spec.Dst.Digest}
+		specs[i].Transform = copy.Transform{}
+	}
+	return copy.CopyAllWithOptions(concurrency, opts, specs...)
+}
+
+// extract unpacks the layout in the bundle at p into dir, replacing the
+// layout's index with the bundle's, and returns the bundle's manifest along
+// with the digest of its encoded form.
+func extract(p, dir string) (manifest Manifest, dgst digest.Digest, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return Manifest{}, "", err
+	}
+	defer f.Close()
+
+	var (
+		found bool
+		dst   = layout.Open(dir)
+		tr    = tar.NewReader(f)
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Manifest{}, "", fmt.Errorf("invalid bundle %s: %w", p, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if blob, ok := blobDigest(name); ok {
+			if err := dst.PutBlob(blob, tr); err != nil {
+				return Manifest{}, "", fmt.Errorf("invalid bundle %s: %w", p, err)
+			}
+			continue
+		}
+		switch name {
+		case manifestFile:
+			encoded, err := io.ReadAll(tr)
+			if err != nil {
+				return Manifest{}, "", err
+			}
+			if err := json.Unmarshal(encoded, &manifest); err != nil {
+				return Manifest{}, "", fmt.Errorf("invalid %s in bundle %s: %w", manifestFile, p, err)
+			}
+			dgst, found = digest.Canonical.FromBytes(encoded), true
+		case "index.json", "oci-layout":
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return Manifest{}, "", err
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+				return Manifest{}, "", err
+			}
+		default:
+			return Manifest{}, "", fmt.Errorf("invalid bundle %s: unexpected file %s", p, hdr.Name)
+		}
+	}
+	if !found {
+		return Manifest{}, "", fmt.Errorf("invalid bundle %s: missing %s", p, manifestFile)
+	}
+	return manifest, dgst, nil
+}
+
+// readManifest reads the bundle.json file from the bundle at p, and returns it
+// along with the digest of its encoded form.
+func readManifest(p string) (Manifest, digest.Digest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return Manifest{}, "", err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return Manifest{}, "", fmt.Errorf("invalid bundle %s: missing %s", p, manifestFile)
+		}
+		if err != nil {
+			return Manifest{}, "", fmt.Errorf("invalid bundle %s: %w", p, err)
+		}
+		if path.Clean(hdr.Name) != manifestFile {
+			continue
+		}
+		encoded, err := io.ReadAll(tr)
+		if err != nil {
+			return Manifest{}, "", err
+		}
+		var manifest Manifest
+		if err := json.Unmarshal(encoded, &manifest); err != nil {
+			return Manifest{}, "", fmt.Errorf("invalid %s in bundle %s: %w", manifestFile, p, err)
+		}
+		return manifest, digest.Canonical.FromBytes(encoded), nil
+	}
+}
@@ -0,0 +1,116 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/copy"
+	"github.com/ahamlinman/magic-mirror/internal/image/layout"
+)
+
+func TestIncrementalBundles(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		srcDir   = filepath.Join(dir, "src")
+		dstDir   = filepath.Join(dir, "dst")
+		bundle1  = filepath.Join(dir, "bundle1.tar")
+		bundle2  = filepath.Join(dir, "bundle2.tar")
+		src      = layout.Open(srcDir)
+		config   = []byte(`{}`)
+		shared   = []byte("shared layer")
+		onlyV1   = []byte("v1 layer")
+		onlyV2   = []byte("v2 layer")
+		manifest = func(tag string, layers ...[]byte) digest.Digest {
+			m := image.ParsedManifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: v1.MediaTypeImageManifest,
+				Config:    putBlob(t, src, v1.MediaTypeImageConfig, config),
+			}
+			for _, layer := range layers {
+				m.Layers = append(m.Layers, putBlob(t, src, v1.MediaTypeImageLayer, layer))
+			}
+			body, err := json.Marshal(m)
+			require.NoError(t, err)
+			desc := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.FromBytes(body), Size: int64(len(body))}
+			require.NoError(t, src.PutManifest(tag, body, desc))
+			return desc.Digest
+		}
+		spec = func(tag string) copy.Spec {
+			var s copy.Spec
+			s.Src = parse(t, "oci:"+srcDir+":"+tag)
+			s.Dst = parse(t, "oci:"+dstDir+":"+tag)
+			return s
+		}
+	)
+
+	manifest("v1", shared, onlyV1)
+	require.NoError(t, Export(1, copy.Options{}, bundle1, "", []copy.Spec{spec("v1")}))
+
+	manifest("v2", shared, onlyV2)
+	require.NoError(t, Export(1, copy.Options{}, bundle2, bundle1, []copy.Spec{spec("v1"), spec("v2")}))
+
+	files := bundleFiles(t, bundle2)
+	assert.Contains(t, files, "blobs/sha256/"+digest.FromBytes(onlyV2).Encoded())
+	assert.NotContains(t, files, "blobs/sha256/"+digest.FromBytes(shared).Encoded(), "bundle repeated a previous blob")
+	assert.NotContains(t, files, "blobs/sha256/"+digest.FromBytes(onlyV1).Encoded(), "bundle repeated a previous blob")
+
+	assert.ErrorContains(t, Import(1, copy.Options{}, []string{bundle2}), "earlier bundles")
+	assert.ErrorContains(t, Import(1, copy.Options{}, []string{bundle2, bundle1}), "does not follow")
+
+	require.NoError(t, Import(1, copy.Options{}, []string{bundle1, bundle2}))
+	dst := layout.Open(dstDir)
+	for _, tag := range []string{"v1", "v2"} {
+		_, _, err := dst.GetManifest(tag)
+		assert.NoError(t, err, "missing %s at destination", tag)
+	}
+	for _, blob := range [][]byte{config, shared, onlyV1, onlyV2} {
+		ok, err := dst.HasBlob(digest.FromBytes(blob))
+		require.NoError(t, err)
+		assert.True(t, ok, "missing blob %q at destination", blob)
+	}
+}
+
+func putBlob(t *testing.T, l *layout.Layout, mediaType string, content []byte) v1.Descriptor {
+	t.Helper()
+	dgst := digest.FromBytes(content)
+	require.NoError(t, l.PutBlob(dgst, bytes.NewReader(content)))
+	return v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(content))}
+}
+
+func parse(t *testing.T, s string) image.Image {
+	t.Helper()
+	img, err := image.Parse(s)
+	require.NoError(t, err)
+	return img
+}
+
+func bundleFiles(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+}
@@ -0,0 +1,570 @@
+// Package archive reads and writes images in tarballs in the format of
+// "docker save" and "docker load".
+//
+// An archive lists its images in a top-level manifest.json file, each with the
+// path to its config and the paths to its layers within the tarball, and the
+// names under which "docker load" should tag it. This package writes configs
+// and layers under blobs/<algorithm>/<encoded> in the same way as recent
+// versions of "docker save", so that images in the same archive share layers.
+// It reads archives in that format along with the older format that stores
+// each layer in its own directory.
+//
+// Since a tarball can't be updated in place, an archive is written in two
+// phases. Blobs and manifests are first staged in a temporary OCI layout next
+// to the final path, which Commit assembles into the tarball.
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/layout"
+)
+
+const (
+	manifestFile     = "manifest.json"
+	repositoriesFile = "repositories"
+	blobsDir         = "blobs"
+)
+
+// manifestEntry describes a single image in manifest.json.
+type manifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Archive provides access to the content of a Docker archive. An Archive is
+// either read-only, or (after Create) write-only.
+type Archive struct {
+	path string
+
+	readOnce sync.Once
+	readErr  error
+	files    map[string]fileEntry
+	digests  map[digest.Digest]string
+	entries  []manifestEntry
+
+	writing    bool
+	stagingDir string
+	staging    *layout.Layout
+	images     map[string]manifestEntry
+	writeMu    sync.Mutex
+}
+
+type fileEntry struct {
+	offset, size int64
+	digest       digest.Digest
+}
+
+var (
+	archives   = make(map[string]*Archive)
+	archivesMu sync.Mutex
+)
+
+// Open returns the Archive for the tarball at path. Unless Create has prepared
+// it for writing, the Archive reads the tarball's existing content. All calls
+// with the same cleaned path share an Archive.
+func Open(path string) *Archive {
+	path = filepath.Clean(path)
+
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	if a, ok := archives[path]; ok {
+		return a
+	}
+	a := &Archive{path: path}
+	archives[path] = a
+	return a
+}
+
+// Create prepares the Archive at path for writing, replacing any existing
+// content when Commit is called. It must be called before any other use of the
+// Archive.
+func Create(path string) (*Archive, error) {
+	a := Open(path)
+
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	if a.writing {
+		return a, nil
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(a.path), ".tmp-"+filepath.Base(a.path)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	a.writing = true
+	a.stagingDir = dir
+	a.staging = layout.Open(dir)
+	a.images = make(map[string]manifestEntry)
+	return a, nil
+}
+
+// HasBlob returns whether the archive contains the blob with the provided
+// digest.
+func (a *Archive) HasBlob(dgst digest.Digest) (bool, error) {
+	if a.writing {
+		return a.staging.HasBlob(dgst)
+	}
+	if err := a.index(); err != nil {
+		return false, err
+	}
+	_, ok := a.digests[dgst]
+	return ok, nil
+}
+
+// GetBlob opens the blob with the provided digest, and returns its size.
+func (a *Archive) GetBlob(dgst digest.Digest) (r io.ReadCloser, size int64, err error) {
+	if a.writing {
+		return nil, 0, fmt.Errorf("docker archive %s is being written, and can't be read", a.path)
+	}
+	if err := a.index(); err != nil {
+		return nil, 0, err
+	}
+	name, ok := a.digests[dgst]
+	if !ok {
+		return nil, 0, fmt.Errorf("blob %s in docker archive %s: %w", dgst, a.path, fs.ErrNotExist)
+	}
+	return a.openFile(name)
+}
+
+// GetManifest returns the content and media type of a Docker image manifest
+// for the image in the archive with the provided name or manifest digest. The
+// archive itself doesn't store manifests, so GetManifest synthesizes them from
+// manifest.json. If reference is empty, the archive must contain exactly one
+// image.
+//
+// When the archive has no image with the reference, or is being written, the
+// error wraps fs.ErrNotExist.
+func (a *Archive) GetManifest(reference string) (body []byte, mediaType string, err error) {
+	if a.writing {
+		return nil, "", fmt.Errorf("%s in docker archive %s: %w", reference, a.path, fs.ErrNotExist)
+	}
+	if err := a.index(); err != nil {
+		return nil, "", err
+	}
+
+	if reference == "" {
+		if len(a.entries) != 1 {
+			return nil, "", fmt.Errorf("docker archive %s contains %d images, and requires a name to select one", a.path, len(a.entries))
+		}
+		body, err = a.synthesizeManifest(a.entries[0])
+		return body, string(image.DockerManifestMediaType), err
+	}
+
+	dgst, dgstErr := digest.Parse(reference)
+	for _, entry := range a.entries {
+		if dgstErr == nil {
+			body, err = a.synthesizeManifest(entry)
+			if err == nil && dgst.Algorithm().FromBytes(body) == dgst {
+				return body, string(image.DockerManifestMediaType), nil
+			}
+			continue
+		}
+		for _, repoTag := range entry.RepoTags {
+			if sameName(repoTag, reference) {
+				body, err = a.synthesizeManifest(entry)
+				return body, string(image.DockerManifestMediaType), err
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("%s in docker archive %s: %w", reference, a.path, fs.ErrNotExist)
+}
+
+// Tags returns the names of all images in the archive.
+func (a *Archive) Tags() ([]string, error) {
+	if a.writing {
+		a.writeMu.Lock()
+		defer a.writeMu.Unlock()
+		return slices.Sorted(maps.Keys(a.images)), nil
+	}
+	if err := a.index(); err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, entry := range a.entries {
+		tags = append(tags, entry.RepoTags...)
+	}
+	return tags, nil
+}
+
+// synthesizeManifest returns the encoded Docker image manifest for an entry in
+// manifest.json.
+func (a *Archive) synthesizeManifest(entry manifestEntry) ([]byte, error) {
+	config, err := a.describe(entry.Config, image.DockerConfigMediaType)
+	if err != nil {
+		return nil, err
+	}
+	manifest := image.ParsedManifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: string(image.DockerManifestMediaType),
+		Config:    config,
+		Layers:    make([]v1.Descriptor, len(entry.Layers)),
+	}
+	for i, layer := range entry.Layers {
+		if manifest.Layers[i], err = a.describe(layer, ""); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(manifest)
+}
+
+// describe returns a descriptor for the file with the provided name. If
+// mediaType is empty, describe detects whether the file is a compressed or
+// uncompressed layer.
+func (a *Archive) describe(name string, mediaType image.MediaType) (v1.Descriptor, error) {
+	name = path.Clean(name)
+	file, ok := a.files[name]
+	if !ok {
+		return v1.Descriptor{}, fmt.Errorf("docker archive %s is missing %s", a.path, name)
+	}
+	if mediaType == "" {
+		r, _, err := a.openFile(name)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		magic := make([]byte, 2)
+		_, err = io.ReadFull(r, magic)
+		r.Close()
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return v1.Descriptor{}, err
+		}
+		mediaType = image.DockerLayerMediaType
+		if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			mediaType = image.DockerLayerGzipMediaType
+		}
+	}
+
+	return v1.Descriptor{
+		MediaType: string(mediaType),
+		Digest:    file.digest,
+		Size:      file.size,
+	}, nil
+}
+
+// index scans the tarball once to find the location and digest of every file,
+// and reads manifest.json.
+func (a *Archive) index() error {
+	a.readOnce.Do(func() {
+		a.readErr = a.scan()
+	})
+	return a.readErr
+}
+
+func (a *Archive) scan() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	a.files = make(map[string]fileEntry)
+	a.digests = make(map[digest.Digest]string)
+
+	var (
+		manifestJSON []byte
+		links        = make(map[string]string)
+	)
+	cr := &countingReader{Reader: bufio.NewReader(f)}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid docker archive %s: %w", a.path, err)
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			// Legacy "docker save" archives link repeated layers to the first
+			// copy, like <id>/layer.tar -> ../<other>/layer.tar.
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+			continue
+		case tar.TypeLink:
+			links[name] = path.Clean(hdr.Linkname)
+			continue
+		default:
+			continue
+		}
+
+		entry := fileEntry{offset: cr.N, size: hdr.Size}
+		digester := digest.Canonical.Digester()
+		var w io.Writer = digester.Hash()
+		var content bytes.Buffer
+		if name == manifestFile {
+			w = io.MultiWriter(w, &content)
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return fmt.Errorf("invalid docker archive %s: %w", a.path, err)
+		}
+		if name == manifestFile {
+			manifestJSON = content.Bytes()
+		}
+		entry.digest = digester.Digest()
+		a.files[name] = entry
+		a.digests[entry.digest] = name
+	}
+	for name := range links {
+		if entry, ok := resolveLink(a.files, links, name); ok {
+			a.files[name] = entry
+		}
+	}
+
+	if manifestJSON == nil {
+		return fmt.Errorf("docker archive %s has no %s", a.path, manifestFile)
+	}
+	if err := json.Unmarshal(manifestJSON, &a.entries); err != nil {
+		return fmt.Errorf("invalid %s in docker archive %s: %w", manifestFile, a.path, err)
+	}
+	return nil
+}
+
+// resolveLink follows the chain of links starting at name to a regular file,
+// returning false if the chain is broken or circular.
+func resolveLink(files map[string]fileEntry, links map[string]string, name string) (fileEntry, bool) {
+	for range len(links) {
+		target, ok := links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	entry, ok := files[name]
+	return entry, ok
+}
+
+func (a *Archive) openFile(name string) (io.ReadCloser, int64, error) {
+	entry := a.files[name]
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sectionReadCloser{io.NewSectionReader(f, entry.offset, entry.size), f}, entry.size, nil
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+type countingReader struct {
+	io.Reader
+	N int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.N += int64(n)
+	return
+}
+
+// PutBlob stages the content of r as the blob with the provided digest.
+func (a *Archive) PutBlob(dgst digest.Digest, r io.Reader) error {
+	if !a.writing {
+		return fmt.Errorf("docker archive %s is not open for writing", a.path)
+	}
+	return a.staging.PutBlob(dgst, r)
+}
+
+// PutManifest adds an image to the archive under the provided name, given its
+// manifest. The config and layers of the image must already be staged with
+// PutBlob. Docker archives can only hold single-platform images with names.
+func (a *Archive) PutManifest(tag string, body []byte, desc v1.Descriptor) error {
+	if !a.writing {
+		return fmt.Errorf("docker archive %s is not open for writing", a.path)
+	}
+	if !image.MediaType(desc.MediaType).IsManifest() {
+		return fmt.Errorf("docker archive %s can't store %s manifests; use limitPlatforms to select a single platform", a.path, desc.MediaType)
+	}
+	if tag == "" {
+		return fmt.Errorf("docker archive %s can't store images without names", a.path)
+	}
+	repo, tagStr, err := splitRepoTag(tag)
+	if err != nil {
+		return err
+	}
+
+	var manifest image.ParsedManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return err
+	}
+	entry := manifestEntry{
+		Config:   blobPath(manifest.Config.Digest),
+		RepoTags: []string{repo + ":" + tagStr},
+	}
+	for _, blob := range manifest.Blobs() {
+		ok, err := a.staging.HasBlob(blob.Digest)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("docker archive %s is missing blob %s (foreign layers require the copy policy)", a.path, blob.Digest)
+		}
+	}
+	for _, layer := range manifest.Layers {
+		entry.Layers = append(entry.Layers, blobPath(layer.Digest))
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	a.images[entry.RepoTags[0]] = entry
+	return nil
+}
+
+// Discard removes the content staged for the archive without writing the
+// tarball, leaving any existing file at its path in place.
+func (a *Archive) Discard() error {
+	if !a.writing {
+		return fmt.Errorf("docker archive %s is not open for writing", a.path)
+	}
+
+	archivesMu.Lock()
+	delete(archives, a.path)
+	archivesMu.Unlock()
+	return os.RemoveAll(a.stagingDir)
+}
+
+// Commit writes the tarball with every image added to the archive, replacing
+// any existing file at its path, and removes the staged content.
+func (a *Archive) Commit() (err error) {
+	if !a.writing {
+		return fmt.Errorf("docker archive %s is not open for writing", a.path)
+	}
+
+	archivesMu.Lock()
+	delete(archives, a.path)
+	archivesMu.Unlock()
+	defer os.RemoveAll(a.stagingDir)
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(a.path), ".tmp-"+filepath.Base(a.path)+"-*.tar")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	var (
+		entries      []manifestEntry
+		repositories = make(map[string]map[string]string)
+		written      = make(map[string]bool)
+	)
+	tw := tar.NewWriter(f)
+	for _, repoTag := range slices.Sorted(maps.Keys(a.images)) {
+		entry := a.images[repoTag]
+		entries = append(entries, entry)
+		for _, name := range append([]string{entry.Config}, entry.Layers...) {
+			if written[name] {
+				continue
+			}
+			written[name] = true
+			if err := a.writeStagedBlob(tw, name); err != nil {
+				return err
+			}
+		}
+
+		repo, tag, _ := splitRepoTag(repoTag)
+		if repositories[repo] == nil {
+			repositories[repo] = make(map[string]string)
+		}
+		if n := len(entry.Layers); n > 0 {
+			repositories[repo][tag] = path.Base(entry.Layers[n-1])
+		}
+	}
+
+	if err := writeJSON(tw, manifestFile, entries); err != nil {
+		return err
+	}
+	if err := writeJSON(tw, repositoriesFile, repositories); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), a.path)
+}
+
+func (a *Archive) writeStagedBlob(tw *tar.Writer, name string) error {
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(name))), path.Base(name))
+	r, size, err := a.staging.GetBlob(dgst)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: size}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+func writeJSON(tw *tar.Writer, name string, v any) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(encoded))}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(encoded)
+	return err
+}
+
+func blobPath(dgst digest.Digest) string {
+	return path.Join(blobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// splitRepoTag splits an image name like "alpine:3.19" into its repository and
+// tag, using "latest" if the name has no tag.
+func splitRepoTag(ref string) (repo, tag string, err error) {
+	t, err := name.NewTag(ref)
+	if err != nil {
+		return "", "", err
+	}
+	tag = t.TagStr()
+	return strings.TrimSuffix(ref, ":"+tag), tag, nil
+}
+
+// sameName returns true if two image names refer to the same repository and
+// tag after normalization (for example, "alpine" and
+// "docker.io/library/alpine:latest").
+func sameName(a, b string) bool {
+	ta, errA := name.NewTag(a)
+	tb, errB := name.NewTag(b)
+	return errA == nil && errB == nil && ta.Name() == tb.Name()
+}
@@ -0,0 +1,161 @@
+package copy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+// Backend provides access to the blobs and manifests in one kind of image
+// storage, like a registry or a directory on the local filesystem. The copier
+// selects a Backend for each repository based on its transport.
+//
+// When a blob, manifest, or repository does not exist, a Backend returns an
+// error that wraps fs.ErrNotExist, or a registry error with a 404 status.
+type Backend interface {
+	// StatBlob returns whether repo contains the blob with the provided digest.
+	StatBlob(repo image.Repository, dgst digest.Digest) (bool, error)
+
+	// GetBlob opens the blob with the provided digest in repo, and returns its
+	// size.
+	GetBlob(repo image.Repository, dgst digest.Digest) (r io.ReadCloser, size int64, err error)
+
+	// PutBlob writes the content of r to repo as the blob with the provided
+	// digest and size, failing if the content does not match the digest.
+	PutBlob(repo image.Repository, dgst digest.Digest, size int64, r io.Reader) error
+
+	// MountBlob makes the blob with the provided digest available in repo
+	// without transferring its content, if the storage supports it, and returns
+	// whether it did so. The from repository is another repository in the same
+	// storage that is known to contain the blob, or the zero Repository if no
+	// such repository is known. If the storage started an upload of the blob in
+	// place of the mount, MountBlob returns it, and the caller must complete or
+	// cancel it rather than calling PutBlob.
+	MountBlob(repo image.Repository, dgst digest.Digest, from image.Repository) (mounted bool, upload BlobUpload, err error)
+
+	// GetManifest returns the content and media type of the manifest in repo
+	// with the provided tag or digest. The media type may be empty if the
+	// storage doesn't record it, in which case the copier detects it from the
+	// content.
+	GetManifest(repo image.Repository, reference string) (body []byte, mediaType string, err error)
+
+	// PutManifest writes a manifest to the repository of img, and points the
+	// tag of img at it if the tag is not empty.
+	PutManifest(img image.Image, manifest image.ManifestKind) error
+
+	// HeadManifest returns a descriptor for the manifest in repo with the
+	// provided tag or digest, without necessarily downloading its content.
+	HeadManifest(repo image.Repository, reference string) (v1.Descriptor, error)
+
+	// ListTags returns the tags in repo.
+	ListTags(repo image.Repository) ([]string, error)
+
+	// Referrers returns descriptors for the manifests in repo whose subject is
+	// the manifest with the provided digest, or no descriptors if there are
+	// none or the storage can't find them.
+	Referrers(repo image.Repository, dgst digest.Digest) ([]v1.Descriptor, error)
+}
+
+// BlobUpload is an upload of a single blob that a Backend has started but not
+// finished.
+type BlobUpload interface {
+	// Complete writes the content of r as the blob, as if by PutBlob.
+	Complete(size int64, r io.Reader) error
+
+	// Cancel abandons the upload, on a best-effort basis.
+	Cancel()
+}
+
+// FinishingBackend is implemented by backends that must prepare each
+// destination repository before any copies to it begin, and finish writing it
+// after all copies are done. Discard abandons a prepared repository instead of
+// finishing it, leaving any existing content in place.
+type FinishingBackend interface {
+	Backend
+	Prepare(repo image.Repository) error
+	Finish(repo image.Repository) error
+	Discard(repo image.Repository) error
+}
+
+// AccessCheckingBackend is implemented by backends that can cheaply check,
+// before any copies begin, whether the copier will be able to pull from or push
+// to a repository.
+type AccessCheckingBackend interface {
+	Backend
+	CheckAccess(repo image.Repository, push bool) error
+}
+
+// backendSet selects a Backend for each transport.
+type backendSet map[image.Transport]Backend
+
+func defaultBackends() backendSet {
+	return backendSet{
+		image.RegistryTransport:        registryBackend{},
+		image.OCILayoutTransport:       layoutBackend{},
+		image.DockerArchiveTransport:   archiveBackend{},
+		image.RegistryStorageTransport: storageBackend{},
+	}
+}
+
+// For returns the Backend for the transport of repo.
+func (bs backendSet) For(repo image.Repository) (Backend, error) {
+	if backend, ok := bs[repo.Transport]; ok {
+		return backend, nil
+	}
+	return nil, fmt.Errorf("no backend for %s (transport %q)", repo, repo.Transport)
+}
+
+// uploadBlob writes the provided content to the repository as a blob with the
+// provided digest and size, unless the repository already has the blob.
+func (bs backendSet) uploadBlob(repo image.Repository, dgst digest.Digest, size int64, r io.Reader) error {
+	backend, err := bs.For(repo)
+	if err != nil {
+		return err
+	}
+	hasBlob, err := backend.StatBlob(repo, dgst)
+	if err != nil || hasBlob {
+		return err
+	}
+	return backend.PutBlob(repo, dgst, size, r)
+}
+
+// downloadBlob opens the blob with the provided digest in the repository.
+func (bs backendSet) downloadBlob(repo image.Repository, dgst digest.Digest) (r io.ReadCloser, size int64, err error) {
+	backend, err := bs.For(repo)
+	if err != nil {
+		return nil, 0, err
+	}
+	return backend.GetBlob(repo, dgst)
+}
+
+// referrersFromTag implements Backend.Referrers through the fallback tag schema
+// of the OCI distribution spec, where clients that push referrers also maintain
+// an index of them under the tag "<alg>-<hex>" in repo.
+func referrersFromTag(b Backend, repo image.Repository, dgst digest.Digest) ([]v1.Descriptor, error) {
+	body, _, err := b.GetManifest(repo, fmt.Sprintf("%s-%s", dgst.Algorithm(), dgst.Encoded()))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index v1.Index
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("invalid referrers index for %s@%s: %w", repo, dgst, err)
+	}
+	return index.Manifests, nil
+}
+
+// uploadManifest writes a manifest to the repository of img.
+func (bs backendSet) uploadManifest(img image.Image, manifest image.ManifestKind) error {
+	backend, err := bs.For(img.Repository)
+	if err != nil {
+		return err
+	}
+	return backend.PutManifest(img, manifest)
+}
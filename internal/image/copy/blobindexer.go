@@ -18,9 +18,9 @@ type blobIndexer struct {
 	blobs     *blobCopier
 }
 
-func newBlobIndexer(concurrency int, blobs *blobCopier) *blobIndexer {
+func newBlobIndexer(concurrency int, blobs *blobCopier, backends backendSet) *blobIndexer {
 	return &blobIndexer{
-		manifests: newManifestCache(concurrency),
+		manifests: newManifestCache(concurrency, backends),
 		blobs:     blobs,
 	}
 }
@@ -36,10 +36,12 @@ func (bi *blobIndexer) Submit(repo image.Repository, manifest image.ManifestKind
 		return
 	}
 
-	parsed := manifest.(image.Manifest).Parsed()
-	bi.blobs.RegisterSource(parsed.Config.Digest, repo)
-	for _, layer := range parsed.Layers {
-		bi.blobs.RegisterSource(layer.Digest, repo)
+	for _, blob := range manifest.(image.Manifest).Parsed().Blobs() {
+		// A manifest that references a foreign layer doesn't imply that the
+		// repository stores its content.
+		if !image.MediaType(blob.MediaType).IsForeignLayer() {
+			bi.blobs.RegisterSource(blob.Digest, repo)
+		}
 	}
 	dgst := manifest.Descriptor().Digest
 	log.Verbosef("[dstindex]\tindexed blobs referenced by %s@%s", repo, dgst)
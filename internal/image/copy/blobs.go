@@ -1,18 +1,19 @@
 package copy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
-	"strconv"
 	"sync"
+	"sync/atomic"
 
 	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/ahamlinman/magic-mirror/internal/image"
-	"github.com/ahamlinman/magic-mirror/internal/image/registry"
 	"github.com/ahamlinman/magic-mirror/internal/log"
 	"github.com/ahamlinman/magic-mirror/internal/parka"
 )
@@ -20,10 +21,15 @@ import (
 // blobCopier handles requests to copy blob content between repositories.
 type blobCopier struct {
 	parka.Set[blobCopyKey]
-	copyMu parka.KeyMutex[blobMutexKey]
+	copyMu   parka.KeyMutex[blobMutexKey]
+	backends backendSet
 
 	sourceMap   map[digest.Digest]mapset.Set[image.Repository]
+	foreignMap  map[digest.Digest]v1.Descriptor
 	sourceMapMu sync.Mutex
+
+	mounts         atomic.Int64
+	mountFallbacks atomic.Int64
 }
 
 type blobCopyKey struct {
@@ -36,10 +42,18 @@ type blobMutexKey struct {
 	Registry image.Registry
 }
 
-func newBlobCopier(concurrency int) *blobCopier {
-	c := &blobCopier{sourceMap: make(map[digest.Digest]mapset.Set[image.Repository])}
+func newBlobCopier(concurrency int, backends backendSet) *blobCopier {
+	c := &blobCopier{
+		backends:   backends,
+		sourceMap:  make(map[digest.Digest]mapset.Set[image.Repository]),
+		foreignMap: make(map[digest.Digest]v1.Descriptor),
+	}
 	c.Set = parka.NewSet(c.copyBlob)
 	c.Set.Limit(concurrency)
+	// A blob can be shared by many specs, so one transient failure shouldn't
+	// fail every later spec that needs it. Specs already waiting on a failed
+	// copy still see its error.
+	c.Set.ForgetErrors(0)
 	return c
 }
 
@@ -53,19 +67,45 @@ func (c *blobCopier) RegisterSource(dgst digest.Digest, src image.Repository) {
 }
 
 // CopyAll ensures that all referenced blobs from the source repository exist
-// in the destination repository.
+// in the destination repository, or returns early if ctx is done. Copies that
+// nobody else is waiting for stop once CopyAll returns.
 //
 // The source repository will be registered as a source for the provided blobs.
 // Note that the copier may source the blobs for this operation from another
 // repository, and may use the provided repository as a source for future
 // unrelated copies.
-func (c *blobCopier) CopyAll(src, dst image.Repository, dgsts ...digest.Digest) error {
+func (c *blobCopier) CopyAll(ctx context.Context, src, dst image.Repository, dgsts ...digest.Digest) error {
 	keys := make([]blobCopyKey, len(dgsts))
 	for i, dgst := range dgsts {
 		c.RegisterSource(dgst, src)
 		keys[i] = blobCopyKey{Digest: dgst, Dst: dst}
 	}
-	return c.Set.Collect(keys...)
+	return c.Set.CollectContext(ctx, keys...)
+}
+
+// CopyForeign ensures that the content of all provided foreign layers exists in
+// the destination repository, fetching it from the URLs in each descriptor if
+// no other source is known. Like CopyAll, it returns early if ctx is done.
+func (c *blobCopier) CopyForeign(ctx context.Context, dst image.Repository, layers ...v1.Descriptor) error {
+	keys := make([]blobCopyKey, len(layers))
+	for i, layer := range layers {
+		c.registerForeign(layer)
+		keys[i] = blobCopyKey{Digest: layer.Digest, Dst: dst}
+	}
+	return c.Set.CollectContext(ctx, keys...)
+}
+
+func (c *blobCopier) registerForeign(layer v1.Descriptor) {
+	c.sourceMapMu.Lock()
+	defer c.sourceMapMu.Unlock()
+	c.foreignMap[layer.Digest] = layer
+}
+
+func (c *blobCopier) foreign(dgst digest.Digest) (layer v1.Descriptor, ok bool) {
+	c.sourceMapMu.Lock()
+	defer c.sourceMapMu.Unlock()
+	layer, ok = c.foreignMap[dgst]
+	return
 }
 
 func (c *blobCopier) sources(dgst digest.Digest) mapset.Set[image.Repository] {
@@ -87,6 +127,12 @@ func (c *blobCopier) copyBlob(ph *parka.Handle, req blobCopyKey) (err error) {
 	c.copyMu.LockDetached(ph, key)
 	defer c.copyMu.Unlock(key)
 
+	// Every copier that wanted this blob may have given up while we waited.
+	ctx := ph.Context()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	srcSet := c.sources(req.Digest)
 	if srcSet.Contains(req.Dst) {
 		log.Verbosef("[blob]\tknown %s@%s", req.Dst, req.Digest)
@@ -99,7 +145,11 @@ func (c *blobCopier) copyBlob(ph *parka.Handle, req blobCopyKey) (err error) {
 		}
 	}()
 
-	hasBlob, err := checkForExistingBlob(req.Dst, req.Digest)
+	dstBackend, err := c.backends.For(req.Dst)
+	if err != nil {
+		return err
+	}
+	hasBlob, err := dstBackend.StatBlob(req.Dst, req.Digest)
 	if err != nil {
 		return err
 	}
@@ -112,54 +162,56 @@ func (c *blobCopier) copyBlob(ph *parka.Handle, req blobCopyKey) (err error) {
 	// iteration order to balance the use of different sources when the same blob
 	// is copied to multiple destinations.
 	allSources := srcSet.ToSlice()
+	if len(allSources) == 0 {
+		return c.copyForeignBlob(ctx, req)
+	}
 	source := allSources[0]
 
-	// If we have access to another repository on the same destination registry
-	// that we know contains this blob, it's cheaper for the registry to copy it
+	// If we have access to another repository in the same destination storage
+	// that we know contains this blob, it's cheaper for the storage to copy it
 	// locally ("mounting" it) than for us to send it.
 	var mountRepo image.Repository
 	for _, src := range allSources {
-		if src.Registry == req.Dst.Registry {
+		if src.Transport == req.Dst.Transport && src.Registry == req.Dst.Registry {
 			mountRepo = src
 			break
 		}
 	}
 
-	uploadURL, mounted, err := requestBlobUploadURL(req.Dst, req.Digest, mountRepo.Namespace)
+	mounted, upload, err := dstBackend.MountBlob(req.Dst, req.Digest, mountRepo)
 	if err != nil {
 		return err
 	}
 	if mounted {
+		c.mounts.Add(1)
+	}
+	if !mounted && mountRepo != (image.Repository{}) {
+		c.mountFallbacks.Add(1)
+		log.Verbosef("[blob]\tcould not mount %s@%s to %s, uploading instead", mountRepo, req.Digest, req.Dst)
+	}
+	if mounted && mountRepo.Namespace != "" {
 		log.Verbosef("[blob]\tmounted %s@%s to %s", mountRepo, req.Digest, req.Dst)
 		return nil
 	}
-
-	blob, size, err := downloadBlob(source, req.Digest)
-	if err != nil {
-		return err // TODO: DELETE the upload request to cancel it.
-	}
-	defer blob.Close()
-
-	query, err := url.ParseQuery(uploadURL.RawQuery)
-	if err != nil {
-		return err
+	if mounted {
+		log.Verbosef("[blob]\tmounted %s to %s", req.Digest, req.Dst)
+		return nil
 	}
-	query.Add("digest", req.Digest.String())
-	uploadURL.RawQuery = query.Encode()
 
-	uploadReq, err := http.NewRequest(http.MethodPut, uploadURL.String(), blob)
+	blob, size, err := c.backends.downloadBlob(source, req.Digest)
 	if err != nil {
+		if upload != nil {
+			upload.Cancel()
+		}
 		return err
 	}
-	uploadReq.Header.Add("Content-Type", "application/octet-stream")
-	uploadReq.Header.Add("Content-Length", strconv.FormatInt(size, 10))
+	defer blob.Close()
 
-	client, err := registry.GetClient(req.Dst, registry.PushScope)
-	if err != nil {
-		return err
+	if upload != nil {
+		err = upload.Complete(size, contextReader{ctx, blob})
+	} else {
+		err = dstBackend.PutBlob(req.Dst, req.Digest, size, contextReader{ctx, blob})
 	}
-
-	_, err = client.DoExpectingNoBody(uploadReq, http.StatusCreated)
 	if err != nil {
 		return err
 	}
@@ -168,80 +220,109 @@ func (c *blobCopier) copyBlob(ph *parka.Handle, req blobCopyKey) (err error) {
 	return nil
 }
 
-func checkForExistingBlob(repo image.Repository, dgst digest.Digest) (bool, error) {
-	client, err := registry.GetClient(repo, registry.PullScope)
-	if err != nil {
-		return false, err
+// copyForeignBlob copies a foreign layer with no known source repository from
+// its original URLs.
+func (c *blobCopier) copyForeignBlob(ctx context.Context, req blobCopyKey) error {
+	layer, ok := c.foreign(req.Digest)
+	if !ok {
+		return fmt.Errorf("no known source for %s@%s", req.Dst, req.Digest)
 	}
 
-	u := repo.Registry.APIBaseURL()
-	u.Path = fmt.Sprintf("/v2/%s/blobs/%s", repo.Namespace, dgst)
-	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	blob, err := downloadForeignBlob(ctx, layer)
 	if err != nil {
-		return false, err
+		return err
+	}
+	defer blob.Close()
+
+	if err := c.backends.uploadBlob(req.Dst, req.Digest, layer.Size, contextReader{ctx, blob}); err != nil {
+		return err
 	}
 
-	resp, err := client.DoExpectingNoBody(req, http.StatusOK, http.StatusNotFound)
-	ok := (err == nil && resp.StatusCode == http.StatusOK)
-	return ok, err
+	log.Verbosef("[blob]\tcopied foreign %s to %s", req.Digest, req.Dst)
+	return nil
 }
 
-func downloadBlob(repo image.Repository, dgst digest.Digest) (r io.ReadCloser, size int64, err error) {
-	client, err := registry.GetClient(repo, registry.PullScope)
-	if err != nil {
-		return nil, 0, err
+// downloadForeignBlob downloads the content of a foreign layer from the first
+// of its URLs that serves it. Since foreign URLs sit outside of any registry,
+// the returned reader fails at the end of the content unless it matches the
+// digest and size of the layer's descriptor.
+func downloadForeignBlob(ctx context.Context, layer v1.Descriptor) (io.ReadCloser, error) {
+	if len(layer.URLs) == 0 {
+		return nil, fmt.Errorf("foreign layer %s has no URLs", layer.Digest)
 	}
-
-	u := repo.Registry.APIBaseURL()
-	u.Path = fmt.Sprintf("/v2/%s/blobs/%s", repo.Namespace, dgst)
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
-	if err != nil {
-		return nil, 0, err
+	if err := layer.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("foreign layer %s: %w", layer.Digest, err)
 	}
 
-	resp, err := client.DoExpecting(req, http.StatusOK)
-	if err != nil {
-		return nil, 0, err
+	var errs []error
+	for _, u := range layer.URLs {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			errs = append(errs, fmt.Errorf("unexpected status from %s: %s", u, resp.Status))
+			continue
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength != layer.Size {
+			resp.Body.Close()
+			errs = append(errs, fmt.Errorf("%s serves %d bytes, expected %d", u, resp.ContentLength, layer.Size))
+			continue
+		}
+		return &verifyingReader{
+			ReadCloser: resp.Body,
+			layer:      layer,
+			verifier:   layer.Digest.Verifier(),
+		}, nil
 	}
-
-	r = resp.Body
-	size, err = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	return
+	return nil, fmt.Errorf("failed to download foreign layer %s: %w", layer.Digest, errors.Join(errs...))
 }
 
-func requestBlobUploadURL(repo image.Repository, dgst digest.Digest, mountNamespace string) (upload *url.URL, mounted bool, err error) {
-	client, err := registry.GetClient(repo, registry.PushScope)
-	if err != nil {
-		return nil, false, err
-	}
+// verifyingReader checks the content of a foreign layer against its
+// descriptor as it streams, and replaces the final io.EOF with an error if the
+// content doesn't match.
+type verifyingReader struct {
+	io.ReadCloser
+	layer    v1.Descriptor
+	verifier digest.Verifier
+	n        int64
+}
 
-	query := make(url.Values)
-	if mountNamespace != "" {
-		query.Add("mount", dgst.String())
-		query.Add("from", mountNamespace)
-	} else {
-		query.Add("digest", dgst.String())
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.verifier.Write(p[:n])
+	r.n += int64(n)
+	if r.n > r.layer.Size {
+		return n, fmt.Errorf("foreign layer %s is larger than %d bytes", r.layer.Digest, r.layer.Size)
 	}
-
-	u := repo.Registry.APIBaseURL()
-	u.Path = fmt.Sprintf("/v2/%s/blobs/uploads/", repo.Namespace)
-	u.RawQuery = query.Encode()
-	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
-	if err != nil {
-		return nil, false, err
+	if err == io.EOF {
+		if r.n != r.layer.Size {
+			return n, fmt.Errorf("foreign layer %s has %d bytes, expected %d", r.layer.Digest, r.n, r.layer.Size)
+		}
+		if !r.verifier.Verified() {
+			return n, fmt.Errorf("content of foreign layer %s does not match its digest", r.layer.Digest)
+		}
 	}
+	return n, err
+}
 
-	resp, err := client.DoExpectingNoBody(req, http.StatusCreated, http.StatusAccepted)
-	if err != nil {
-		return nil, false, err
-	}
+// contextReader fails reads once its context is done, so that abandoned blob
+// copies stop transferring content.
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
 
-	if resp.StatusCode == http.StatusCreated {
-		// The mount was successful.
-		return nil, true, nil
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
-
-	// The mount was not successful, and we need to provide a regular upload URL.
-	upload, err = u.Parse(resp.Header.Get("Location"))
-	return
+	return r.Reader.Read(p)
 }
@@ -0,0 +1,89 @@
+package copy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/registry"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+// copyCompanions copies the companion tags requested by spec from the source
+// repository to the destination repository, given the source manifest and the
+// manifest now present at the destination.
+//
+// Tools like cosign name companion tags after the digest of the image they
+// describe, so they are only meaningful at the destination when the copy
+// preserved that digest.
+func (c *copier) copyCompanions(spec Spec, srcManifest, dstManifest image.ManifestKind) error {
+	if spec.CompanionTags.Cardinality() == 0 {
+		return nil
+	}
+	if spec.Dst.Transport == image.DockerArchiveTransport {
+		// Docker archives record images by name rather than tag, and "docker load"
+		// has no use for companion artifacts.
+		log.Verbosef("[image]\tskipping companion tags for %s, since %s is a docker archive", spec.Src, spec.Dst)
+		return nil
+	}
+
+	if !preservesDigest(srcManifest, dstManifest) {
+		log.Verbosef("[image]\tskipping companion tags for %s, since %s has a different digest", spec.Src, spec.Dst)
+		return nil
+	}
+
+	srcDigest := srcManifest.Descriptor().Digest
+	var errs []error
+	for suffix := range spec.CompanionTags.All() {
+		if suffix == signatureSuffix && c.signsWithTag(spec) {
+			// Copying the source signatures over the destination tag would drop
+			// the mirror's own signature, so signWithTag merges them instead.
+			continue
+		}
+
+		tag := companionTag(srcDigest, suffix)
+		src := image.Image{Repository: spec.Src.Repository, Tag: tag}
+		dst := image.Image{Repository: spec.Dst.Repository, Tag: tag}
+
+		if _, err := c.srcManifests.Get(src); err != nil {
+			if !isNotFound(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		// Companion copies go through the same set as top-level specs, so that
+		// specs sharing a source digest and destination repository share the work.
+		if err := c.copies.Get(Spec{Src: src, Dst: dst}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Verbosef("[image]\tcopied companion %s to %s", src, dst)
+	}
+	return errors.Join(errs...)
+}
+
+// preservesDigest returns true if dstManifest has the same digest as
+// srcManifest, under the algorithm of the source digest.
+func preservesDigest(srcManifest, dstManifest image.ManifestKind) bool {
+	srcDigest := srcManifest.Descriptor().Digest
+	return srcDigest.Algorithm().FromBytes(dstManifest.Encoded()) == srcDigest
+}
+
+// companionTag returns the tag under which cosign's tag-based scheme stores
+// the companion artifact with the provided suffix for the provided digest.
+func companionTag(dgst digest.Digest, suffix string) string {
+	return fmt.Sprintf("%s-%s.%s", dgst.Algorithm(), dgst.Encoded(), suffix)
+}
+
+// isNotFound returns true if err represents a 404 response from a registry, or
+// a missing file in local storage.
+func isNotFound(err error) bool {
+	var regErr *registry.Error
+	return errors.As(err, &regErr) && regErr.StatusCode == http.StatusNotFound ||
+		errors.Is(err, fs.ErrNotExist)
+}
@@ -2,15 +2,20 @@ package copy
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/signature"
 	"github.com/ahamlinman/magic-mirror/internal/log"
 	"github.com/ahamlinman/magic-mirror/internal/parka"
 )
@@ -19,16 +24,70 @@ import (
 // provided copy specs, using the provided concurrency for each component of the
 // overall operation.
 func CopyAll(concurrency int, specs ...Spec) error {
+	return CopyAllWithOptions(concurrency, Options{}, specs...)
+}
+
+// Options controls optional behavior of CopyAllWithOptions.
+type Options struct {
+	// SignaturePolicy, if not nil, requires the source image of every spec to
+	// carry a valid signature under the policy, and refuses to copy any source
+	// image without one before transferring any of its content.
+	SignaturePolicy *signature.Policy
+
+	// SigningKey, if not nil, signs the manifest at the destination of every spec
+	// after copying it, with a payload that records the source reference and
+	// digest. Destinations that already carry the same signature are unchanged.
+	SigningKey crypto.Signer
+
+	// SignAsReferrers attaches destination signatures as referrers of the
+	// signed manifests, rather than under cosign's companion tags.
+	SignAsReferrers bool
+
+	// KnownBlobs lists the digests of blobs that each repository is assumed to
+	// contain already, which are never copied there.
+	KnownBlobs map[image.Repository][]digest.Digest
+
+	// Preflight selects what happens when the access checks made before any
+	// copies begin find a source that can't be pulled or a destination that
+	// can't be pushed. The zero value refuses to copy anything.
+	Preflight Preflight
+}
+
+// CopyAllWithOptions is like CopyAll, with the optional behavior in opts.
+func CopyAllWithOptions(concurrency int, opts Options, specs ...Spec) error {
 	keys, err := coalesceRequests(specs)
 	if err != nil {
 		return err
 	}
-	copier := newCopier(concurrency)
-	return copier.CopyAll(keys...)
+	copier := newCopier(concurrency, defaultBackends())
+	copier.policy = opts.SignaturePolicy
+	copier.signingKey = opts.SigningKey
+	copier.signReferrers = opts.SignAsReferrers
+	for repo, known := range opts.KnownBlobs {
+		for _, dgst := range known {
+			copier.blobs.RegisterSource(dgst, repo)
+		}
+	}
+	keys, preflightErr := copier.preflight(concurrency, opts.Preflight, keys)
+	if preflightErr != nil && len(keys) == 0 {
+		return preflightErr
+	}
+	return errors.Join(preflightErr, copier.CopyAll(keys...))
 }
 
 type copier struct {
-	copies parka.Set[Spec]
+	copies   parka.Set[Spec]
+	backends backendSet
+
+	// policy, if not nil, is the signature policy for the sources of the
+	// top-level specs passed to CopyAll, which topLevel records.
+	policy   *signature.Policy
+	topLevel map[Spec]bool
+
+	// signingKey, if not nil, signs the destinations of the top-level specs.
+	signingKey    crypto.Signer
+	signReferrers bool
+	signMu        parka.KeyMutex[image.Image]
 
 	blobs        *blobCopier
 	srcManifests *manifestCache
@@ -39,14 +98,15 @@ type copier struct {
 	statsTimer *time.Timer
 }
 
-func newCopier(concurrency int) *copier {
-	blobs := newBlobCopier(concurrency)
-	srcManifests := newManifestCache(concurrency)
-	platforms := newPlatformCopier(srcManifests, blobs)
-	dstManifests := newManifestCache(concurrency)
-	dstIndexer := newBlobIndexer(concurrency, blobs)
+func newCopier(concurrency int, backends backendSet) *copier {
+	blobs := newBlobCopier(concurrency, backends)
+	srcManifests := newManifestCache(concurrency, backends)
+	platforms := newPlatformCopier(srcManifests, blobs, backends)
+	dstManifests := newManifestCache(concurrency, backends)
+	dstIndexer := newBlobIndexer(concurrency, blobs, backends)
 
 	c := &copier{
+		backends:     backends,
 		blobs:        blobs,
 		srcManifests: srcManifests,
 		platforms:    platforms,
@@ -59,19 +119,80 @@ func newCopier(concurrency int) *copier {
 }
 
 func (c *copier) CopyAll(specs ...Spec) error {
+	// Some backends (like Docker archives) write each destination as a whole
+	// once every copy is done, and must prepare it before any copies start.
+	finishing, err := c.prepareDestinations(specs)
+	if err != nil {
+		return err
+	}
+
+	// Companion copies don't require signatures of their own, so only the
+	// top-level specs are subject to verification.
+	c.topLevel = make(map[Spec]bool, len(specs))
+	for _, spec := range specs {
+		c.topLevel[spec] = true
+	}
+
 	// Start up the copies for all known specs.
 	c.copies.Inform(specs...)
 
 	// Then, wait for each spec and aggregate the errors (unlike Collect).
 	errs := make([]error, len(specs))
+	failed := make(map[image.Repository]bool)
 	for i, spec := range specs {
 		errs[i] = c.copies.Get(spec)
+		if errs[i] != nil {
+			failed[spec.Dst.Repository] = true
+		}
+	}
+	// Finishing a destination whose copies failed would replace its existing
+	// content with a partial copy.
+	for repo, backend := range finishing {
+		if failed[repo] {
+			log.Printf("[image]\tdiscarding %s since copies to it failed", repo)
+			errs = append(errs, backend.Discard(repo))
+		} else {
+			errs = append(errs, backend.Finish(repo))
+		}
 	}
 
 	c.printStats()
 	return errors.Join(errs...)
 }
 
+// prepareDestinations prepares every destination repository among specs whose
+// backend is a FinishingBackend, and returns those repositories and backends.
+// If any repository fails to prepare, prepareDestinations discards the ones it
+// has already prepared.
+func (c *copier) prepareDestinations(specs []Spec) (map[image.Repository]FinishingBackend, error) {
+	finishing := make(map[image.Repository]FinishingBackend)
+	discardAll := func() {
+		for repo, fb := range finishing {
+			fb.Discard(repo)
+		}
+	}
+	for _, spec := range specs {
+		if _, ok := finishing[spec.Dst.Repository]; ok {
+			continue
+		}
+		backend, err := c.backends.For(spec.Dst.Repository)
+		if err != nil {
+			discardAll()
+			return nil, err
+		}
+		fb, ok := backend.(FinishingBackend)
+		if !ok {
+			continue
+		}
+		if err := fb.Prepare(spec.Dst.Repository); err != nil {
+			discardAll()
+			return nil, err
+		}
+		finishing[spec.Dst.Repository] = fb
+	}
+	return finishing, nil
+}
+
 const statsInterval = 5 * time.Second
 
 func (c *copier) printStats() {
@@ -81,15 +202,15 @@ func (c *copier) printStats() {
 		imageStats    = c.copies.Stats()
 	)
 	log.Printf(
-		"[stats] blobs: %d of %d copied; platforms: %d of %d copied; images: %d of %d done",
-		blobStats.Handled, blobStats.Total,
+		"[stats] blobs: %d of %d copied (%d mounted, %d mounts fell back to uploads); platforms: %d of %d copied; images: %d of %d done",
+		blobStats.Handled, blobStats.Total, c.blobs.mounts.Load(), c.blobs.mountFallbacks.Load(),
 		platformStats.Handled, platformStats.Total,
 		imageStats.Handled, imageStats.Total,
 	)
 	c.statsTimer.Reset(statsInterval)
 }
 
-func (c *copier) copySpec(_ *parka.Handle, spec Spec) error {
+func (c *copier) copySpec(ph *parka.Handle, spec Spec) error {
 	log.Verbosef("[image]\tstarting copy from %s to %s", spec.Src, spec.Dst)
 
 	var (
@@ -105,22 +226,33 @@ func (c *copier) copySpec(_ *parka.Handle, spec Spec) error {
 	if err != nil {
 		return err
 	}
+	if c.topLevel[spec] {
+		if err := c.verifySource(spec, srcManifest); err != nil {
+			return err
+		}
+	}
 
 	dstWait.Wait()
 	if dstErr == nil {
 		c.dstIndexer.Submit(spec.Dst.Repository, dstManifest)
-		if bytes.Equal(srcManifest.Encoded(), dstManifest.Encoded()) && (spec.Transform == Transform{}) {
+		if bytes.Equal(srcManifest.Encoded(), dstManifest.Encoded()) && spec.Transform.preservesSource() {
 			log.Verbosef("[image]\tno change from %s to %s", spec.Src, spec.Dst)
-			return nil
+			return c.finishSpec(ph.Context(), spec, srcManifest, dstManifest)
 		}
 	}
 
+	var uploaded image.ManifestKind
 	srcMediaType := srcManifest.GetMediaType()
 	switch {
 	case srcMediaType.IsIndex():
-		err = c.copyIndex(spec, srcManifest.(image.Index))
+		uploaded, err = c.copyIndex(spec, srcManifest.(image.Index))
 	case srcMediaType.IsManifest():
-		_, err = c.platforms.Copy(spec.Src, spec.Dst)
+		uploaded, err = c.platforms.Copy(spec.Src, spec.Dst, spec.Transform.ForeignLayers)
+	case srcMediaType.IsSchema1():
+		if dstErr != nil {
+			dstManifest = nil
+		}
+		uploaded, err = c.convertSchema1(ph.Context(), spec, srcManifest.(image.Schema1Manifest), dstManifest)
 	default:
 		err = fmt.Errorf("unknown manifest type for %s: %s", spec.Src, srcMediaType)
 	}
@@ -129,75 +261,168 @@ func (c *copier) copySpec(_ *parka.Handle, spec Spec) error {
 	}
 
 	log.Verbosef("[image]\tfully mirrored %s to %s", spec.Src, spec.Dst)
-	return nil
+	return c.finishSpec(ph.Context(), spec, srcManifest, uploaded)
 }
 
-func (c *copier) copyIndex(spec Spec, srcIndex image.Index) error {
-	src := spec.Src
-	dst := spec.Dst
+// finishSpec copies the companions of spec and signs its destination, given
+// the source manifest and the manifest now present at the destination.
+// Signing comes last, so that a copied companion signature can't replace it.
+func (c *copier) finishSpec(ctx context.Context, spec Spec, srcManifest, dstManifest image.ManifestKind) error {
+	if err := c.copyCompanions(spec, srcManifest, dstManifest); err != nil {
+		return err
+	}
+	if !c.topLevel[spec] {
+		return nil
+	}
+	return c.signDestination(ctx, spec, srcManifest, dstManifest)
+}
+
+// maxIndexDepth is the maximum number of levels of nested indexes that
+// copyIndex will follow below a top-level index.
+const maxIndexDepth = 8
 
+// copyIndex copies the platforms selected from srcIndex to the destination of
+// spec, and returns the manifest or index uploaded to that destination.
+func (c *copier) copyIndex(spec Spec, srcIndex image.Index) (image.ManifestKind, error) {
+	uploaded, err := c.copyNestedIndex(spec, srcIndex, spec.Dst, nil)
+	if err == nil && uploaded == nil {
+		err = fmt.Errorf("could not find any requested platforms in %s", spec.Src)
+	}
+	return uploaded, err
+}
+
+// copyNestedIndex copies srcIndex to dst, given the digests of the indexes
+// that enclose srcIndex (starting at the top level). Indexes may contain
+// other indexes, which copyNestedIndex copies recursively to the destination
+// repository before uploading srcIndex itself. Platform filtering applies only
+// to the manifests at the leaves of this tree. If filtering removes every leaf
+// below srcIndex, copyNestedIndex returns a nil manifest and error, and does
+// not upload anything.
+func (c *copier) copyNestedIndex(spec Spec, srcIndex image.Index, dst image.Image, ancestors []digest.Digest) (image.ManifestKind, error) {
 	if err := srcIndex.Validate(); err != nil {
-		return err
+		return nil, err
 	}
 
-	var (
-		uploadIndex    = srcIndex
-		dstIndex       image.ParsedIndex
-		dstIndexCopied bool
-	)
-	ensureNewDstIndex := func() {
-		if !dstIndexCopied {
-			dstIndex = image.DeepCopy(srcIndex).(image.Index).Parsed()
-			dstIndexCopied = true
-		}
+	srcDigest := srcIndex.Descriptor().Digest
+	if len(ancestors) > maxIndexDepth {
+		return nil, fmt.Errorf("indexes in %s are nested more than %d levels deep", spec.Src, maxIndexDepth)
+	}
+	if slices.Contains(ancestors, srcDigest) {
+		return nil, fmt.Errorf("index %s in %s contains itself", srcDigest, spec.Src)
 	}
+	ancestors = append(slices.Clip(ancestors), srcDigest)
 
-	selectedDescriptors := srcIndex.Parsed().Manifests
+	type entry struct {
+		src, dst v1.Descriptor
+		keep     bool
+	}
+	var (
+		srcDescriptors = srcIndex.Parsed().Manifests
+		entries        = make([]entry, len(srcDescriptors))
+		leaves         []int
+		children       []int
+	)
 	limitPlatforms := spec.Transform.LimitPlatforms.ToPlatforms()
-	if len(limitPlatforms) > 0 {
-		ensureNewDstIndex()
-		selectedDescriptors = []v1.Descriptor{}
-		matcher := platforms.Any(limitPlatforms...)
-		for _, descriptor := range dstIndex.Manifests {
-			if matcher.Match(*descriptor.Platform) {
-				selectedDescriptors = append(selectedDescriptors, descriptor)
-			}
+	matcher := platforms.Any(limitPlatforms...)
+	for i, descriptor := range srcDescriptors {
+		entries[i].src = descriptor
+		switch {
+		case image.MediaType(descriptor.MediaType).IsIndex():
+			children = append(children, i)
+		case len(limitPlatforms) == 0:
+			leaves = append(leaves, i)
+		case descriptor.Platform != nil && matcher.Match(*descriptor.Platform):
+			// Entries without a platform, like artifacts in an index, can't match.
+			leaves = append(leaves, i)
 		}
-		dstIndex.Manifests = selectedDescriptors
 	}
 
-	imgsToCopy := make([]image.Image, len(selectedDescriptors))
-	for i, descriptor := range selectedDescriptors {
-		imgsToCopy[i] = image.Image{
-			Repository: src.Repository,
-			Digest:     descriptor.Digest,
+	leafImgs := make([]image.Image, len(leaves))
+	for j, i := range leaves {
+		leafImgs[j] = image.Image{
+			Repository: spec.Src.Repository,
+			Digest:     srcDescriptors[i].Digest,
 		}
 	}
 
-	if len(imgsToCopy) == 0 {
-		return fmt.Errorf("could not find any requested platforms in %s", src)
+	// A top-level index that selects a single platform is flattened to that
+	// platform's manifest.
+	if len(ancestors) == 1 && len(children) == 0 && len(leafImgs) == 1 {
+		return c.platforms.Copy(leafImgs[0], dst, spec.Transform.ForeignLayers)
 	}
-	if len(imgsToCopy) == 1 {
-		_, err := c.platforms.Copy(imgsToCopy[0], dst)
-		return err
+
+	var (
+		childWait sync.WaitGroup
+		childErrs = make([]error, len(children))
+	)
+	for j, i := range children {
+		childImg := image.Image{Repository: spec.Src.Repository, Digest: srcDescriptors[i].Digest}
+		childWait.Go(func() {
+			childManifest, err := c.srcManifests.Get(childImg)
+			if err != nil {
+				childErrs[j] = err
+				return
+			}
+			if !childManifest.GetMediaType().IsIndex() {
+				childErrs[j] = fmt.Errorf("%s is a manifest, but should be a manifest list", childImg)
+				return
+			}
+			childDst := image.Image{Repository: dst.Repository}
+			uploaded, err := c.copyNestedIndex(spec, childManifest.(image.Index), childDst, ancestors)
+			if uploaded != nil {
+				entries[i].dst = uploaded.Descriptor()
+				entries[i].keep = true
+			}
+			childErrs[j] = err
+		})
 	}
 
-	dstManifests, err := c.platforms.CopyAll(dst.Repository, imgsToCopy...)
-	if err != nil {
-		return err
+	dstManifests, err := c.platforms.CopyAll(dst.Repository, spec.Transform.ForeignLayers, leafImgs...)
+	childWait.Wait()
+	if err := errors.Join(err, errors.Join(childErrs...)); err != nil {
+		return nil, err
 	}
-	for i, dstManifest := range dstManifests {
-		desc := dstManifest.Descriptor()
-		if desc.Digest != selectedDescriptors[i].Digest {
-			ensureNewDstIndex()
-			dstIndex.Manifests[i] = desc
-			dstIndex.Manifests[i].Annotations = selectedDescriptors[i].Annotations
-			dstIndex.Manifests[i].Platform = selectedDescriptors[i].Platform
+	for j, i := range leaves {
+		entries[i].dst = dstManifests[j].Descriptor()
+		entries[i].keep = true
+	}
+
+	// Rewrite the descriptors of any entries whose digests changed as a result of
+	// transformations, keeping their platforms and annotations.
+	var (
+		dstDescriptors []v1.Descriptor
+		changed        bool
+	)
+	for _, entry := range entries {
+		if !entry.keep {
+			changed = true
+			continue
 		}
+		descriptor := entry.src
+		if entry.dst.Digest != entry.src.Digest {
+			changed = true
+			descriptor.MediaType = entry.dst.MediaType
+			descriptor.Digest = entry.dst.Digest
+			descriptor.Size = entry.dst.Size
+			descriptor.Data = nil
+		}
+		dstDescriptors = append(dstDescriptors, descriptor)
+	}
+	if len(dstDescriptors) == 0 {
+		return nil, nil
 	}
 
-	if dstIndexCopied {
-		uploadIndex = dstIndex
+	var uploadIndex image.ManifestKind = srcIndex
+	if changed {
+		dstIndex := image.DeepCopy(srcIndex).(image.Index).Parsed()
+		dstIndex.Manifests = dstDescriptors
+		uploadIndex = image.NewRawIndex(dstIndex, srcDigest.Algorithm())
+	}
+	if err := c.backends.uploadManifest(dst, uploadIndex); err != nil {
+		return nil, err
+	}
+	if len(ancestors) > 1 {
+		log.Verbosef("[image]\tmirrored nested index %s@%s to %s@%s", spec.Src.Repository, srcDigest, dst.Repository, uploadIndex.Descriptor().Digest)
 	}
-	return uploadManifest(dst, uploadIndex)
+	return uploadIndex, nil
 }
@@ -0,0 +1,1243 @@
+package copy
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/registry"
+	"github.com/ahamlinman/magic-mirror/internal/image/signature"
+)
+
+func TestCopyCompanionTags(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	putManifest := func(tag, content string) v1.Descriptor {
+		layer := reg.PutBlob("src/app", []byte(content))
+		config := reg.PutBlob("src/app", []byte(`{}`))
+		body := fmt.Appendf(nil,
+			`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+			v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, config,
+			v1.MediaTypeImageLayerGzip, layer, len(content),
+		)
+		return v1.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    reg.PutManifest("src/app", tag, v1.MediaTypeImageManifest, body),
+			Size:      int64(len(body)),
+		}
+	}
+	withPlatform := func(desc v1.Descriptor, platform string) v1.Descriptor {
+		p := platforms.MustParse(platform)
+		desc.Platform = &p
+		return desc
+	}
+
+	amd64 := withPlatform(putManifest("", "amd64 layer"), "linux/amd64")
+	arm64 := withPlatform(putManifest("", "arm64 layer"), "linux/arm64")
+	body, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{amd64, arm64},
+	})
+	require.NoError(t, err)
+	indexDigest := reg.PutManifest("src/app", "v1", v1.MediaTypeImageIndex, body)
+
+	// The source has a signature for the index, but no attestation.
+	sigTag := companionTag(indexDigest, signatureSuffix)
+	attTag := companionTag(indexDigest, attestationSuffix)
+	sig := putManifest(sigTag, "signature payload")
+
+	var companions companionSet
+	companions.Add(signatureSuffix)
+	companions.Add(attestationSuffix)
+
+	t.Run("preserved digest", func(t *testing.T) {
+		spec := Spec{Src: reg.Image("src/app", "v1"), Dst: reg.Image("dst/app", "v1"), CompanionTags: companions}
+		require.NoError(t, CopyAll(1, spec))
+
+		got, ok := reg.GetManifest("dst/app", sigTag)
+		require.True(t, ok, "missing signature companion at destination")
+		assert.Equal(t, sig.Digest, digest.FromBytes(got.Body))
+		_, ok = reg.GetManifest("dst/app", attTag)
+		assert.False(t, ok, "created attestation companion missing from source")
+	})
+
+	t.Run("changed digest", func(t *testing.T) {
+		var limitPlatforms platformSet
+		limitPlatforms.Add("linux/arm64")
+		spec := Spec{
+			Src:           reg.Image("src/app", "v1"),
+			Dst:           reg.Image("arm64/app", "v1"),
+			Transform:     Transform{LimitPlatforms: limitPlatforms},
+			CompanionTags: companions,
+		}
+		require.NoError(t, CopyAll(1, spec))
+
+		got, ok := reg.GetManifest("arm64/app", "v1")
+		require.True(t, ok, "missing filtered index")
+		assert.NotEqual(t, indexDigest, digest.FromBytes(got.Body))
+		_, ok = reg.GetManifest("arm64/app", sigTag)
+		assert.False(t, ok, "copied signature companion for a different digest")
+	})
+}
+
+func TestCopyArtifacts(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		helmConfig = []byte(`{"name":"chart","version":"1.0.0"}`)
+		helmChart  = []byte("not really a tarball")
+		wasmModule = []byte("\x00asm\x01\x00\x00\x00")
+		emptyJSON  = []byte("{}")
+		sbom       = []byte(`{"spdxVersion":"SPDX-2.3"}`)
+	)
+	for _, namespace := range []string{"src/helm", "src/wasm", "src/sbom"} {
+		for _, blob := range [][]byte{helmConfig, helmChart, wasmModule, emptyJSON, sbom} {
+			reg.PutBlob(namespace, blob)
+		}
+	}
+
+	// A Helm chart, with custom config and layer types. The manifest is served
+	// with a Content-Type parameter and an intentionally odd JSON layout to
+	// catch any re-encoding.
+	helmManifest := fmt.Appendf(nil, `{
+  "schemaVersion": 2,
+  "mediaType": %q,
+  "config": {"mediaType": "application/vnd.cncf.helm.config.v1+json", "digest": %q, "size": %d},
+  "layers": [{"mediaType": "application/vnd.cncf.helm.chart.content.v1.tar+gzip", "digest": %q, "size": %d}]
+}`,
+		v1.MediaTypeImageManifest,
+		digest.FromBytes(helmConfig), len(helmConfig),
+		digest.FromBytes(helmChart), len(helmChart),
+	)
+	helmDigest := reg.PutManifest("src/helm", "v1", v1.MediaTypeImageManifest+"; charset=utf-8", helmManifest)
+
+	// A WASM module with an artifactType, the empty config descriptor, and no
+	// mediaType field in the manifest itself.
+	wasmManifest := fmt.Appendf(nil,
+		`{"schemaVersion":2,"artifactType":"application/vnd.wasm.content.layer.v1+wasm","config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":"application/wasm","digest":%q,"size":%d}]}`,
+		v1.MediaTypeEmptyJSON, digest.FromBytes(emptyJSON),
+		digest.FromBytes(wasmModule), len(wasmModule),
+	)
+	reg.PutManifest("src/wasm", "v1", v1.MediaTypeImageManifest, wasmManifest)
+
+	// An SBOM that refers to the Helm chart as its subject.
+	sbomManifest := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"artifactType":"application/spdx+json","config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":"application/spdx+json","digest":%q,"size":%d}],"subject":{"mediaType":%q,"digest":%q,"size":%d}}`,
+		v1.MediaTypeImageManifest,
+		v1.MediaTypeEmptyJSON, digest.FromBytes(emptyJSON),
+		digest.FromBytes(sbom), len(sbom),
+		v1.MediaTypeImageManifest, helmDigest, len(helmManifest),
+	)
+	reg.PutManifest("src/sbom", "v1", v1.MediaTypeImageManifest, sbomManifest)
+
+	specs := []Spec{
+		{Src: reg.Image("src/helm", "v1"), Dst: reg.Image("dst/helm", "v1")},
+		{Src: reg.Image("src/wasm", "v1"), Dst: reg.Image("dst/wasm", "v1")},
+		{Src: reg.Image("src/sbom", "v1"), Dst: reg.Image("dst/sbom", "v1")},
+	}
+	require.NoError(t, CopyAll(2, specs...))
+
+	wantManifests := map[string][]byte{
+		"dst/helm": helmManifest,
+		"dst/wasm": wasmManifest,
+		"dst/sbom": sbomManifest,
+	}
+	for namespace, want := range wantManifests {
+		got, ok := reg.GetManifest(namespace, "v1")
+		if !assert.True(t, ok, "missing manifest in %s", namespace) {
+			continue
+		}
+		assert.Equal(t, string(want), string(got.Body), "manifest in %s not copied byte-for-byte", namespace)
+		assert.Equal(t, v1.MediaTypeImageManifest, got.ContentType, "wrong Content-Type in %s", namespace)
+	}
+
+	wantBlobs := map[string][][]byte{
+		"dst/helm": {helmConfig, helmChart},
+		"dst/wasm": {emptyJSON, wasmModule},
+		"dst/sbom": {emptyJSON, sbom},
+	}
+	for namespace, blobs := range wantBlobs {
+		for _, blob := range blobs {
+			_, ok := reg.GetBlob(namespace, digest.FromBytes(blob))
+			assert.True(t, ok, "missing blob %s in %s", digest.FromBytes(blob), namespace)
+		}
+	}
+}
+
+func TestConvertSchema1(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		baseLayer = gzipBytes(t, "base layer")
+		appLayer  = gzipBytes(t, "app layer")
+		emptyTar  = gzipBytes(t, "")
+	)
+	for _, blob := range [][]byte{baseLayer, appLayer, emptyTar} {
+		reg.PutBlob("legacy/app", blob)
+	}
+
+	// Schema1 lists layers and history from newest to oldest, with a throwaway
+	// layer for metadata-only instructions.
+	schema1Manifest := fmt.Appendf(nil, `{
+   "schemaVersion": 1,
+   "name": "legacy/app",
+   "tag": "v1",
+   "architecture": "amd64",
+   "fsLayers": [{"blobSum": %q}, {"blobSum": %q}, {"blobSum": %q}],
+   "history": [
+      {"v1Compatibility": "{\"id\":\"c\",\"parent\":\"b\",\"throwaway\":true,\"created\":\"2016-01-01T00:00:02Z\",\"config\":{\"Cmd\":[\"/app\"]},\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) CMD [\\\"/app\\\"]\"]}}"},
+      {"v1Compatibility": "{\"id\":\"b\",\"parent\":\"a\",\"created\":\"2016-01-01T00:00:01Z\",\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) ADD app /app\"]}}"},
+      {"v1Compatibility": "{\"id\":\"a\",\"created\":\"2016-01-01T00:00:00Z\",\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) ADD base /\"]}}"}
+   ]
+}`, digest.FromBytes(emptyTar), digest.FromBytes(appLayer), digest.FromBytes(baseLayer))
+	reg.PutManifest("legacy/app", "v1", string(image.DockerSchema1MediaType), schema1Manifest)
+
+	src := reg.Image("legacy/app", "v1")
+	dst := reg.Image("modern/app", "v1")
+	assert.Error(t, CopyAll(1, Spec{Src: src, Dst: dst}), "copied schema1 image without conversion")
+
+	spec := Spec{Src: src, Dst: dst, Transform: Transform{ConvertSchema1: true}}
+	require.NoError(t, CopyAll(1, spec))
+
+	got, ok := reg.GetManifest("modern/app", "v1")
+	require.True(t, ok, "missing converted manifest")
+	assert.Equal(t, string(image.DockerManifestMediaType), got.ContentType)
+
+	var manifest image.ParsedManifest
+	require.NoError(t, json.Unmarshal(got.Body, &manifest))
+	layerDigests := make([]digest.Digest, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layerDigests[i] = layer.Digest
+		_, ok := reg.GetBlob("modern/app", layer.Digest)
+		assert.True(t, ok, "missing layer %s", layer.Digest)
+	}
+	assert.Equal(t, []digest.Digest{digest.FromBytes(baseLayer), digest.FromBytes(appLayer)}, layerDigests)
+
+	configBlob, ok := reg.GetBlob("modern/app", manifest.Config.Digest)
+	require.True(t, ok, "missing config blob")
+	var config v1.Image
+	require.NoError(t, json.Unmarshal(configBlob, &config))
+	assert.Equal(t, []string{"/app"}, config.Config.Cmd)
+	assert.Equal(t, []digest.Digest{digest.FromString("base layer"), digest.FromString("app layer")}, config.RootFS.DiffIDs)
+	if assert.Len(t, config.History, 3) {
+		assert.True(t, config.History[2].EmptyLayer, "throwaway layer not marked empty")
+	}
+
+	// A rebuild that changes only the image's config, and not its layers, must
+	// still replace the destination.
+	rebuiltManifest := bytes.Replace(schema1Manifest, []byte(`{\"Cmd\":[\"/app\"]}`), []byte(`{\"Cmd\":[\"/app\",\"--verbose\"]}`), 1)
+	require.NotEqual(t, schema1Manifest, rebuiltManifest)
+	reg.PutManifest("legacy/app", "v1", string(image.DockerSchema1MediaType), rebuiltManifest)
+	require.NoError(t, CopyAll(1, spec))
+
+	got, ok = reg.GetManifest("modern/app", "v1")
+	require.True(t, ok, "missing converted manifest")
+	var rebuilt image.ParsedManifest
+	require.NoError(t, json.Unmarshal(got.Body, &rebuilt))
+	assert.Equal(t, manifest.Layers, rebuilt.Layers)
+	configBlob, ok = reg.GetBlob("modern/app", rebuilt.Config.Digest)
+	require.True(t, ok, "missing config blob")
+	require.NoError(t, json.Unmarshal(configBlob, &config))
+	assert.Equal(t, []string{"/app", "--verbose"}, config.Config.Cmd)
+
+	// A schema1 source pinned by a SHA-512 digest must verify against it.
+	pinned := image.Image{Repository: src.Repository, Digest: digest.SHA512.FromBytes(rebuiltManifest)}
+	require.NoError(t, CopyAll(1, Spec{Src: pinned, Dst: reg.Image("modern/app", "pinned"), Transform: Transform{ConvertSchema1: true}}))
+	_, ok = reg.GetManifest("modern/app", "pinned")
+	assert.True(t, ok, "missing manifest converted from pinned schema1 source")
+}
+
+func gzipBytes(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestForeignLayers(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		foreignLayer = []byte("foreign layer")
+		localLayer   = []byte("local layer")
+		config       = []byte(`{"os":"windows"}`)
+	)
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tampered" {
+			w.Write(bytes.ToUpper(foreignLayer))
+			return
+		}
+		w.Write(foreignLayer)
+	}))
+	t.Cleanup(cdn.Close)
+
+	reg.PutBlob("src/windows", localLayer)
+	reg.PutBlob("src/windows", config)
+	manifest := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[{"mediaType":%q,"digest":%q,"size":%d,"urls":[%q]},{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		image.DockerManifestMediaType,
+		image.DockerConfigMediaType, digest.FromBytes(config), len(config),
+		image.DockerForeignLayerMediaType, digest.FromBytes(foreignLayer), len(foreignLayer), cdn.URL+"/layer",
+		image.DockerLayerGzipMediaType, digest.FromBytes(localLayer), len(localLayer),
+	)
+	reg.PutManifest("src/windows", "v1", string(image.DockerManifestMediaType), manifest)
+	src := reg.Image("src/windows", "v1")
+
+	t.Run("skip", func(t *testing.T) {
+		require.NoError(t, CopyAll(1, Spec{Src: src, Dst: reg.Image("skip/windows", "v1")}))
+		got, ok := reg.GetManifest("skip/windows", "v1")
+		require.True(t, ok, "missing manifest")
+		assert.Equal(t, string(manifest), string(got.Body))
+		_, ok = reg.GetBlob("skip/windows", digest.FromBytes(foreignLayer))
+		assert.False(t, ok, "copied foreign layer")
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		spec := Spec{
+			Src:       src,
+			Dst:       reg.Image("fail/windows", "v1"),
+			Transform: Transform{ForeignLayers: failForeignLayers},
+		}
+		assert.ErrorContains(t, CopyAll(1, spec), "foreign layer")
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		spec := Spec{
+			Src:       src,
+			Dst:       reg.Image("copy/windows", "v1"),
+			Transform: Transform{ForeignLayers: copyForeignLayers},
+		}
+		require.NoError(t, CopyAll(1, spec))
+		got, ok := reg.GetManifest("copy/windows", "v1")
+		require.True(t, ok, "missing manifest")
+		var parsed image.ParsedManifest
+		require.NoError(t, json.Unmarshal(got.Body, &parsed))
+		assert.Equal(t, string(image.DockerLayerGzipMediaType), parsed.Layers[0].MediaType)
+		assert.Empty(t, parsed.Layers[0].URLs)
+		_, ok = reg.GetBlob("copy/windows", digest.FromBytes(foreignLayer))
+		assert.True(t, ok, "missing foreign layer")
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := bytes.Replace(manifest, []byte(cdn.URL+"/layer"), []byte(cdn.URL+"/tampered"), 1)
+		reg.PutManifest("src/windows", "tampered", string(image.DockerManifestMediaType), tampered)
+		spec := Spec{
+			Src:       reg.Image("src/windows", "tampered"),
+			Dst:       reg.Image("tampered/windows", "v1"),
+			Transform: Transform{ForeignLayers: copyForeignLayers},
+		}
+		assert.ErrorContains(t, CopyAll(1, spec), "content of foreign layer")
+		_, ok := reg.GetBlob("tampered/windows", digest.FromBytes(foreignLayer))
+		assert.False(t, ok, "copied tampered foreign layer")
+	})
+}
+
+func TestCopyNestedIndex(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	putImage := func(name string) v1.Descriptor {
+		layer := reg.PutBlob("src/nested", []byte(name+" layer"))
+		config := reg.PutBlob("src/nested", []byte(`{}`))
+		body := fmt.Appendf(nil,
+			`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+			v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, config,
+			v1.MediaTypeImageLayerGzip, layer, len(name+" layer"),
+		)
+		return v1.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    reg.PutManifest("src/nested", "", v1.MediaTypeImageManifest, body),
+			Size:      int64(len(body)),
+		}
+	}
+	putIndex := func(tag string, entries ...v1.Descriptor) v1.Descriptor {
+		body, err := json.Marshal(v1.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageIndex,
+			Manifests: entries,
+		})
+		require.NoError(t, err)
+		return v1.Descriptor{
+			MediaType: v1.MediaTypeImageIndex,
+			Digest:    reg.PutManifest("src/nested", tag, v1.MediaTypeImageIndex, body),
+			Size:      int64(len(body)),
+		}
+	}
+	withPlatform := func(desc v1.Descriptor, platform string) v1.Descriptor {
+		p := platforms.MustParse(platform)
+		desc.Platform = &p
+		return desc
+	}
+
+	var (
+		amd64 = withPlatform(putImage("amd64"), "linux/amd64")
+		arm64 = withPlatform(putImage("arm64"), "linux/arm64")
+		s390x = withPlatform(putImage("s390x"), "linux/s390x")
+		inner = putIndex("", amd64, arm64)
+		outer = putIndex("v1", inner, s390x)
+	)
+
+	t.Run("unfiltered", func(t *testing.T) {
+		spec := Spec{Src: reg.Image("src/nested", "v1"), Dst: reg.Image("all/nested", "v1")}
+		require.NoError(t, CopyAll(1, spec))
+		got, ok := reg.GetManifest("all/nested", "v1")
+		require.True(t, ok, "missing top-level index")
+		assert.Equal(t, outer.Digest, digest.FromBytes(got.Body))
+		for _, desc := range []v1.Descriptor{inner, amd64, arm64, s390x} {
+			_, ok := reg.GetManifest("all/nested", desc.Digest.String())
+			assert.True(t, ok, "missing manifest %s", desc.Digest)
+		}
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		var limitPlatforms platformSet
+		limitPlatforms.Add("linux/arm64")
+		spec := Spec{
+			Src:       reg.Image("src/nested", "v1"),
+			Dst:       reg.Image("arm64/nested", "v1"),
+			Transform: Transform{LimitPlatforms: limitPlatforms},
+		}
+		require.NoError(t, CopyAll(1, spec))
+
+		got, ok := reg.GetManifest("arm64/nested", "v1")
+		require.True(t, ok, "missing top-level index")
+		var top v1.Index
+		require.NoError(t, json.Unmarshal(got.Body, &top))
+		require.Len(t, top.Manifests, 1)
+		assert.Equal(t, v1.MediaTypeImageIndex, top.Manifests[0].MediaType)
+		assert.NotEqual(t, inner.Digest, top.Manifests[0].Digest, "nested index not rewritten")
+
+		nested, ok := reg.GetManifest("arm64/nested", top.Manifests[0].Digest.String())
+		require.True(t, ok, "missing rewritten nested index")
+		var nestedIndex v1.Index
+		require.NoError(t, json.Unmarshal(nested.Body, &nestedIndex))
+		require.Len(t, nestedIndex.Manifests, 1)
+		assert.Equal(t, arm64.Digest, nestedIndex.Manifests[0].Digest)
+		_, ok = reg.GetManifest("arm64/nested", amd64.Digest.String())
+		assert.False(t, ok, "copied filtered platform")
+	})
+}
+
+func TestCopyLayout(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		layer  = []byte("layer content")
+		config = []byte(`{}`)
+	)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	body := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, digest.FromBytes(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	)
+	dgst := reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, body)
+
+	dir := t.TempDir()
+	toLayout, err := image.Parse("oci:" + dir + ":v1")
+	require.NoError(t, err)
+	require.NoError(t, CopyAll(1, Spec{Src: reg.Image("src/image", "v1"), Dst: toLayout}))
+
+	var index v1.Index
+	indexJSON, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(indexJSON, &index))
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, dgst, index.Manifests[0].Digest)
+	assert.Equal(t, "v1", index.Manifests[0].Annotations[v1.AnnotationRefName])
+	for _, dgst := range []digest.Digest{dgst, digest.FromBytes(layer), digest.FromBytes(config)} {
+		assert.FileExists(t, filepath.Join(dir, "blobs", "sha256", dgst.Encoded()))
+	}
+	assert.FileExists(t, filepath.Join(dir, "oci-layout"))
+
+	// Copying back out of the layout must reproduce the original image.
+	require.NoError(t, CopyAll(1, Spec{Src: toLayout, Dst: reg.Image("dst/image", "v1")}))
+	got, ok := reg.GetManifest("dst/image", "v1")
+	require.True(t, ok, "missing manifest copied from layout")
+	assert.Equal(t, body, got.Body)
+	gotLayer, ok := reg.GetBlob("dst/image", digest.FromBytes(layer))
+	require.True(t, ok, "missing layer copied from layout")
+	assert.Equal(t, layer, gotLayer)
+}
+
+func TestCopyDockerArchive(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		shared = gzipBytes(t, "shared layer")
+		layerA = gzipBytes(t, "layer a")
+		layerB = gzipBytes(t, "layer b")
+		config = []byte(`{"architecture":"amd64","os":"linux"}`)
+	)
+	putImage := func(namespace string, layers ...[]byte) {
+		reg.PutBlob(namespace, config)
+		descs := make([]v1.Descriptor, len(layers))
+		for i, layer := range layers {
+			descs[i] = v1.Descriptor{
+				MediaType: string(image.DockerLayerGzipMediaType),
+				Digest:    reg.PutBlob(namespace, layer),
+				Size:      int64(len(layer)),
+			}
+		}
+		body, err := json.Marshal(image.ParsedManifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: string(image.DockerManifestMediaType),
+			Config: v1.Descriptor{
+				MediaType: string(image.DockerConfigMediaType),
+				Digest:    digest.FromBytes(config),
+				Size:      int64(len(config)),
+			},
+			Layers: descs,
+		})
+		require.NoError(t, err)
+		reg.PutManifest(namespace, "v1", string(image.DockerManifestMediaType), body)
+	}
+	putImage("src/a", shared, layerA)
+	putImage("src/b", shared, layerB)
+
+	path := filepath.Join(t.TempDir(), "images.tar")
+	toArchive := func(ref string) image.Image {
+		img, err := image.Parse("docker-archive:" + path + ":" + ref)
+		require.NoError(t, err)
+		return img
+	}
+	require.NoError(t, CopyAll(2,
+		Spec{Src: reg.Image("src/a", "v1"), Dst: toArchive("example.com/app-a:v1")},
+		Spec{Src: reg.Image("src/b", "v1"), Dst: toArchive("example.com/app-b:v1")},
+	))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		_, dup := files[hdr.Name]
+		assert.False(t, dup, "archive contains %s more than once", hdr.Name)
+		files[hdr.Name], err = io.ReadAll(tr)
+		require.NoError(t, err)
+	}
+
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	require.NoError(t, json.Unmarshal(files["manifest.json"], &manifest))
+	require.Len(t, manifest, 2)
+	assert.Equal(t, []string{"example.com/app-a:v1"}, manifest[0].RepoTags)
+	assert.Equal(t, []string{"example.com/app-b:v1"}, manifest[1].RepoTags)
+	assert.Equal(t, manifest[0].Layers[0], manifest[1].Layers[0], "shared layer stored twice")
+	assert.Equal(t, shared, files[manifest[0].Layers[0]])
+	assert.Equal(t, config, files[manifest[0].Config])
+	assert.Contains(t, string(files["repositories"]), `"example.com/app-a":{"v1":`)
+
+	// Copying an image back out of the archive must preserve its content.
+	src, err := image.Parse("docker-archive:" + path + ":example.com/app-b:v1")
+	require.NoError(t, err)
+	require.NoError(t, CopyAll(1, Spec{Src: src, Dst: reg.Image("dst/b", "v1")}))
+	got, ok := reg.GetManifest("dst/b", "v1")
+	require.True(t, ok, "missing manifest copied from archive")
+	var gotManifest image.ParsedManifest
+	require.NoError(t, json.Unmarshal(got.Body, &gotManifest))
+	assert.Equal(t, digest.FromBytes(config), gotManifest.Config.Digest)
+	require.Len(t, gotManifest.Layers, 2)
+	assert.Equal(t, string(image.DockerLayerGzipMediaType), gotManifest.Layers[1].MediaType)
+	gotLayer, ok := reg.GetBlob("dst/b", digest.FromBytes(layerB))
+	require.True(t, ok, "missing layer copied from archive")
+	assert.Equal(t, layerB, gotLayer)
+}
+
+func TestDiscardFailedDockerArchive(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	layer := gzipBytes(t, "layer")
+	config := []byte(`{}`)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	body := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, digest.FromBytes(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	)
+	reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, body)
+
+	dir := t.TempDir()
+	toArchive := func(path, ref string) image.Image {
+		img, err := image.Parse("docker-archive:" + path + ":" + ref)
+		require.NoError(t, err)
+		return img
+	}
+	assertNoStaging := func() {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			assert.False(t, strings.HasPrefix(entry.Name(), ".tmp-"), "left staged content in %s", entry.Name())
+		}
+	}
+
+	path := filepath.Join(dir, "images.tar")
+	require.NoError(t, CopyAll(1, Spec{Src: reg.Image("src/image", "v1"), Dst: toArchive(path, "example.com/app:v1")}))
+	good, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// A failed copy must leave the existing archive alone, even though another
+	// copy to the same archive succeeded.
+	err = CopyAll(1,
+		Spec{Src: reg.Image("src/image", "v1"), Dst: toArchive(path, "example.com/app:v2")},
+		Spec{Src: reg.Image("src/missing", "v1"), Dst: toArchive(path, "example.com/missing:v1")},
+	)
+	assert.Error(t, err)
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, good, got, "failed copy replaced the archive")
+	assertNoStaging()
+
+	// An archive that can't be prepared must not leave behind the staged
+	// content of the archives prepared before it.
+	err = CopyAll(1,
+		Spec{Src: reg.Image("src/image", "v1"), Dst: toArchive(path, "example.com/app:v3")},
+		Spec{Src: reg.Image("src/image", "v1"), Dst: toArchive(filepath.Join(dir, "missing", "images.tar"), "example.com/app:v1")},
+	)
+	assert.Error(t, err)
+	assertNoStaging()
+}
+
+func TestCopyLegacyDockerArchive(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		layer  = []byte("repeated layer")
+		config = []byte(`{"architecture":"amd64","os":"linux"}`)
+	)
+	// Legacy "docker save" archives store repeated layers once, and link to
+	// that copy from the directories of later layers.
+	path := filepath.Join(t.TempDir(), "legacy.tar")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	writeFile := func(name string, content []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	writeLink := func(name, target string, typeflag byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: typeflag, Linkname: target, Mode: 0o644}))
+	}
+	writeFile("config.json", config)
+	writeFile("first/layer.tar", layer)
+	writeLink("second/layer.tar", "../first/layer.tar", tar.TypeSymlink)
+	writeLink("third/layer.tar", "first/layer.tar", tar.TypeLink)
+	writeFile("manifest.json", []byte(`[{"Config":"config.json","RepoTags":["example.com/app:v1"],"Layers":["first/layer.tar","second/layer.tar","third/layer.tar"]}]`))
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	src, err := image.Parse("docker-archive:" + path + ":example.com/app:v1")
+	require.NoError(t, err)
+	require.NoError(t, CopyAll(1, Spec{Src: src, Dst: reg.Image("dst/app", "v1")}))
+
+	got, ok := reg.GetManifest("dst/app", "v1")
+	require.True(t, ok, "missing manifest copied from archive")
+	var gotManifest image.ParsedManifest
+	require.NoError(t, json.Unmarshal(got.Body, &gotManifest))
+	require.Len(t, gotManifest.Layers, 3)
+	for _, desc := range gotManifest.Layers {
+		assert.Equal(t, digest.FromBytes(layer), desc.Digest)
+		assert.Equal(t, int64(len(layer)), desc.Size)
+	}
+	gotLayer, ok := reg.GetBlob("dst/app", digest.FromBytes(layer))
+	require.True(t, ok, "missing layer copied from archive")
+	assert.Equal(t, layer, gotLayer)
+}
+
+func TestCopyRegistryStorage(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		layer  = []byte("layer content")
+		config = []byte(`{}`)
+	)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	body := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, digest.FromBytes(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	)
+	dgst := reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, body)
+
+	root := t.TempDir()
+	storage := func(ref string) image.Image {
+		img, err := image.Parse("registry-fs:" + root + ":" + ref)
+		require.NoError(t, err)
+		return img
+	}
+	require.NoError(t, CopyAll(1,
+		Spec{Src: reg.Image("src/image", "v1"), Dst: storage("mirror/one:v1")},
+		Spec{Src: reg.Image("src/image", "v1"), Dst: storage("mirror/two:v1")},
+	))
+
+	v2 := filepath.Join(root, "docker", "registry", "v2")
+	readLink := func(elems ...string) string {
+		content, err := os.ReadFile(filepath.Join(append([]string{v2, "repositories"}, elems...)...))
+		require.NoError(t, err)
+		return string(content)
+	}
+	for _, repo := range []string{"one", "two"} {
+		assert.Equal(t, dgst.String(), readLink("mirror", repo, "_manifests", "tags", "v1", "current", "link"))
+		assert.Equal(t, dgst.String(), readLink("mirror", repo, "_manifests", "tags", "v1", "index", "sha256", dgst.Encoded(), "link"))
+		assert.Equal(t, dgst.String(), readLink("mirror", repo, "_manifests", "revisions", "sha256", dgst.Encoded(), "link"))
+		for _, blob := range []digest.Digest{digest.FromBytes(layer), digest.FromBytes(config)} {
+			assert.Equal(t, blob.String(), readLink("mirror", repo, "_layers", "sha256", blob.Encoded(), "link"))
+		}
+	}
+	stored, err := os.ReadFile(filepath.Join(v2, "blobs", "sha256", dgst.Encoded()[:2], dgst.Encoded(), "data"))
+	require.NoError(t, err)
+	assert.Equal(t, body, stored)
+
+	// Copying back out of storage must reproduce the original image.
+	require.NoError(t, CopyAll(1, Spec{Src: storage("mirror/two:v1"), Dst: reg.Image("dst/image", "v1")}))
+	got, ok := reg.GetManifest("dst/image", "v1")
+	require.True(t, ok, "missing manifest copied from storage")
+	assert.Equal(t, body, got.Body)
+}
+
+func TestCopyCustomBackend(t *testing.T) {
+	reg := newFakeRegistry(t)
+	mem := newMemBackend()
+
+	var (
+		layer  = []byte("layer content")
+		config = []byte(`{}`)
+	)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	body := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, digest.FromBytes(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	)
+	dgst := reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, body)
+
+	backends := defaultBackends()
+	backends[memTransport] = mem
+	copier := newCopier(1, backends)
+	require.NoError(t, copier.CopyAll(Spec{Src: reg.Image("src/image", "v1"), Dst: mem.Image("mirror/one", "v1")}))
+
+	// A second copy into the same storage must mount the blobs from the first.
+	copier = newCopier(1, backends)
+	copier.blobs.RegisterSource(digest.FromBytes(layer), mem.Repository("mirror/one"))
+	copier.blobs.RegisterSource(digest.FromBytes(config), mem.Repository("mirror/one"))
+	require.NoError(t, copier.CopyAll(Spec{Src: reg.Image("src/image", "v1"), Dst: mem.Image("mirror/two", "v1")}))
+	assert.Equal(t, 2, mem.mounts)
+
+	for _, name := range []string{"mirror/one", "mirror/two"} {
+		got, mediaType, err := mem.GetManifest(mem.Repository(name), "v1")
+		require.NoError(t, err)
+		assert.Equal(t, body, got)
+		assert.Equal(t, v1.MediaTypeImageManifest, mediaType)
+
+		desc, err := mem.HeadManifest(mem.Repository(name), "v1")
+		require.NoError(t, err)
+		assert.Equal(t, dgst, desc.Digest)
+	}
+	assert.Equal(t, []image.Repository{mem.Repository("mirror/one"), mem.Repository("mirror/two")}, mem.finished)
+
+	// Copying back out of the custom backend must reproduce the original image.
+	copier = newCopier(1, backends)
+	require.NoError(t, copier.CopyAll(Spec{Src: mem.Image("mirror/two", "v1"), Dst: reg.Image("dst/image", "v1")}))
+	got, ok := reg.GetManifest("dst/image", "v1")
+	require.True(t, ok, "missing manifest copied from custom backend")
+	assert.Equal(t, body, got.Body)
+}
+
+func TestVerifySignatures(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	trusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	untrusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	pubDER, err := x509.MarshalPKIXPublicKey(&trusted.PublicKey)
+	require.NoError(t, err)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "trusted.pub"), pubPEM, 0o644))
+	policyPath := filepath.Join(dir, "policy.json")
+	policyJSON := fmt.Sprintf(`{"scopes":{%q:{"keys":["trusted.pub"]}}}`, string(reg.Registry())+"/src")
+	require.NoError(t, os.WriteFile(policyPath, []byte(policyJSON), 0o644))
+	policy, err := signature.LoadPolicy(policyPath)
+	require.NoError(t, err)
+
+	pushImage := func(namespace string) (dgst digest.Digest, layer []byte) {
+		layer = []byte("layer of " + namespace)
+		config := []byte(`{}`)
+		reg.PutBlob(namespace, layer)
+		reg.PutBlob(namespace, config)
+		body := fmt.Appendf(nil,
+			`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+			v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, digest.FromBytes(config),
+			v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+		)
+		return reg.PutManifest(namespace, "v1", v1.MediaTypeImageManifest, body), layer
+	}
+
+	// sign pushes a cosign signature of dgst made with key, either under the
+	// companion tag or as a referrer of dgst.
+	sign := func(namespace string, dgst digest.Digest, key *ecdsa.PrivateKey, referrer bool) {
+		payload := fmt.Appendf(nil,
+			`{"critical":{"identity":{"docker-reference":"%s/%s"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+			reg.Registry(), namespace, dgst,
+		)
+		hash := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+		require.NoError(t, err)
+
+		emptyJSON := []byte("{}")
+		reg.PutBlob(namespace, payload)
+		reg.PutBlob(namespace, emptyJSON)
+		manifest := v1.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageManifest,
+			Config:    v1.Descriptor{MediaType: v1.MediaTypeEmptyJSON, Digest: digest.FromBytes(emptyJSON), Size: 2},
+			Layers: []v1.Descriptor{{
+				MediaType:   signature.PayloadMediaType,
+				Digest:      digest.FromBytes(payload),
+				Size:        int64(len(payload)),
+				Annotations: map[string]string{signature.Annotation: base64.StdEncoding.EncodeToString(sig)},
+			}},
+		}
+		tag := companionTag(dgst, signatureSuffix)
+		if referrer {
+			tag = ""
+			manifest.ArtifactType = signature.ArtifactType
+			manifest.Subject = &v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst}
+		}
+		body, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		reg.PutManifest(namespace, tag, v1.MediaTypeImageManifest, body)
+	}
+
+	taggedDigest, _ := pushImage("src/tagged")
+	sign("src/tagged", taggedDigest, trusted, false)
+	referredDigest, _ := pushImage("src/referred")
+	sign("src/referred", referredDigest, untrusted, false)
+	sign("src/referred", referredDigest, trusted, true)
+	_, unsignedLayer := pushImage("src/unsigned")
+	forgedDigest, forgedLayer := pushImage("src/forged")
+	sign("src/forged", forgedDigest, untrusted, false)
+	_, unscopedLayer := pushImage("other/image")
+
+	opts := Options{SignaturePolicy: policy}
+	accepted := Spec{Src: reg.Image("src/tagged", "v1"), Dst: reg.Image("dst/tagged", "v1")}
+	accepted.CompanionTags.Add(signatureSuffix)
+	assert.NoError(t, CopyAllWithOptions(1, opts, accepted))
+	assert.NoError(t, CopyAllWithOptions(1, opts, Spec{Src: reg.Image("src/referred", "v1"), Dst: reg.Image("dst/referred", "v1")}))
+
+	// The signature itself was copied as a companion, without a signature of
+	// its own.
+	_, ok := reg.GetManifest("dst/tagged", companionTag(taggedDigest, signatureSuffix))
+	assert.True(t, ok, "missing signature companion at destination")
+
+	refused := []struct {
+		name    string
+		layer   []byte
+		wantErr string
+	}{
+		{"unsigned", unsignedLayer, "no signatures found"},
+		{"forged", forgedLayer, "does not match any trusted key"},
+	}
+	for _, tc := range refused {
+		name := tc.name
+		err := CopyAllWithOptions(1, opts, Spec{Src: reg.Image("src/"+name, "v1"), Dst: reg.Image("dst/"+name, "v1")})
+		assert.ErrorContains(t, err, tc.wantErr, "copied %s", name)
+		_, ok := reg.GetBlob("dst/"+name, digest.FromBytes(tc.layer))
+		assert.False(t, ok, "transferred blob of refused image %s", name)
+	}
+
+	err = CopyAllWithOptions(1, opts, Spec{Src: reg.Image("other/image", "v1"), Dst: reg.Image("dst/other", "v1")})
+	assert.ErrorContains(t, err, "no signature policy scope covers")
+	_, ok = reg.GetBlob("dst/other", digest.FromBytes(unscopedLayer))
+	assert.False(t, ok, "transferred blob of image outside policy")
+}
+
+func TestSignDestinations(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		layer  = []byte("layer content")
+		config = []byte(`{}`)
+	)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	body := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, digest.FromBytes(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	)
+	dgst := reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, body)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "mirror.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "policy.json"), []byte(`{"scopes":{"*":{"keys":["mirror.pub"]}}}`), 0o644))
+	policy, err := signature.LoadPolicy(filepath.Join(dir, "policy.json"))
+	require.NoError(t, err)
+
+	layoutPath := t.TempDir()
+	layoutImage, err := image.Parse("oci:" + layoutPath + ":v1")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		dst       image.Image
+		referrers bool
+	}{
+		{"tag", reg.Image("dst/tag", "v1"), false},
+		{"referrer", reg.Image("dst/referrer", "v1"), true},
+		{"layout referrer", layoutImage, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := Options{SigningKey: key, SignAsReferrers: tc.referrers}
+			spec := Spec{Src: reg.Image("src/image", "v1"), Dst: tc.dst}
+			require.NoError(t, CopyAllWithOptions(1, opts, spec))
+
+			// Signing again must find the existing signature rather than add another.
+			require.NoError(t, CopyAllWithOptions(1, opts, spec))
+
+			backend, err := defaultBackends().For(tc.dst.Repository)
+			require.NoError(t, err)
+			var sigManifests []image.Image
+			if tc.referrers {
+				referrers, err := backend.Referrers(tc.dst.Repository, dgst)
+				require.NoError(t, err)
+				for _, desc := range referrers {
+					sigManifests = append(sigManifests, image.Image{Repository: tc.dst.Repository, Digest: desc.Digest})
+				}
+			} else {
+				sigManifests = append(sigManifests, image.Image{Repository: tc.dst.Repository, Tag: companionTag(dgst, signatureSuffix)})
+			}
+			require.Len(t, sigManifests, 1)
+			sigBody, _, err := backend.GetManifest(tc.dst.Repository, cmp.Or(sigManifests[0].Digest.String(), sigManifests[0].Tag))
+			require.NoError(t, err)
+			var sigManifest v1.Manifest
+			require.NoError(t, json.Unmarshal(sigBody, &sigManifest))
+			require.Len(t, sigManifest.Layers, 1)
+
+			blob, _, err := backend.GetBlob(tc.dst.Repository, sigManifest.Layers[0].Digest)
+			require.NoError(t, err)
+			payload, err := io.ReadAll(blob)
+			blob.Close()
+			require.NoError(t, err)
+			var parsed signature.Payload
+			require.NoError(t, json.Unmarshal(payload, &parsed))
+			assert.Equal(t, spec.Src.String(), parsed.Optional["source"])
+			assert.Equal(t, dgst.String(), parsed.Optional["sourceDigest"])
+
+			// The destination must now pass verification under the signing key.
+			verifyOpts := Options{SignaturePolicy: policy}
+			assert.NoError(t, CopyAllWithOptions(1, verifyOpts, Spec{Src: tc.dst, Dst: reg.Image("verified/"+strings.ReplaceAll(tc.name, " ", "-"), "v1")}))
+		})
+	}
+}
+
+func TestSignWithCompanionSignatures(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	var (
+		layer  = []byte("layer content")
+		config = []byte(`{}`)
+	)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	body := fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":2},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest, v1.MediaTypeImageConfig, digest.FromBytes(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	)
+	dgst := reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, body)
+
+	// The source carries a signature of its own under the companion tag.
+	sigTag := companionTag(dgst, signatureSuffix)
+	srcPayload := []byte(`{"critical":{"type":"cosign container image signature"}}`)
+	reg.PutBlob("src/image", srcPayload)
+	reg.PutBlob("src/image", []byte("{}"))
+	srcSig, err := json.Marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: v1.DescriptorEmptyJSON.Digest, Size: v1.DescriptorEmptyJSON.Size},
+		Layers: []v1.Descriptor{{
+			MediaType:   signature.PayloadMediaType,
+			Digest:      digest.FromBytes(srcPayload),
+			Size:        int64(len(srcPayload)),
+			Annotations: map[string]string{signature.Annotation: "c291cmNlIHNpZ25hdHVyZQ=="},
+		}},
+	})
+	require.NoError(t, err)
+	reg.PutManifest("src/image", sigTag, v1.MediaTypeImageManifest, srcSig)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	opts := Options{SigningKey: key}
+	spec := Spec{Src: reg.Image("src/image", "v1"), Dst: reg.Image("dst/image", "v1")}
+	spec.CompanionTags.Add(signatureSuffix)
+
+	// The source signature and the mirror's signature must reach the
+	// destination tag together, and repeating the copy must leave it alone.
+	require.NoError(t, CopyAllWithOptions(1, opts, spec))
+	require.NoError(t, CopyAllWithOptions(1, opts, spec))
+	assert.Equal(t, 1, reg.manifestPuts["dst/image:"+sigTag], "signature tag written more than once")
+
+	got, ok := reg.GetManifest("dst/image", sigTag)
+	require.True(t, ok, "missing signature manifest at destination")
+	var sigManifest v1.Manifest
+	require.NoError(t, json.Unmarshal(got.Body, &sigManifest))
+	require.Len(t, sigManifest.Layers, 2)
+	assert.Equal(t, digest.FromBytes(srcPayload), sigManifest.Layers[0].Digest, "source signature not kept")
+	_, ok = reg.GetBlob("dst/image", digest.FromBytes(srcPayload))
+	assert.True(t, ok, "source signature payload not copied")
+	mirrorPayload, ok := reg.GetBlob("dst/image", sigManifest.Layers[1].Digest)
+	require.True(t, ok, "mirror signature payload not uploaded")
+	keys := []crypto.PublicKey{key.Public()}
+	assert.NoError(t, signature.Verify(keys, mirrorPayload, sigManifest.Layers[1].Annotations[signature.Annotation], dgst), "invalid mirror signature")
+}
+
+func TestCopySHA512(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	manifestDescs := make([]v1.Descriptor, 2)
+	var blobs []digest.Digest
+	for i, arch := range []string{"amd64", "arm64"} {
+		layer := []byte("layer for " + arch)
+		config := fmt.Appendf(nil, `{"architecture":%q,"os":"linux"}`, arch)
+		reg.PutBlob("src/image", layer)
+		reg.PutBlob("src/image", config)
+		blobs = append(blobs, digest.SHA512.FromBytes(layer), digest.SHA512.FromBytes(config))
+
+		body := fmt.Appendf(nil,
+			`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+			v1.MediaTypeImageManifest,
+			v1.MediaTypeImageConfig, digest.SHA512.FromBytes(config), len(config),
+			v1.MediaTypeImageLayerGzip, digest.SHA512.FromBytes(layer), len(layer),
+		)
+		reg.PutManifest("src/image", "", v1.MediaTypeImageManifest, body)
+		manifestDescs[i] = v1.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    digest.SHA512.FromBytes(body),
+			Size:      int64(len(body)),
+			Platform:  &v1.Platform{OS: "linux", Architecture: arch},
+		}
+	}
+	indexBody, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: manifestDescs,
+	})
+	require.NoError(t, err)
+	reg.PutManifest("src/image", "", v1.MediaTypeImageIndex, indexBody)
+	indexDigest := digest.SHA512.FromBytes(indexBody)
+
+	src := image.Image{Repository: reg.Image("src/image", "").Repository, Digest: indexDigest}
+	layoutPath := t.TempDir()
+	layoutDst, err := image.Parse("oci:" + layoutPath + ":v1")
+	require.NoError(t, err)
+	pinnedDst := image.Image{Repository: reg.Image("dst/pinned", "").Repository, Digest: indexDigest}
+	require.NoError(t, CopyAll(1,
+		Spec{Src: src, Dst: reg.Image("dst/image", "v1")},
+		Spec{Src: src, Dst: pinnedDst},
+		Spec{Src: src, Dst: layoutDst},
+	))
+
+	// The index must be copied byte-for-byte, still referencing its platform
+	// manifests by their SHA-512 digests.
+	got, ok := reg.GetManifest("dst/image", "v1")
+	require.True(t, ok, "missing index at destination")
+	assert.Equal(t, string(indexBody), string(got.Body))
+	_, ok = reg.GetManifest("dst/pinned", indexDigest.String())
+	assert.True(t, ok, "missing index pinned by SHA-512 digest")
+	for _, desc := range manifestDescs {
+		_, ok := reg.GetManifest("dst/image", desc.Digest.String())
+		assert.True(t, ok, "missing manifest %s", desc.Digest)
+	}
+	for _, dgst := range blobs {
+		_, ok := reg.GetBlob("dst/image", dgst)
+		assert.True(t, ok, "missing blob %s", dgst)
+	}
+
+	// The layout must store every object and the tagged index under its SHA-512
+	// digest.
+	for _, dgst := range append(blobs, indexDigest, manifestDescs[0].Digest, manifestDescs[1].Digest) {
+		assert.FileExists(t, filepath.Join(layoutPath, "blobs", "sha512", dgst.Encoded()))
+	}
+	layoutIndex, err := os.ReadFile(filepath.Join(layoutPath, "index.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(layoutIndex), indexDigest.String())
+}
+
+func TestMountFallback(t *testing.T) {
+	for _, decline := range []bool{false, true} {
+		reg := newFakeRegistry(t)
+		reg.declineMounts = decline
+
+		layer := []byte("layer")
+		config := []byte(`{"architecture":"amd64","os":"linux"}`)
+		reg.PutBlob("src/image", layer)
+		reg.PutBlob("src/image", config)
+		reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, fmt.Appendf(nil,
+			`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+			v1.MediaTypeImageManifest,
+			v1.MediaTypeImageConfig, digest.FromBytes(config), len(config),
+			v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+		))
+
+		keys, err := coalesceRequests([]Spec{{Src: reg.Image("src/image", "v1"), Dst: reg.Image("dst/image", "v1")}})
+		require.NoError(t, err)
+		c := newCopier(1, defaultBackends())
+		require.NoError(t, c.CopyAll(keys...))
+
+		for _, blob := range [][]byte{layer, config} {
+			_, ok := reg.GetBlob("dst/image", digest.FromBytes(blob))
+			assert.True(t, ok, "missing blob %s (declined mounts: %v)", digest.FromBytes(blob), decline)
+		}
+		if decline {
+			assert.Equal(t, int64(0), c.blobs.mounts.Load())
+			assert.Equal(t, int64(2), c.blobs.mountFallbacks.Load(), "declined mounts not counted")
+			assert.Equal(t, 2, reg.uploads, "declined mounts did not reuse their upload sessions")
+		} else {
+			assert.Equal(t, int64(2), c.blobs.mounts.Load(), "mounts not counted")
+			assert.Equal(t, int64(0), c.blobs.mountFallbacks.Load())
+		}
+		assert.Empty(t, reg.sessions, "upload sessions left open")
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	reg := newFakeRegistry(t)
+	reg.denyPush = map[string]bool{"readonly/image": true}
+
+	layer := []byte("layer")
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest,
+		v1.MediaTypeImageConfig, digest.FromBytes(config), len(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	))
+
+	specsTo := func(dst string) []Spec {
+		return []Spec{
+			{Src: reg.Image("src/image", "v1"), Dst: reg.Image(dst, "v1")},
+			{Src: reg.Image("src/image", "v1"), Dst: reg.Image("readonly/image", "v1")},
+		}
+	}
+
+	err := CopyAllWithOptions(1, Options{}, specsTo("abort/image")...)
+	assert.ErrorContains(t, err, "cannot push to "+string(reg.Registry())+"/readonly/image")
+	assert.ErrorContains(t, err, "nothing was copied")
+	_, ok := reg.GetManifest("abort/image", "v1")
+	assert.False(t, ok, "copied an image after a failed access check")
+	_, ok = reg.GetBlob("abort/image", digest.FromBytes(layer))
+	assert.False(t, ok, "copied a blob after a failed access check")
+
+	err = CopyAllWithOptions(1, Options{Preflight: PreflightDrop}, specsTo("drop/image")...)
+	assert.ErrorContains(t, err, "skipped 1 of 2 copies")
+	_, ok = reg.GetManifest("drop/image", "v1")
+	assert.True(t, ok, "did not copy an image with passing access checks")
+
+	err = CopyAllWithOptions(1, Options{Preflight: PreflightOff}, specsTo("off/image")...)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "access checks")
+	_, ok = reg.GetManifest("off/image", "v1")
+	assert.True(t, ok, "did not copy an image without access checks")
+}
+
+func TestRegistryPathPrefix(t *testing.T) {
+	reg := newFakeRegistry(t)
+
+	// The proxy strips its path prefix before forwarding requests, but doesn't
+	// add it back to the Location headers in responses.
+	const prefix = "/artifactory/api/docker/repo"
+	proxy := httptest.NewServer(http.StripPrefix(prefix, reg))
+	defer proxy.Close()
+	proxyRegistry := image.Registry(strings.TrimPrefix(proxy.URL, "http://"))
+
+	registriesConfig := filepath.Join(t.TempDir(), "registries.json")
+	require.NoError(t, os.WriteFile(registriesConfig, fmt.Appendf(nil, `{"registries": {%q: {"pathPrefix": %q}}}`, proxyRegistry, prefix+"/"), 0o644))
+	require.NoError(t, registry.ConfigureRegistries(registriesConfig))
+	t.Cleanup(func() {
+		require.NoError(t, os.WriteFile(registriesConfig, []byte(`{}`), 0o644))
+		require.NoError(t, registry.ConfigureRegistries(registriesConfig))
+	})
+
+	layer := []byte("layer")
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	reg.PutBlob("src/image", layer)
+	reg.PutBlob("src/image", config)
+	reg.PutManifest("src/image", "v1", v1.MediaTypeImageManifest, fmt.Appendf(nil,
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+		v1.MediaTypeImageManifest,
+		v1.MediaTypeImageConfig, digest.FromBytes(config), len(config),
+		v1.MediaTypeImageLayerGzip, digest.FromBytes(layer), len(layer),
+	))
+
+	prefixed := image.Image{
+		Repository: image.Repository{Registry: proxyRegistry, Namespace: "prefixed/image"},
+		Tag:        "v1",
+	}
+	require.NoError(t, CopyAll(1, Spec{Src: reg.Image("src/image", "v1"), Dst: prefixed}))
+	_, ok := reg.GetManifest("prefixed/image", "v1")
+	assert.True(t, ok, "did not push manifest under the path prefix")
+	_, ok = reg.GetBlob("prefixed/image", digest.FromBytes(layer))
+	assert.True(t, ok, "did not push blob under the path prefix")
+
+	require.NoError(t, CopyAll(1, Spec{Src: prefixed, Dst: reg.Image("back/image", "v1")}))
+	_, ok = reg.GetManifest("back/image", "v1")
+	assert.True(t, ok, "did not pull manifest from under the path prefix")
+
+	reg.PutManifest("prefixed/image", "v2", v1.MediaTypeImageManifest, []byte(`{}`))
+	tags, err := registryBackend{}.ListTags(prefixed.Repository)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2"}, tags)
+}
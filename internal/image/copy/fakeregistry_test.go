@@ -0,0 +1,318 @@
+package copy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+// fakeRegistry is a minimal in-memory implementation of the registry API,
+// sufficient for the requests that the copier makes.
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string]map[digest.Digest][]byte // By repository.
+	manifests map[string]map[string]fakeManifest  // By repository, then digest or tag.
+	uploads   int
+	sessions  map[string]bool // Upload sessions started but not finished.
+
+	// manifestPuts counts the manifest uploads to each repository and
+	// reference, as "namespace:reference".
+	manifestPuts map[string]int
+
+	// declineMounts makes cross-repository mount requests start regular uploads,
+	// like registries that don't authorize the mount.
+	declineMounts bool
+
+	// denyPush lists repositories that refuse uploads of blobs and manifests,
+	// like repositories that the client may only pull from.
+	denyPush map[string]bool
+}
+
+type fakeManifest struct {
+	ContentType string
+	Body        []byte
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     make(map[string]map[digest.Digest][]byte),
+		manifests: make(map[string]map[string]fakeManifest),
+		sessions:  make(map[string]bool),
+
+		manifestPuts: make(map[string]int),
+	}
+	r.Server = httptest.NewServer(r)
+	t.Cleanup(r.Server.Close)
+	return r
+}
+
+// Registry returns the registry component of image references served by r.
+func (r *fakeRegistry) Registry() image.Registry {
+	return image.Registry(strings.TrimPrefix(r.Server.URL, "http://"))
+}
+
+// Image returns a reference to an image in r.
+func (r *fakeRegistry) Image(namespace, tag string) image.Image {
+	return image.Image{
+		Repository: image.Repository{Registry: r.Registry(), Namespace: namespace},
+		Tag:        tag,
+	}
+}
+
+// PutBlob stores content as a blob in the provided repository, and returns its
+// canonical digest. The blob is also available by its SHA-512 digest.
+func (r *fakeRegistry) PutBlob(namespace string, content []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst := digest.FromBytes(content)
+	r.repoBlobs(namespace)[dgst] = content
+	r.repoBlobs(namespace)[digest.SHA512.FromBytes(content)] = content
+	return dgst
+}
+
+// PutManifest stores a manifest in the provided repository under its digest
+// and the provided tag, and returns its canonical digest. The manifest is also
+// available by its SHA-512 digest.
+func (r *fakeRegistry) PutManifest(namespace, tag, contentType string, body []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst := digest.FromBytes(body)
+	m := fakeManifest{ContentType: contentType, Body: body}
+	r.repoManifests(namespace)[dgst.String()] = m
+	r.repoManifests(namespace)[digest.SHA512.FromBytes(body).String()] = m
+	if tag != "" {
+		r.repoManifests(namespace)[tag] = m
+	}
+	return dgst
+}
+
+// GetBlob returns the content of a blob in the provided repository.
+func (r *fakeRegistry) GetBlob(namespace string, dgst digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	content, ok := r.blobs[namespace][dgst]
+	return content, ok
+}
+
+// GetManifest returns a manifest in the provided repository by tag or digest.
+func (r *fakeRegistry) GetManifest(namespace, reference string) (fakeManifest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.manifests[namespace][reference]
+	return m, ok
+}
+
+func (r *fakeRegistry) repoBlobs(namespace string) map[digest.Digest][]byte {
+	if r.blobs[namespace] == nil {
+		r.blobs[namespace] = make(map[digest.Digest][]byte)
+	}
+	return r.blobs[namespace]
+}
+
+func (r *fakeRegistry) repoManifests(namespace string) map[string]fakeManifest {
+	if r.manifests[namespace] == nil {
+		r.manifests[namespace] = make(map[string]fakeManifest)
+	}
+	return r.manifests[namespace]
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		return
+	}
+
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		r.mu.Lock()
+		denied := false
+		for namespace := range r.denyPush {
+			denied = denied || strings.HasPrefix(path, namespace+"/")
+		}
+		r.mu.Unlock()
+		if denied {
+			http.Error(w, "push denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i >= 0 {
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		r.serveBlob(w, req, path[:i], digest.Digest(path[i+len("/blobs/"):]))
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if namespace, ok := strings.CutSuffix(path, "/tags/list"); ok && req.Method == http.MethodGet {
+		r.serveTags(w, req, namespace)
+		return
+	}
+	if i := strings.LastIndex(path, "/referrers/"); i >= 0 && req.Method == http.MethodGet {
+		r.serveReferrers(w, path[:i], digest.Digest(path[i+len("/referrers/"):]))
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func (r *fakeRegistry) serveReferrers(w http.ResponseWriter, namespace string, subject digest.Digest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	for ref, m := range r.manifests[namespace] {
+		var parsed v1.Manifest
+		if ref != digest.FromBytes(m.Body).String() || json.Unmarshal(m.Body, &parsed) != nil {
+			continue
+		}
+		if parsed.Subject != nil && parsed.Subject.Digest == subject {
+			index.Manifests = append(index.Manifests, v1.Descriptor{
+				MediaType:    m.ContentType,
+				ArtifactType: parsed.ArtifactType,
+				Digest:       digest.Digest(ref),
+				Size:         int64(len(m.Body)),
+			})
+		}
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	json.NewEncoder(w).Encode(index)
+}
+
+// serveTags lists one tag per page, linking to the next page like a registry
+// that paginates its tag lists.
+func (r *fakeRegistry) serveTags(w http.ResponseWriter, req *http.Request, namespace string) {
+	r.mu.Lock()
+	var tags []string
+	for ref := range r.manifests[namespace] {
+		if _, err := digest.Parse(ref); err != nil {
+			tags = append(tags, ref)
+		}
+	}
+	r.mu.Unlock()
+	if len(tags) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+
+	slices.Sort(tags)
+	if last := req.URL.Query().Get("last"); last != "" {
+		tags = tags[sort.SearchStrings(tags, last+"\x00"):]
+	}
+	if len(tags) > 1 {
+		tags = tags[:1]
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?last=%s>; rel="next"`, namespace, tags[0]))
+	}
+	json.NewEncoder(w).Encode(map[string]any{"name": namespace, "tags": tags})
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, namespace string, dgst digest.Digest) {
+	content, ok := r.GetBlob(namespace, dgst)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+	if req.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, namespace, session string) {
+	query := req.URL.Query()
+	switch req.Method {
+	case http.MethodPost:
+		r.mu.Lock()
+		declineMounts := r.declineMounts
+		r.mu.Unlock()
+		if from, mount := query.Get("from"), digest.Digest(query.Get("mount")); from != "" && !declineMounts {
+			if content, ok := r.GetBlob(from, mount); ok {
+				r.PutBlob(namespace, content)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.mu.Lock()
+		r.uploads++
+		id := fmt.Sprint(r.uploads)
+		r.sessions[id] = true
+		r.mu.Unlock()
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", namespace, id))
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodPut:
+		r.mu.Lock()
+		delete(r.sessions, session)
+		r.mu.Unlock()
+		content, _ := io.ReadAll(req.Body)
+		if dgst := digest.Digest(query.Get("digest")); dgst.Validate() != nil || dgst != dgst.Algorithm().FromBytes(content) {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		r.PutBlob(namespace, content)
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		r.mu.Lock()
+		delete(r.sessions, session)
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unsupported upload method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, namespace, reference string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.GetManifest(namespace, reference)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", m.ContentType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.Body).String())
+		if req.Method == http.MethodGet {
+			io.Copy(w, bytes.NewReader(m.Body))
+		}
+
+	case http.MethodPut:
+		r.mu.Lock()
+		r.manifestPuts[namespace+":"+reference]++
+		r.mu.Unlock()
+		body, _ := io.ReadAll(req.Body)
+		tag := reference
+		if _, err := digest.Parse(reference); err == nil {
+			tag = ""
+		}
+		dgst := r.PutManifest(namespace, tag, req.Header.Get("Content-Type"), body)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "unsupported manifest method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,188 @@
+package copy
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/archive"
+	"github.com/ahamlinman/magic-mirror/internal/image/layout"
+	"github.com/ahamlinman/magic-mirror/internal/image/registryfs"
+)
+
+// layoutBackend accesses images in OCI image layout directories.
+type layoutBackend struct{}
+
+var _ Backend = layoutBackend{}
+
+func (layoutBackend) open(repo image.Repository) *layout.Layout {
+	return layout.Open(string(repo.Registry))
+}
+
+func (b layoutBackend) StatBlob(repo image.Repository, dgst digest.Digest) (bool, error) {
+	return b.open(repo).HasBlob(dgst)
+}
+
+func (b layoutBackend) GetBlob(repo image.Repository, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	return b.open(repo).GetBlob(dgst)
+}
+
+func (b layoutBackend) PutBlob(repo image.Repository, dgst digest.Digest, _ int64, r io.Reader) error {
+	return b.open(repo).PutBlob(dgst, r)
+}
+
+func (layoutBackend) MountBlob(image.Repository, digest.Digest, image.Repository) (bool, BlobUpload, error) {
+	return false, nil, nil
+}
+
+func (b layoutBackend) GetManifest(repo image.Repository, reference string) ([]byte, string, error) {
+	return b.open(repo).GetManifest(reference)
+}
+
+func (b layoutBackend) PutManifest(img image.Image, manifest image.ManifestKind) error {
+	return b.open(img.Repository).PutManifest(img.Tag, manifest.Encoded(), manifest.Descriptor())
+}
+
+func (b layoutBackend) HeadManifest(repo image.Repository, reference string) (v1.Descriptor, error) {
+	body, mediaType, err := b.GetManifest(repo, reference)
+	return describeManifest(reference, body, mediaType, err)
+}
+
+func (b layoutBackend) ListTags(repo image.Repository) ([]string, error) {
+	return b.open(repo).Tags()
+}
+
+func (b layoutBackend) Referrers(repo image.Repository, dgst digest.Digest) ([]v1.Descriptor, error) {
+	return referrersFromTag(b, repo, dgst)
+}
+
+// archiveBackend accesses images in Docker archives, which it prepares for
+// writing before any copies begin and writes once all copies are done.
+type archiveBackend struct{}
+
+var _ FinishingBackend = archiveBackend{}
+
+func (archiveBackend) open(repo image.Repository) *archive.Archive {
+	return archive.Open(string(repo.Registry))
+}
+
+func (b archiveBackend) StatBlob(repo image.Repository, dgst digest.Digest) (bool, error) {
+	return b.open(repo).HasBlob(dgst)
+}
+
+func (b archiveBackend) GetBlob(repo image.Repository, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	return b.open(repo).GetBlob(dgst)
+}
+
+func (b archiveBackend) PutBlob(repo image.Repository, dgst digest.Digest, _ int64, r io.Reader) error {
+	return b.open(repo).PutBlob(dgst, r)
+}
+
+func (archiveBackend) MountBlob(image.Repository, digest.Digest, image.Repository) (bool, BlobUpload, error) {
+	return false, nil, nil
+}
+
+func (b archiveBackend) GetManifest(repo image.Repository, reference string) ([]byte, string, error) {
+	return b.open(repo).GetManifest(reference)
+}
+
+func (b archiveBackend) PutManifest(img image.Image, manifest image.ManifestKind) error {
+	return b.open(img.Repository).PutManifest(img.Tag, manifest.Encoded(), manifest.Descriptor())
+}
+
+func (b archiveBackend) HeadManifest(repo image.Repository, reference string) (v1.Descriptor, error) {
+	body, mediaType, err := b.GetManifest(repo, reference)
+	return describeManifest(reference, body, mediaType, err)
+}
+
+func (b archiveBackend) ListTags(repo image.Repository) ([]string, error) {
+	return b.open(repo).Tags()
+}
+
+func (b archiveBackend) Referrers(repo image.Repository, dgst digest.Digest) ([]v1.Descriptor, error) {
+	return referrersFromTag(b, repo, dgst)
+}
+
+func (archiveBackend) Prepare(repo image.Repository) error {
+	_, err := archive.Create(string(repo.Registry))
+	return err
+}
+
+func (b archiveBackend) Finish(repo image.Repository) error {
+	return b.open(repo).Commit()
+}
+
+func (b archiveBackend) Discard(repo image.Repository) error {
+	return b.open(repo).Discard()
+}
+
+// storageBackend accesses images in the storage directories of registries that
+// use the docker/distribution filesystem driver.
+type storageBackend struct{}
+
+var _ Backend = storageBackend{}
+
+func (storageBackend) open(repo image.Repository) *registryfs.Storage {
+	return registryfs.Open(string(repo.Registry))
+}
+
+func (b storageBackend) StatBlob(repo image.Repository, dgst digest.Digest) (bool, error) {
+	return b.open(repo).HasBlob(repo.Namespace, dgst)
+}
+
+func (b storageBackend) GetBlob(repo image.Repository, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	return b.open(repo).GetBlob(repo.Namespace, dgst)
+}
+
+func (b storageBackend) PutBlob(repo image.Repository, dgst digest.Digest, _ int64, r io.Reader) error {
+	return b.open(repo).PutBlob(repo.Namespace, dgst, r)
+}
+
+// MountBlob links any blob that the storage directory contains into repo,
+// whether or not from is known.
+func (b storageBackend) MountBlob(repo image.Repository, dgst digest.Digest, _ image.Repository) (bool, BlobUpload, error) {
+	mounted, err := b.open(repo).MountBlob(repo.Namespace, dgst)
+	return mounted, nil, err
+}
+
+func (b storageBackend) GetManifest(repo image.Repository, reference string) ([]byte, string, error) {
+	body, err := b.open(repo).GetManifest(repo.Namespace, reference)
+	return body, "", err
+}
+
+func (b storageBackend) PutManifest(img image.Image, manifest image.ManifestKind) error {
+	return b.open(img.Repository).PutManifest(img.Namespace, img.Tag, manifest.Encoded(), manifest.Descriptor().Digest)
+}
+
+func (b storageBackend) HeadManifest(repo image.Repository, reference string) (v1.Descriptor, error) {
+	body, mediaType, err := b.GetManifest(repo, reference)
+	return describeManifest(reference, body, mediaType, err)
+}
+
+func (b storageBackend) ListTags(repo image.Repository) ([]string, error) {
+	return b.open(repo).Tags(repo.Namespace)
+}
+
+func (b storageBackend) Referrers(repo image.Repository, dgst digest.Digest) ([]v1.Descriptor, error) {
+	return referrersFromTag(b, repo, dgst)
+}
+
+// describeManifest returns a descriptor for a manifest in local storage, given
+// the reference and results of GetManifest. The digest uses the algorithm of a
+// digest reference, or the canonical algorithm for a tag.
+func describeManifest(reference string, body []byte, mediaType string, err error) (v1.Descriptor, error) {
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	alg := digest.Canonical
+	if dgst, err := digest.Parse(reference); err == nil {
+		alg = dgst.Algorithm()
+	}
+	return v1.Descriptor{
+		MediaType: string(image.DetectManifestMediaType(mediaType, body)),
+		Digest:    alg.FromBytes(body),
+		Size:      int64(len(body)),
+	}, nil
+}
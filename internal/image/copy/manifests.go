@@ -1,56 +1,29 @@
 package copy
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"strings"
+
+	"github.com/opencontainers/go-digest"
 
 	"github.com/ahamlinman/magic-mirror/internal/image"
-	"github.com/ahamlinman/magic-mirror/internal/image/registry"
 	"github.com/ahamlinman/magic-mirror/internal/log"
 	"github.com/ahamlinman/magic-mirror/internal/parka"
 )
 
-func uploadManifest(img image.Image, manifest image.ManifestKind) error {
-	client, err := registry.GetClient(img.Repository, registry.PushScope)
-	if err != nil {
-		return err
-	}
-
-	reference := img.Tag
-	if reference == "" {
-		reference = img.Digest.String()
-	}
-	if reference == "" {
-		reference = manifest.Descriptor().Digest.String()
-	}
-
-	u := img.Registry.APIBaseURL()
-	u.Path = fmt.Sprintf("/v2/%s/manifests/%s", img.Namespace, reference)
-	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(manifest.Encoded()))
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", manifest.Descriptor().MediaType)
-
-	_, err = client.DoExpectingNoBody(req, http.StatusCreated)
-	return err
-}
-
 type manifestCache struct {
 	*parka.Map[image.Image, image.ManifestKind]
+	backends backendSet
 }
 
-func newManifestCache(concurrency int) *manifestCache {
-	cache := manifestCache{parka.NewMap(getManifest)}
+func newManifestCache(concurrency int, backends backendSet) *manifestCache {
+	cache := &manifestCache{backends: backends}
+	cache.Map = parka.NewMap(cache.getManifest)
 	cache.Map.Limit(concurrency)
-	return &cache
+	return cache
 }
 
-func getManifest(_ *parka.Handle, img image.Image) (image.ManifestKind, error) {
+func (mc *manifestCache) getManifest(_ *parka.Handle, img image.Image) (image.ManifestKind, error) {
 	reference := img.Digest.String()
 	if reference == "" {
 		reference = img.Tag
@@ -58,50 +31,65 @@ func getManifest(_ *parka.Handle, img image.Image) (image.ManifestKind, error) {
 
 	log.Verbosef("[manifest]\tdownloading %s", img)
 
-	client, err := registry.GetClient(img.Repository, registry.PullScope)
+	backend, err := mc.backends.For(img.Repository)
 	if err != nil {
 		return nil, err
 	}
-
-	u := img.Registry.APIBaseURL()
-	u.Path = fmt.Sprintf("/v2/%s/manifests/%s", img.Namespace, reference)
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	body, rawContentType, err := backend.GetManifest(img.Repository, reference)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Accept", strings.Join(image.AllManifestMediaTypes, ","))
-
-	resp, err := client.DoExpecting(req, http.StatusOK)
-	if err != nil {
-		return nil, err
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	resp.Body.Close()
 
+	// A manifest requested by digest keeps that digest's algorithm, so that its
+	// descriptor matches the references to it (and any copies of it use the same
+	// algorithm). Other manifests use the canonical algorithm.
+	var alg digest.Algorithm
 	if img.Digest != "" {
-		verifier := img.Digest.Verifier()
-		io.Copy(verifier, bytes.NewReader(body))
-		if !verifier.Verified() {
-			return nil, fmt.Errorf("content of %s does not match specified digest", img)
+		alg = img.Digest.Algorithm()
+		if !alg.Available() {
+			return nil, fmt.Errorf("unsupported digest algorithm in %s", img)
 		}
 	}
 
+	// The mediaType field is optional in OCI manifests, so we fill it in from
+	// the response to ensure that we can upload the manifest elsewhere with the
+	// correct Content-Type. This only affects the parsed form of the manifest;
+	// the raw content is still copied byte-for-byte.
 	var result image.ManifestKind
-	contentType := image.MediaType(resp.Header.Get("Content-Type"))
+	contentType := image.DetectManifestMediaType(rawContentType, body)
 	switch {
 	case contentType.IsIndex():
 		var index image.RawIndex
 		err = json.Unmarshal(body, &index)
+		if index.MediaType == "" {
+			index.MediaType = string(contentType)
+		}
+		index.Algorithm = alg
 		result = index
 	case contentType.IsManifest():
 		var manifest image.RawManifest
 		err = json.Unmarshal(body, &manifest)
+		if manifest.MediaType == "" {
+			manifest.MediaType = string(contentType)
+		}
+		manifest.Algorithm = alg
+		result = manifest
+	case contentType.IsSchema1():
+		var manifest image.Schema1Manifest
+		err = json.Unmarshal(body, &manifest)
+		manifest.Algorithm = alg
 		result = manifest
 	default:
 		err = fmt.Errorf("unknown manifest type for %s: %s", img, contentType)
 	}
-	return result, err
+	if err != nil {
+		return nil, err
+	}
+
+	// The digest of a signed schema1 manifest covers its unsigned payload, which
+	// Descriptor accounts for.
+	if img.Digest != "" && result.Descriptor().Digest != img.Digest {
+		return nil, fmt.Errorf("content of %s does not match specified digest", img)
+	}
+	return result, nil
 }
@@ -0,0 +1,159 @@
+package copy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+const memTransport image.Transport = "mem"
+
+// memBackend is an in-memory Backend, keyed by the whole repository. It mounts
+// blobs between any of its repositories that share a registry name.
+type memBackend struct {
+	mu        sync.Mutex
+	blobs     map[image.Repository]map[digest.Digest][]byte
+	manifests map[image.Repository]map[string]fakeManifest // By digest or tag.
+	mounts    int
+	finished  []image.Repository
+	discarded []image.Repository
+}
+
+var _ FinishingBackend = (*memBackend)(nil)
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		blobs:     make(map[image.Repository]map[digest.Digest][]byte),
+		manifests: make(map[image.Repository]map[string]fakeManifest),
+	}
+}
+
+func (b *memBackend) Repository(name string) image.Repository {
+	return image.Repository{Transport: memTransport, Registry: "memory", Namespace: name}
+}
+
+func (b *memBackend) Image(name, tag string) image.Image {
+	return image.Image{Repository: b.Repository(name), Tag: tag}
+}
+
+func (b *memBackend) StatBlob(repo image.Repository, dgst digest.Digest) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.blobs[repo][dgst]
+	return ok, nil
+}
+
+func (b *memBackend) GetBlob(repo image.Repository, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.blobs[repo][dgst]
+	if !ok {
+		return nil, 0, fmt.Errorf("blob %s in %s: %w", dgst, repo, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+}
+
+func (b *memBackend) PutBlob(repo image.Repository, dgst digest.Digest, size int64, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if digest.FromBytes(content) != dgst || int64(len(content)) != size {
+		return fmt.Errorf("content of blob %s does not match its digest and size", dgst)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.putBlobLocked(repo, dgst, content)
+	return nil
+}
+
+func (b *memBackend) MountBlob(repo image.Repository, dgst digest.Digest, from image.Repository) (bool, BlobUpload, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.blobs[from][dgst]
+	if !ok {
+		return false, nil, nil
+	}
+	b.putBlobLocked(repo, dgst, content)
+	b.mounts++
+	return true, nil, nil
+}
+
+func (b *memBackend) putBlobLocked(repo image.Repository, dgst digest.Digest, content []byte) {
+	if b.blobs[repo] == nil {
+		b.blobs[repo] = make(map[digest.Digest][]byte)
+	}
+	b.blobs[repo][dgst] = content
+}
+
+func (b *memBackend) GetManifest(repo image.Repository, reference string) ([]byte, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.manifests[repo][reference]
+	if !ok {
+		return nil, "", fmt.Errorf("manifest %s in %s: %w", reference, repo, fs.ErrNotExist)
+	}
+	return m.Body, m.ContentType, nil
+}
+
+func (b *memBackend) PutManifest(img image.Image, manifest image.ManifestKind) error {
+	desc := manifest.Descriptor()
+	m := fakeManifest{ContentType: desc.MediaType, Body: manifest.Encoded()}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.manifests[img.Repository] == nil {
+		b.manifests[img.Repository] = make(map[string]fakeManifest)
+	}
+	b.manifests[img.Repository][desc.Digest.String()] = m
+	if img.Tag != "" {
+		b.manifests[img.Repository][img.Tag] = m
+	}
+	return nil
+}
+
+func (b *memBackend) HeadManifest(repo image.Repository, reference string) (v1.Descriptor, error) {
+	body, mediaType, err := b.GetManifest(repo, reference)
+	return describeManifest(reference, body, mediaType, err)
+}
+
+func (b *memBackend) ListTags(repo image.Repository) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var tags []string
+	for ref := range b.manifests[repo] {
+		if _, err := digest.Parse(ref); err != nil {
+			tags = append(tags, ref)
+		}
+	}
+	slices.Sort(tags)
+	return tags, nil
+}
+
+func (b *memBackend) Referrers(repo image.Repository, dgst digest.Digest) ([]v1.Descriptor, error) {
+	return referrersFromTag(b, repo, dgst)
+}
+
+func (b *memBackend) Prepare(image.Repository) error { return nil }
+
+func (b *memBackend) Finish(repo image.Repository) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.finished = append(b.finished, repo)
+	return nil
+}
+
+func (b *memBackend) Discard(repo image.Repository) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.discarded = append(b.discarded, repo)
+	return nil
+}
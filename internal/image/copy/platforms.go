@@ -1,9 +1,11 @@
 package copy
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/ahamlinman/magic-mirror/internal/image"
 	"github.com/ahamlinman/magic-mirror/internal/log"
@@ -15,27 +17,30 @@ type platformCopier struct {
 
 	manifests *manifestCache
 	blobs     *blobCopier
+	backends  backendSet
 }
 
 type platformCopyKey struct {
-	Src image.Image
-	Dst image.Image
+	Src           image.Image
+	Dst           image.Image
+	ForeignLayers foreignLayerPolicy
 }
 
-func newPlatformCopier(manifests *manifestCache, blobs *blobCopier) *platformCopier {
+func newPlatformCopier(manifests *manifestCache, blobs *blobCopier, backends backendSet) *platformCopier {
 	c := &platformCopier{
 		manifests: manifests,
 		blobs:     blobs,
+		backends:  backends,
 	}
 	c.Map = parka.NewMap(c.copyPlatform)
 	return c
 }
 
-func (c *platformCopier) Copy(src image.Image, dst image.Image) (image.Manifest, error) {
-	return c.Map.Get(platformCopyKey{Src: src, Dst: dst})
+func (c *platformCopier) Copy(src image.Image, dst image.Image, foreign foreignLayerPolicy) (image.Manifest, error) {
+	return c.Map.Get(platformCopyKey{Src: src, Dst: dst, ForeignLayers: foreign})
 }
 
-func (c *platformCopier) CopyAll(dst image.Repository, srcs ...image.Image) ([]image.Manifest, error) {
+func (c *platformCopier) CopyAll(dst image.Repository, foreign foreignLayerPolicy, srcs ...image.Image) ([]image.Manifest, error) {
 	reqs := make([]platformCopyKey, len(srcs))
 	for i, src := range srcs {
 		reqs[i] = platformCopyKey{
@@ -44,18 +49,20 @@ func (c *platformCopier) CopyAll(dst image.Repository, srcs ...image.Image) ([]i
 				Repository: dst,
 				Digest:     src.Digest,
 			},
+			ForeignLayers: foreign,
 		}
 	}
 	return c.Map.Collect(reqs...)
 }
 
-func (c *platformCopier) copyPlatform(_ *parka.Handle, req platformCopyKey) (m image.Manifest, err error) {
+func (c *platformCopier) copyPlatform(ph *parka.Handle, req platformCopyKey) (m image.Manifest, err error) {
 	// We share this manifest cache with the top-level copier. The top level
 	// requests both indexes and platform manifests, without knowing in advance
 	// what it'll get. This level always gets platform manifests, which are
-	// required to discover source blobs, so we put our requests up front to
-	// fill the blob queue faster.
-	c.manifests.InformFront(req.Src)
+	// required to discover source blobs, so we give our requests a higher
+	// priority to fill the blob queue faster. This also promotes any request
+	// for the same manifest that the top level already queued.
+	c.manifests.InformPriority(1, req.Src)
 	srcManifest, err := c.manifests.Get(req.Src)
 	if err != nil {
 		return
@@ -70,13 +77,26 @@ func (c *platformCopier) copyPlatform(_ *parka.Handle, req platformCopyKey) (m i
 		return
 	}
 
-	layers := manifest.Parsed().Layers
-	blobDigests := make([]digest.Digest, len(layers)+1)
-	for i, layer := range layers {
-		blobDigests[i] = layer.Digest
+	// Artifacts like Helm charts use the same manifest structure as images, with
+	// arbitrary media types for the config and layers. We copy them the same way,
+	// and upload the original manifest byte-for-byte.
+	var (
+		blobDigests   []digest.Digest
+		foreignLayers []v1.Descriptor
+	)
+	for _, blob := range manifest.Parsed().Blobs() {
+		if image.MediaType(blob.MediaType).IsForeignLayer() {
+			foreignLayers = append(foreignLayers, blob)
+		} else {
+			blobDigests = append(blobDigests, blob.Digest)
+		}
+	}
+	if len(foreignLayers) > 0 {
+		if manifest, err = c.handleForeignLayers(ph.Context(), req, manifest, foreignLayers); err != nil {
+			return
+		}
 	}
-	blobDigests[len(blobDigests)-1] = manifest.Parsed().Config.Digest
-	if err = c.blobs.CopyAll(req.Src.Repository, req.Dst.Repository, blobDigests...); err != nil {
+	if err = c.blobs.CopyAll(ph.Context(), req.Src.Repository, req.Dst.Repository, blobDigests...); err != nil {
 		return
 	}
 
@@ -85,9 +105,37 @@ func (c *platformCopier) copyPlatform(_ *parka.Handle, req platformCopyKey) (m i
 		Tag:        req.Dst.Tag,
 		Digest:     manifest.Descriptor().Digest,
 	}
-	err = uploadManifest(dstImg, manifest)
+	err = c.backends.uploadManifest(dstImg, manifest)
 	if err == nil {
 		log.Verbosef("[platform]\tmirrored %s to %s", req.Src, dstImg)
 	}
 	return manifest, err
 }
+
+// handleForeignLayers applies the foreign layer policy for req to a manifest
+// with the provided foreign layers, and returns the manifest to upload to the
+// destination.
+func (c *platformCopier) handleForeignLayers(ctx context.Context, req platformCopyKey, manifest image.Manifest, foreignLayers []v1.Descriptor) (image.Manifest, error) {
+	switch req.ForeignLayers {
+	case skipForeignLayers:
+		log.Verbosef("[platform]\tskipping %d foreign layer(s) in %s", len(foreignLayers), req.Src)
+		return manifest, nil
+	case failForeignLayers:
+		return nil, fmt.Errorf("%s contains %d foreign layer(s)", req.Src, len(foreignLayers))
+	}
+
+	if err := c.blobs.CopyForeign(ctx, req.Dst.Repository, foreignLayers...); err != nil {
+		return nil, err
+	}
+
+	rewritten := image.DeepCopy(manifest).(image.Manifest).Parsed()
+	for i, layer := range rewritten.Layers {
+		mediaType := image.MediaType(layer.MediaType)
+		if mediaType.IsForeignLayer() {
+			rewritten.Layers[i].MediaType = string(mediaType.DistributableLayer())
+			rewritten.Layers[i].URLs = nil
+		}
+	}
+	log.Verbosef("[platform]\trewrote %d foreign layer(s) in %s as regular layers", len(foreignLayers), req.Src)
+	return image.NewRawManifest(rewritten, manifest.Descriptor().Digest.Algorithm()), nil
+}
@@ -0,0 +1,137 @@
+package copy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+// Preflight selects what CopyAllWithOptions does when it finds, before copying
+// anything, that it can't pull from a source repository or push to a
+// destination repository.
+type Preflight int
+
+const (
+	// PreflightAbort refuses to copy anything if any repository fails its
+	// access check.
+	PreflightAbort Preflight = iota
+	// PreflightDrop skips the specs whose repositories fail their access
+	// checks, and copies the rest.
+	PreflightDrop
+	// PreflightOff skips access checks entirely.
+	PreflightOff
+)
+
+// ParsePreflight parses "abort", "drop", or "off" as a Preflight.
+func ParsePreflight(s string) (Preflight, error) {
+	switch s {
+	case "abort":
+		return PreflightAbort, nil
+	case "drop":
+		return PreflightDrop, nil
+	case "off":
+		return PreflightOff, nil
+	default:
+		return 0, fmt.Errorf("unknown preflight mode %q (want abort, drop, or off)", s)
+	}
+}
+
+// accessCheck is a single repository that the specs pull from or push to.
+type accessCheck struct {
+	repo image.Repository
+	push bool
+}
+
+func (a accessCheck) String() string {
+	if a.push {
+		return fmt.Sprintf("push to %s", a.repo)
+	}
+	return fmt.Sprintf("pull from %s", a.repo)
+}
+
+// preflight checks access to every distinct source and destination repository
+// among specs whose backend is an AccessCheckingBackend, with up to
+// concurrency checks at once. If every check passes, preflight returns specs
+// unchanged. Otherwise, it either returns an error that reports every failed
+// check (for PreflightAbort), or returns the specs that don't depend on any
+// failed check along with that report (for PreflightDrop).
+func (c *copier) preflight(concurrency int, mode Preflight, specs []Spec) ([]Spec, error) {
+	if mode == PreflightOff {
+		return specs, nil
+	}
+
+	var checks []accessCheck
+	for _, spec := range specs {
+		for _, check := range []accessCheck{{spec.Src.Repository, false}, {spec.Dst.Repository, true}} {
+			if !slices.Contains(checks, check) {
+				checks = append(checks, check)
+			}
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, max(concurrency, 1))
+		failures = make([]error, len(checks))
+	)
+	for i, check := range checks {
+		backend, err := c.backends.For(check.repo)
+		if err != nil {
+			failures[i] = err
+			continue
+		}
+		checker, ok := backend.(AccessCheckingBackend)
+		if !ok {
+			continue
+		}
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			log.Verbosef("[preflight]\tchecking access to %s", check)
+			failures[i] = checker.CheckAccess(check.repo, check.push)
+		})
+	}
+	wg.Wait()
+
+	failed := make(map[accessCheck]error)
+	for i, err := range failures {
+		if err != nil {
+			failed[checks[i]] = err
+		}
+	}
+	if len(failed) == 0 {
+		return specs, nil
+	}
+
+	var (
+		kept    []Spec
+		dropped int
+	)
+	for _, spec := range specs {
+		_, srcFailed := failed[accessCheck{spec.Src.Repository, false}]
+		_, dstFailed := failed[accessCheck{spec.Dst.Repository, true}]
+		if srcFailed || dstFailed {
+			dropped++
+		} else {
+			kept = append(kept, spec)
+		}
+	}
+
+	var errs []error
+	for i, err := range failures {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot %s: %w", checks[i], err))
+		}
+	}
+	report := errors.Join(errs...)
+
+	if mode == PreflightAbort {
+		return nil, fmt.Errorf("access checks failed for %d repositories (affecting %d of %d copies), so nothing was copied:\n%w",
+			len(failed), dropped, len(specs), report)
+	}
+	return kept, fmt.Errorf("skipped %d of %d copies after access checks failed:\n%w", dropped, len(specs), report)
+}
@@ -0,0 +1,328 @@
+package copy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/registry"
+)
+
+// registryBackend accesses repositories through the registry HTTP API.
+type registryBackend struct{}
+
+var _ AccessCheckingBackend = registryBackend{}
+
+func (registryBackend) StatBlob(repo image.Repository, dgst digest.Digest) (bool, error) {
+	client, err := registry.GetClient(repo, registry.PullScope)
+	if err != nil {
+		return false, err
+	}
+
+	u := registry.APIURL(repo.Registry, fmt.Sprintf("/v2/%s/blobs/%s", repo.Namespace, dgst))
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.DoExpectingNoBody(req, http.StatusOK, http.StatusNotFound)
+	ok := (err == nil && resp.StatusCode == http.StatusOK)
+	return ok, err
+}
+
+func (registryBackend) GetBlob(repo image.Repository, dgst digest.Digest) (r io.ReadCloser, size int64, err error) {
+	client, err := registry.GetClient(repo, registry.PullScope)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	u := registry.APIURL(repo.Registry, fmt.Sprintf("/v2/%s/blobs/%s", repo.Namespace, dgst))
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := client.DoExpecting(req, http.StatusOK)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r = resp.Body
+	size, err = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return
+}
+
+func (registryBackend) PutBlob(repo image.Repository, dgst digest.Digest, size int64, r io.Reader) error {
+	uploadURL, _, err := requestBlobUploadURL(repo, dgst, image.Repository{})
+	if err != nil {
+		return err
+	}
+	return completeBlobUpload(repo, uploadURL, dgst, size, r)
+}
+
+// MountBlob requests a cross-repository mount from another repository in the
+// same registry, with a token that may pull from that repository as well as
+// push to the destination. Registries that decline the mount start a regular
+// upload instead, which MountBlob returns for the caller to complete. Once a
+// registry has declined enough mounts to suggest that it never accepts them,
+// MountBlob stops asking.
+func (registryBackend) MountBlob(repo image.Repository, dgst digest.Digest, from image.Repository) (bool, BlobUpload, error) {
+	if from.Namespace == "" {
+		return false, nil, nil
+	}
+	if support, _ := registry.Probe(repo, registry.MountCapability); support == registry.Unsupported {
+		return false, nil, nil
+	}
+	uploadURL, mounted, err := requestBlobUploadURL(repo, dgst, from)
+	if err != nil {
+		return false, nil, err
+	}
+	registry.ObserveMount(repo.Registry, mounted)
+	if mounted {
+		return true, nil, nil
+	}
+	return false, registryUpload{repo, dgst, uploadURL}, nil
+}
+
+// registryUpload is an upload session that a registry started in place of a
+// declined mount.
+type registryUpload struct {
+	repo      image.Repository
+	dgst      digest.Digest
+	uploadURL *url.URL
+}
+
+func (u registryUpload) Complete(size int64, r io.Reader) error {
+	return completeBlobUpload(u.repo, u.uploadURL, u.dgst, size, r)
+}
+
+func (u registryUpload) Cancel() {
+	if client, err := registry.GetClient(u.repo, registry.PushScope); err == nil {
+		registry.CancelUpload(client, u.uploadURL)
+	}
+}
+
+// CheckAccess checks access to repo as if by [registry.CheckAccess].
+func (registryBackend) CheckAccess(repo image.Repository, push bool) error {
+	return registry.CheckAccess(repo, push)
+}
+
+func (registryBackend) GetManifest(repo image.Repository, reference string) (body []byte, contentType string, err error) {
+	resp, err := requestManifest(repo, http.MethodGet, reference)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	return body, resp.Header.Get("Content-Type"), err
+}
+
+func (registryBackend) PutManifest(img image.Image, manifest image.ManifestKind) error {
+	client, err := registry.GetClient(img.Repository, registry.PushScope)
+	if err != nil {
+		return err
+	}
+
+	reference := img.Tag
+	if reference == "" {
+		reference = img.Digest.String()
+	}
+	if reference == "" {
+		reference = manifest.Descriptor().Digest.String()
+	}
+
+	u := registry.APIURL(img.Registry, fmt.Sprintf("/v2/%s/manifests/%s", img.Namespace, reference))
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(manifest.Encoded()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", manifest.Descriptor().MediaType)
+
+	_, err = client.DoExpectingNoBody(req, http.StatusCreated)
+	return err
+}
+
+func (registryBackend) HeadManifest(repo image.Repository, reference string) (v1.Descriptor, error) {
+	resp, err := requestManifest(repo, http.MethodHead, reference)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	resp.Body.Close()
+
+	dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("missing or invalid digest for %s:%s: %w", repo, reference, err)
+	}
+	return v1.Descriptor{
+		MediaType: string(image.DetectManifestMediaType(resp.Header.Get("Content-Type"), nil)),
+		Digest:    dgst,
+		Size:      resp.ContentLength,
+	}, nil
+}
+
+func (registryBackend) ListTags(repo image.Repository) ([]string, error) {
+	client, err := registry.GetClient(repo, registry.PullScope)
+	if err != nil {
+		return nil, err
+	}
+
+	u := registry.APIURL(repo.Registry, fmt.Sprintf("/v2/%s/tags/list", repo.Namespace))
+	next := u.String()
+
+	var tags []string
+	for next != "" {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.DoExpecting(req, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+
+		// Registries paginate long tag lists with an RFC 5988 Link header.
+		next = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			target, _, _ := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+			if nextURL, err := registry.ResolveLocation(repo.Registry, req.URL, target); err == nil {
+				next = nextURL.String()
+			}
+		}
+	}
+	return tags, nil
+}
+
+// Referrers uses the referrers API when the registry supports it, and falls
+// back to the referrers tag schema otherwise.
+func (b registryBackend) Referrers(repo image.Repository, dgst digest.Digest) ([]v1.Descriptor, error) {
+	if support, _ := registry.Probe(repo, registry.ReferrersCapability); support == registry.Unsupported {
+		return referrersFromTag(b, repo, dgst)
+	}
+
+	client, err := registry.GetClient(repo, registry.PullScope)
+	if err != nil {
+		return nil, err
+	}
+
+	u := registry.APIURL(repo.Registry, fmt.Sprintf("/v2/%s/referrers/%s", repo.Namespace, dgst))
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", v1.MediaTypeImageIndex)
+
+	resp, err := client.DoExpecting(req, http.StatusOK)
+	if isNotFound(err) {
+		return referrersFromTag(b, repo, dgst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var index v1.Index
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("invalid referrers response for %s@%s: %w", repo, dgst, err)
+	}
+	return index.Manifests, nil
+}
+
+func requestManifest(repo image.Repository, method, reference string) (*http.Response, error) {
+	client, err := registry.GetClient(repo, registry.PullScope)
+	if err != nil {
+		return nil, err
+	}
+
+	u := registry.APIURL(repo.Registry, fmt.Sprintf("/v2/%s/manifests/%s", repo.Namespace, reference))
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", strings.Join(image.AllManifestMediaTypes, ","))
+
+	return client.DoExpecting(req, http.StatusOK)
+}
+
+func requestBlobUploadURL(repo image.Repository, dgst digest.Digest, mountFrom image.Repository) (upload *url.URL, mounted bool, err error) {
+	var client registry.Client
+	if mountFrom.Namespace != "" {
+		client, err = registry.GetMountClient(repo, mountFrom)
+	} else {
+		client, err = registry.GetClient(repo, registry.PushScope)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	query := make(url.Values)
+	if mountFrom.Namespace != "" {
+		query.Add("mount", dgst.String())
+		query.Add("from", mountFrom.Namespace)
+	} else {
+		query.Add("digest", dgst.String())
+	}
+
+	u := registry.APIURL(repo.Registry, fmt.Sprintf("/v2/%s/blobs/uploads/", repo.Namespace))
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := client.DoExpectingNoBody(req, http.StatusCreated, http.StatusAccepted)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if resp.StatusCode == http.StatusCreated {
+		// The mount was successful.
+		return nil, true, nil
+	}
+
+	// The mount was not successful, and we need to provide a regular upload URL.
+	upload, err = registry.ResolveLocation(repo.Registry, u, resp.Header.Get("Location"))
+	return
+}
+
+func completeBlobUpload(repo image.Repository, uploadURL *url.URL, dgst digest.Digest, size int64, r io.Reader) error {
+	query, err := url.ParseQuery(uploadURL.RawQuery)
+	if err != nil {
+		return err
+	}
+	query.Add("digest", dgst.String())
+	uploadURL.RawQuery = query.Encode()
+
+	uploadReq, err := http.NewRequest(http.MethodPut, uploadURL.String(), r)
+	if err != nil {
+		return err
+	}
+	uploadReq.Header.Add("Content-Type", "application/octet-stream")
+	uploadReq.Header.Add("Content-Length", strconv.FormatInt(size, 10))
+
+	client, err := registry.GetClient(repo, registry.PushScope)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DoExpectingNoBody(uploadReq, http.StatusCreated)
+	return err
+}
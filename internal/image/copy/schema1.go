@@ -0,0 +1,197 @@
+package copy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+// convertSchema1 converts a legacy schema1 source image to a schema2 image at
+// the destination of spec, given the current destination manifest (if any).
+//
+// Conversion requires the uncompressed digest of every layer, so it downloads
+// each layer from the source in full (in addition to copying it).
+func (c *copier) convertSchema1(ctx context.Context, spec Spec, srcManifest image.Schema1Manifest, dstManifest image.ManifestKind) (image.ManifestKind, error) {
+	if !spec.Transform.ConvertSchema1 {
+		return nil, fmt.Errorf("%s is a legacy schema1 image, and requires the convertSchema1 transform to copy", spec.Src)
+	}
+	if err := srcManifest.Validate(); err != nil {
+		return nil, err
+	}
+
+	allLayers, err := srcManifest.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var layers []image.Schema1Layer
+	for _, layer := range allLayers {
+		if !layer.Throwaway {
+			layers = append(layers, layer)
+		}
+	}
+
+	// If the destination has the same layers as the source, its config records
+	// their uncompressed digests, so we can repeat the conversion without
+	// downloading any layers. We can skip the rest of the process only if that
+	// produces exactly the destination manifest, since the source may have
+	// changed its config or history without changing its layers.
+	if dstManifest != nil && dstManifest.GetMediaType().IsManifest() {
+		if diffIDs, sizes, ok := c.destinationDiffIDs(spec.Dst.Repository, dstManifest.(image.Manifest), layers); ok {
+			config, err := srcManifest.Config(diffIDs)
+			if err == nil && bytes.Equal(convertedManifest(config, layers, sizes).Encoded(), dstManifest.Encoded()) {
+				log.Verbosef("[image]\tno change from converted schema1 %s to %s", spec.Src, spec.Dst)
+				return dstManifest, nil
+			}
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		diffIDs   = make([]digest.Digest, len(layers))
+		sizes     = make([]int64, len(layers))
+		layerErrs = make([]error, len(layers))
+	)
+	for i, layer := range layers {
+		wg.Go(func() {
+			diffIDs[i], sizes[i], layerErrs[i] = c.computeDiffID(spec.Src.Repository, layer.BlobSum)
+		})
+	}
+	wg.Wait()
+	if err := errors.Join(layerErrs...); err != nil {
+		return nil, err
+	}
+
+	config, err := srcManifest.Config(diffIDs)
+	if err != nil {
+		return nil, err
+	}
+	configDigest := digest.Canonical.FromBytes(config)
+	if err := c.backends.uploadBlob(spec.Dst.Repository, configDigest, int64(len(config)), bytes.NewReader(config)); err != nil {
+		return nil, err
+	}
+
+	layerDigests := make([]digest.Digest, len(layers))
+	for i, layer := range layers {
+		layerDigests[i] = layer.BlobSum
+	}
+	if err := c.blobs.CopyAll(ctx, spec.Src.Repository, spec.Dst.Repository, layerDigests...); err != nil {
+		return nil, err
+	}
+
+	manifest := convertedManifest(config, layers, sizes)
+	if err := c.backends.uploadManifest(spec.Dst, manifest); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[image]\tconverted legacy schema1 %s to %s@%s", spec.Src, spec.Dst, manifest.Descriptor().Digest)
+	return manifest, nil
+}
+
+// computeDiffID downloads a compressed layer blob to compute the digest of its
+// uncompressed content, and returns that digest along with the compressed size.
+func (c *copier) computeDiffID(repo image.Repository, dgst digest.Digest) (diffID digest.Digest, size int64, err error) {
+	blob, _, err := c.backends.downloadBlob(repo, dgst)
+	if err != nil {
+		return "", 0, err
+	}
+	defer blob.Close()
+
+	compressed := &countingReader{Reader: blob}
+	verifier := dgst.Verifier()
+	gz, err := gzip.NewReader(io.TeeReader(compressed, verifier))
+	if err != nil {
+		return "", 0, fmt.Errorf("layer %s@%s is not gzip compressed: %w", repo, dgst, err)
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), gz); err != nil {
+		return "", 0, err
+	}
+	// Drain anything past the end of the gzip stream so the verifier sees it.
+	if _, err := io.Copy(io.Discard, io.TeeReader(compressed, verifier)); err != nil {
+		return "", 0, err
+	}
+	if !verifier.Verified() {
+		return "", 0, fmt.Errorf("content of %s@%s does not match its digest", repo, dgst)
+	}
+
+	log.Verbosef("[blob]\tcomputed diff ID of %s@%s", repo, dgst)
+	return digester.Digest(), compressed.N, nil
+}
+
+// convertedManifest returns the schema2 manifest for a converted schema1 image,
+// given its synthesized config along with the compressed size of each of its
+// non-throwaway layers.
+func convertedManifest(config []byte, layers []image.Schema1Layer, sizes []int64) image.ParsedManifest {
+	manifest := image.ParsedManifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: string(image.DockerManifestMediaType),
+		Config: v1.Descriptor{
+			MediaType: string(image.DockerConfigMediaType),
+			Digest:    digest.Canonical.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: make([]v1.Descriptor, len(layers)),
+	}
+	for i, layer := range layers {
+		manifest.Layers[i] = v1.Descriptor{
+			MediaType: string(image.DockerLayerGzipMediaType),
+			Digest:    layer.BlobSum,
+			Size:      sizes[i],
+		}
+	}
+	return manifest
+}
+
+// destinationDiffIDs returns the uncompressed digests and compressed sizes of
+// layers as recorded by dstManifest and its config in repo, if dstManifest has
+// exactly the provided layers. It returns false if the destination can't
+// provide them for any reason, in which case the conversion must compute them
+// from the source.
+func (c *copier) destinationDiffIDs(repo image.Repository, dstManifest image.Manifest, layers []image.Schema1Layer) (diffIDs []digest.Digest, sizes []int64, ok bool) {
+	parsed := dstManifest.Parsed()
+	if !slices.EqualFunc(parsed.Layers, layers, func(desc v1.Descriptor, layer image.Schema1Layer) bool {
+		return desc.Digest == layer.BlobSum
+	}) {
+		return nil, nil, false
+	}
+
+	blob, _, err := c.backends.downloadBlob(repo, parsed.Config.Digest)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer blob.Close()
+	var config v1.Image
+	if err := json.NewDecoder(blob).Decode(&config); err != nil || len(config.RootFS.DiffIDs) != len(layers) {
+		return nil, nil, false
+	}
+
+	sizes = make([]int64, len(layers))
+	for i, desc := range parsed.Layers {
+		sizes[i] = desc.Size
+	}
+	return config.RootFS.DiffIDs, sizes, true
+}
+
+type countingReader struct {
+	io.Reader
+	N int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.N += int64(n)
+	return
+}
@@ -0,0 +1,292 @@
+package copy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/signature"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+// signDestination signs the manifest at the destination of spec with the
+// copier's signing key, given the source manifest and the destination manifest.
+// The signature payload records the source reference and digest, and the
+// signature is attached as a referrer of the destination manifest or under its
+// companion tag. Nothing changes if the destination already carries the same
+// signature.
+func (c *copier) signDestination(ctx context.Context, spec Spec, srcManifest, dstManifest image.ManifestKind) error {
+	if c.signingKey == nil {
+		return nil
+	}
+	if spec.Dst.Transport == image.DockerArchiveTransport {
+		log.Verbosef("[image]\tskipping signature for %s, since it is a docker archive", spec.Dst)
+		return nil
+	}
+
+	dstDesc := dstManifest.Descriptor()
+	payload, err := signature.NewPayload(spec.Dst.Repository.String(), dstDesc.Digest, map[string]any{
+		"source":       spec.Src.String(),
+		"sourceDigest": srcManifest.Descriptor().Digest.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Concurrent specs for the same destination digest would otherwise race to
+	// update the same signature manifest or referrers index.
+	lockKey := image.Image{Repository: spec.Dst.Repository, Digest: dstDesc.Digest}
+	c.signMu.Lock(lockKey)
+	defer c.signMu.Unlock(lockKey)
+
+	if c.signReferrers {
+		err = c.signAsReferrer(spec.Dst.Repository, dstDesc, payload)
+	} else {
+		var srcSigs image.Image
+		if slices.Contains(spec.CompanionTags.ToSlice(), signatureSuffix) && preservesDigest(srcManifest, dstManifest) {
+			srcSigs = image.Image{Repository: spec.Src.Repository, Tag: companionTag(srcManifest.Descriptor().Digest, signatureSuffix)}
+		}
+		err = c.signWithTag(ctx, spec.Dst.Repository, dstDesc.Digest, payload, srcSigs)
+	}
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", lockKey, err)
+	}
+	return nil
+}
+
+// signsWithTag returns true if the copier signs the destination of spec under
+// its signature companion tag.
+func (c *copier) signsWithTag(spec Spec) bool {
+	return c.signingKey != nil && !c.signReferrers && c.topLevel[spec] &&
+		spec.Dst.Transport != image.DockerArchiveTransport
+}
+
+// signWithTag adds a signature of payload to the signature manifest under the
+// companion tag for dgst in repo, creating the manifest if necessary. If srcSigs
+// is not the zero Image, it names a source signature manifest whose signatures
+// signWithTag also adds to the destination manifest, if they are missing. The
+// destination manifest is written at most once, and never without the copier's
+// own signature.
+func (c *copier) signWithTag(ctx context.Context, repo image.Repository, dgst digest.Digest, payload []byte, srcSigs image.Image) error {
+	backend, err := c.backends.For(repo)
+	if err != nil {
+		return err
+	}
+
+	var srcLayers []v1.Descriptor
+	if srcSigs != (image.Image{}) {
+		srcManifest, err := c.srcManifests.Get(srcSigs)
+		switch {
+		case err == nil && srcManifest.GetMediaType().IsManifest():
+			srcLayers = srcManifest.(image.Manifest).Parsed().Layers
+		case err != nil && !isNotFound(err):
+			return err
+		}
+	}
+
+	tagImg := image.Image{Repository: repo, Tag: companionTag(dgst, signatureSuffix)}
+	manifest := image.ParsedManifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+	}
+	body, _, err := backend.GetManifest(repo, tagImg.Tag)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			return fmt.Errorf("invalid signature manifest %s: %w", tagImg, err)
+		}
+	case !isNotFound(err):
+		return err
+	}
+
+	var missing []v1.Descriptor
+	for _, layer := range srcLayers {
+		if !slices.ContainsFunc(manifest.Layers, func(existing v1.Descriptor) bool {
+			return existing.Digest == layer.Digest &&
+				existing.Annotations[signature.Annotation] == layer.Annotations[signature.Annotation]
+		}) {
+			missing = append(missing, layer)
+		}
+	}
+	signed := c.hasOwnSignature(manifest, dgst, payload)
+	if signed && len(missing) == 0 {
+		log.Verbosef("[image]\t%s@%s is already signed", repo, dgst)
+		return nil
+	}
+
+	if len(missing) > 0 {
+		digests := make([]digest.Digest, len(missing))
+		for i, layer := range missing {
+			digests[i] = layer.Digest
+		}
+		if err := c.blobs.CopyAll(ctx, srcSigs.Repository, repo, digests...); err != nil {
+			return err
+		}
+		manifest.Layers = append(slices.Clip(manifest.Layers), missing...)
+		log.Verbosef("[image]\tadding %d signatures from %s to %s", len(missing), srcSigs, tagImg)
+	}
+	if !signed {
+		layer, err := c.uploadSignature(repo, payload)
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(slices.Clip(manifest.Layers), layer)
+	}
+	if manifest.Config.Digest == "" {
+		// Like cosign, use an image config type that older registries accept.
+		if err := c.uploadEmptyJSON(repo); err != nil {
+			return err
+		}
+		manifest.Config = v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: v1.DescriptorEmptyJSON.Digest, Size: v1.DescriptorEmptyJSON.Size}
+	}
+	if err := c.backends.uploadManifest(tagImg, manifest); err != nil {
+		return err
+	}
+
+	log.Printf("[image]\tsigned %s@%s as %s", repo, dgst, tagImg)
+	return nil
+}
+
+// signAsReferrer attaches a new signature manifest for payload to the manifest
+// described by subject in repo, unless one of its referrers already carries the
+// signature.
+//
+// Storage without support for the referrers API finds referrers through the
+// fallback tag schema, so signAsReferrer also adds the signature manifest to the
+// fallback index whenever the storage doesn't report it as a referrer.
+func (c *copier) signAsReferrer(repo image.Repository, subject v1.Descriptor, payload []byte) error {
+	backend, err := c.backends.For(repo)
+	if err != nil {
+		return err
+	}
+
+	referrers, err := backend.Referrers(repo, subject.Digest)
+	if err != nil {
+		return err
+	}
+	for _, desc := range referrers {
+		if desc.ArtifactType != signature.ArtifactType {
+			continue
+		}
+		body, _, err := backend.GetManifest(repo, desc.Digest.String())
+		if err != nil {
+			return err
+		}
+		var existing image.ParsedManifest
+		if json.Unmarshal(body, &existing) == nil && c.hasOwnSignature(existing, subject.Digest, payload) {
+			log.Verbosef("[image]\t%s@%s is already signed", repo, subject.Digest)
+			return nil
+		}
+	}
+
+	layer, err := c.uploadSignature(repo, payload)
+	if err != nil {
+		return err
+	}
+	if err := c.uploadEmptyJSON(repo); err != nil {
+		return err
+	}
+	manifest := image.ParsedManifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: signature.ArtifactType,
+		Config:       v1.Descriptor{MediaType: v1.MediaTypeEmptyJSON, Digest: v1.DescriptorEmptyJSON.Digest, Size: v1.DescriptorEmptyJSON.Size},
+		Layers:       []v1.Descriptor{layer},
+		Subject:      &v1.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+	}
+	desc := manifest.Descriptor()
+	if err := c.backends.uploadManifest(image.Image{Repository: repo, Digest: desc.Digest}, manifest); err != nil {
+		return err
+	}
+
+	referrers, err = backend.Referrers(repo, subject.Digest)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(referrers, func(d v1.Descriptor) bool { return d.Digest == desc.Digest }) {
+		if err := c.addFallbackReferrer(repo, subject.Digest, desc); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[image]\tsigned %s@%s with referrer %s", repo, subject.Digest, desc.Digest)
+	return nil
+}
+
+// addFallbackReferrer adds desc to the index of referrers for dgst under the
+// fallback tag schema in repo.
+func (c *copier) addFallbackReferrer(repo image.Repository, dgst digest.Digest, desc v1.Descriptor) error {
+	backend, err := c.backends.For(repo)
+	if err != nil {
+		return err
+	}
+
+	tagImg := image.Image{Repository: repo, Tag: fmt.Sprintf("%s-%s", dgst.Algorithm(), dgst.Encoded())}
+	index := image.ParsedIndex{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+	}
+	body, _, err := backend.GetManifest(repo, tagImg.Tag)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(body, &index); err != nil {
+			return fmt.Errorf("invalid referrers index %s: %w", tagImg, err)
+		}
+	case !isNotFound(err):
+		return err
+	}
+	index.Manifests = append(slices.Clip(index.Manifests), v1.Descriptor{
+		MediaType:    desc.MediaType,
+		ArtifactType: desc.ArtifactType,
+		Digest:       desc.Digest,
+		Size:         desc.Size,
+	})
+	return c.backends.uploadManifest(tagImg, index)
+}
+
+// uploadSignature signs payload and uploads it to repo, and returns a layer
+// descriptor for it that carries the signature.
+func (c *copier) uploadSignature(repo image.Repository, payload []byte) (v1.Descriptor, error) {
+	sig, err := signature.Sign(c.signingKey, payload)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	dgst := digest.FromBytes(payload)
+	if err := c.backends.uploadBlob(repo, dgst, int64(len(payload)), bytes.NewReader(payload)); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{
+		MediaType:   signature.PayloadMediaType,
+		Digest:      dgst,
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{signature.Annotation: sig},
+	}, nil
+}
+
+// uploadEmptyJSON uploads the content of [v1.DescriptorEmptyJSON] to repo.
+func (c *copier) uploadEmptyJSON(repo image.Repository) error {
+	desc := v1.DescriptorEmptyJSON
+	return c.backends.uploadBlob(repo, desc.Digest, desc.Size, bytes.NewReader(desc.Data))
+}
+
+// hasOwnSignature returns true if manifest contains a layer for payload that
+// carries a valid signature under the copier's signing key.
+func (c *copier) hasOwnSignature(manifest image.ParsedManifest, dgst digest.Digest, payload []byte) bool {
+	payloadDigest := digest.FromBytes(payload)
+	keys := []crypto.PublicKey{c.signingKey.Public()}
+	for _, layer := range manifest.Layers {
+		sig, ok := layer.Annotations[signature.Annotation]
+		if ok && layer.Digest == payloadDigest && signature.Verify(keys, payload, sig, dgst) == nil {
+			return true
+		}
+	}
+	return false
+}
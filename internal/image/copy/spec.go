@@ -19,6 +19,12 @@ type Spec struct {
 	Src       image.Image `json:"src"`
 	Dst       image.Image `json:"dst"`
 	Transform Transform   `json:"transform,omitzero"`
+
+	// CompanionTags lists the suffixes of cosign-style companion tags (such as
+	// "sig" for "sha256-<hex>.sig") to copy from the source repository to the
+	// destination repository after mirroring the image. Companion tags are only
+	// copied when the destination image retains the digest of the source image.
+	CompanionTags companionSet `json:"companionTags,omitzero"`
 }
 
 // Transform represents an optional set of transformations to perform while
@@ -29,6 +35,24 @@ type Transform struct {
 	// image will be copied. If the source image is a single-platform image, this
 	// setting will be ignored and the image will be copied as-is.
 	LimitPlatforms platformSet `json:"limitPlatforms,omitzero"`
+
+	// ConvertSchema1 permits the conversion of a legacy Docker schema1 source
+	// image to a schema2 image, by synthesizing an image config from the history
+	// in the schema1 manifest. If it is false, the copy of a schema1 image will
+	// fail. The setting has no effect on other kinds of images.
+	ConvertSchema1 bool `json:"convertSchema1,omitzero"`
+
+	// ForeignLayers determines how to handle foreign (non-distributable) layers,
+	// which images reference by URL rather than storing in the registry. See
+	// [foreignLayerPolicy] for details.
+	ForeignLayers foreignLayerPolicy `json:"foreignLayers,omitzero"`
+}
+
+// preservesSource returns true if t has no effect on source images other than
+// legacy schema1 images, which can never be copied as-is.
+func (t Transform) preservesSource() bool {
+	t.ConvertSchema1 = false
+	return t == Transform{}
 }
 
 type platformSet struct {
@@ -57,17 +81,89 @@ func (ps *platformSet) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// foreignLayerPolicy determines how to copy foreign layers. The zero value
+// skips foreign layers, as the image spec expects.
+type foreignLayerPolicy string
+
+const (
+	// skipForeignLayers copies the manifest with its foreign layers as-is, so
+	// that clients continue to fetch them from their original URLs.
+	skipForeignLayers foreignLayerPolicy = ""
+	// copyForeignLayers fetches the content of foreign layers from their URLs,
+	// and rewrites them as regular layers stored in the destination registry.
+	copyForeignLayers foreignLayerPolicy = "copy"
+	// failForeignLayers fails the copy of any image with foreign layers.
+	failForeignLayers foreignLayerPolicy = "fail"
+)
+
+func (p *foreignLayerPolicy) UnmarshalJSON(b []byte) error {
+	var raw string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	switch policy := foreignLayerPolicy(raw); policy {
+	case "skip":
+		// This is an explicit form of the default, and must compare equal to it.
+		*p = skipForeignLayers
+	case skipForeignLayers, copyForeignLayers, failForeignLayers:
+		*p = policy
+	default:
+		return fmt.Errorf("unknown foreign layer policy %q", raw)
+	}
+	return nil
+}
+
+// Suffixes of the companion tags that cosign attaches to images using its
+// legacy tag-based scheme.
+const (
+	signatureSuffix   = "sig"
+	attestationSuffix = "att"
+	sbomSuffix        = "sbom"
+)
+
+type companionSet struct {
+	stringkeyed.Set
+}
+
+func (cs *companionSet) UnmarshalJSON(b []byte) error {
+	var raw stringkeyed.Set
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	for suffix := range raw.All() {
+		switch suffix {
+		case signatureSuffix, attestationSuffix, sbomSuffix:
+		default:
+			return fmt.Errorf("unknown companion tag suffix %q", suffix)
+		}
+	}
+	cs.Set = raw
+	return nil
+}
+
 func coalesceRequests(specs []Spec) ([]Spec, error) {
 	var errs []error
 
 	srcs := mapset.NewThreadUnsafeSet[image.Image]()
+	srcArchives := mapset.NewThreadUnsafeSet[image.Repository]()
 	for _, spec := range specs {
 		srcs.Add(spec.Src)
+		if spec.Src.Transport == image.DockerArchiveTransport {
+			srcArchives.Add(spec.Src.Repository)
+		}
 	}
 	for _, spec := range specs {
 		if srcs.Contains(spec.Dst) {
 			errs = append(errs, fmt.Errorf("%s is both a source and a destination", spec.Dst))
 		}
+		if spec.Dst.Transport == image.DockerArchiveTransport {
+			if srcArchives.Contains(spec.Dst.Repository) {
+				errs = append(errs, fmt.Errorf("docker archive %s is both a source and a destination", spec.Dst.Repository))
+			}
+			if spec.Dst.Tag == "" {
+				errs = append(errs, fmt.Errorf("docker archive destination %s requires an image name", spec.Dst))
+			}
+		}
 		if spec.Dst.Digest != "" && spec.Dst.Digest != spec.Src.Digest {
 			errs = append(errs, fmt.Errorf("explicit digest on destination %s is inconsistent with source %s", spec.Dst, spec.Src))
 		}
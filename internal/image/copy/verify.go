@@ -0,0 +1,138 @@
+package copy
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/image/signature"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+// maxPayloadSize bounds the size of the signature payloads that verifySource
+// will download. Real payloads are a few hundred bytes.
+const maxPayloadSize = 1 << 20
+
+// verifySource checks the signatures of the source image of spec against the
+// copier's signature policy, given the source manifest, and returns an error
+// unless at least one signature is valid under a key trusted for the source
+// repository. Signatures may come from the source repository's companion tag
+// for the manifest, or from its referrers.
+func (c *copier) verifySource(spec Spec, srcManifest image.ManifestKind) error {
+	if c.policy == nil {
+		return nil
+	}
+
+	dgst := srcManifest.Descriptor().Digest
+	scope, keys, ok := c.policy.KeysFor(spec.Src.Repository.String())
+	if !ok {
+		return fmt.Errorf("refusing to copy %s: no signature policy scope covers %s", spec.Src, spec.Src.Repository)
+	}
+
+	candidates, err := c.findSignatures(spec.Src.Repository, dgst)
+	if err != nil {
+		return fmt.Errorf("refusing to copy %s: cannot find signatures: %w", spec.Src, err)
+	}
+
+	var errs []error
+	for _, sigImg := range candidates {
+		err := c.verifySignatureManifest(sigImg, keys, dgst)
+		if err == nil {
+			log.Verbosef("[image]\tverified %s@%s with signature %s (scope %q)", spec.Src.Repository, dgst, sigImg, scope)
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", sigImg, err))
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("refusing to copy %s: no signatures found for %s@%s", spec.Src, spec.Src.Repository, dgst)
+	}
+	return fmt.Errorf("refusing to copy %s: no valid signature for %s@%s under scope %q: %w",
+		spec.Src, spec.Src.Repository, dgst, scope, errors.Join(errs...))
+}
+
+// findSignatures returns the signature manifests for the manifest with the
+// provided digest in repo.
+func (c *copier) findSignatures(repo image.Repository, dgst digest.Digest) ([]image.Image, error) {
+	var candidates []image.Image
+
+	tagged := image.Image{Repository: repo, Tag: companionTag(dgst, signatureSuffix)}
+	if _, err := c.srcManifests.Get(tagged); err == nil {
+		candidates = append(candidates, tagged)
+	} else if !isNotFound(err) {
+		return nil, err
+	}
+
+	backend, err := c.backends.For(repo)
+	if err != nil {
+		return nil, err
+	}
+	referrers, err := backend.Referrers(repo, dgst)
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range referrers {
+		if desc.ArtifactType == signature.ArtifactType {
+			candidates = append(candidates, image.Image{Repository: repo, Digest: desc.Digest})
+		}
+	}
+	return candidates, nil
+}
+
+// verifySignatureManifest returns nil if any payload layer in the signature
+// manifest sigImg carries a valid signature for dgst under one of keys.
+func (c *copier) verifySignatureManifest(sigImg image.Image, keys []crypto.PublicKey, dgst digest.Digest) error {
+	manifest, err := c.srcManifests.Get(sigImg)
+	if err != nil {
+		return err
+	}
+	if !manifest.GetMediaType().IsManifest() {
+		return errors.New("signature is not an image manifest")
+	}
+
+	var errs []error
+	for _, layer := range manifest.(image.Manifest).Parsed().Layers {
+		sig, ok := layer.Annotations[signature.Annotation]
+		if layer.MediaType != signature.PayloadMediaType || !ok {
+			continue
+		}
+		payload, err := c.downloadPayload(sigImg.Repository, layer)
+		if err == nil {
+			err = signature.Verify(keys, payload, sig, dgst)
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no signed payloads")
+	}
+	return errors.Join(errs...)
+}
+
+// downloadPayload downloads the signature payload described by layer, and
+// checks it against the layer's digest.
+func (c *copier) downloadPayload(repo image.Repository, layer v1.Descriptor) ([]byte, error) {
+	if layer.Size > maxPayloadSize {
+		return nil, fmt.Errorf("payload %s is too large (%d bytes)", layer.Digest, layer.Size)
+	}
+	blob, _, err := c.backends.downloadBlob(repo, layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(blob, maxPayloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxPayloadSize || layer.Digest.Validate() != nil || layer.Digest.Algorithm().FromBytes(payload) != layer.Digest {
+		return nil, fmt.Errorf("content of payload %s does not match its digest", layer.Digest)
+	}
+	return payload, nil
+}
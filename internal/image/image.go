@@ -3,6 +3,7 @@ package image
 import (
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -10,6 +11,35 @@ import (
 	"github.com/opencontainers/go-digest"
 )
 
+// Transport identifies the mechanism used to store and access images in a
+// repository.
+type Transport string
+
+const (
+	// RegistryTransport accesses images through the registry HTTP API. It is the
+	// default for references without an explicit transport.
+	RegistryTransport Transport = ""
+
+	// OCILayoutTransport accesses images in an OCI Image Layout directory on the
+	// local filesystem. The Registry of a repository using this transport is the
+	// path to the layout directory, and the Namespace is empty.
+	OCILayoutTransport Transport = "oci"
+
+	// DockerArchiveTransport accesses images in a tarball in the format of
+	// "docker save" and "docker load". The Registry of a repository using this
+	// transport is the path to the tarball, the Namespace is empty, and the Tag
+	// of an image is the full name that the archive records for it (for example,
+	// "alpine:3.19").
+	DockerArchiveTransport Transport = "docker-archive"
+
+	// RegistryStorageTransport accesses images directly in the storage
+	// directory of a registry using the docker/distribution filesystem driver.
+	// The Registry of a repository using this transport is the path to the
+	// storage directory, and the Namespace is the name of the repository within
+	// it.
+	RegistryStorageTransport Transport = "registry-fs"
+)
+
 type Registry string
 
 func (r Registry) APIBaseURL() *url.URL {
@@ -24,11 +54,18 @@ func (r Registry) APIBaseURL() *url.URL {
 }
 
 type Repository struct {
+	Transport Transport
 	Registry
 	Namespace string
 }
 
 func (r Repository) String() string {
+	if r.Transport != RegistryTransport {
+		if r.Namespace != "" {
+			return fmt.Sprintf("%s:%s:%s", r.Transport, r.Registry, r.Namespace)
+		}
+		return fmt.Sprintf("%s:%s", r.Transport, r.Registry)
+	}
 	return fmt.Sprintf("%s/%s", r.Registry, r.Namespace)
 }
 
@@ -44,7 +81,22 @@ const defaultRegistry = "docker.io"
 // TODO: This may not be the ideal way to do this.
 var imageRegexp = regexp.MustCompile(`^(?:(?P<registry>[^/]+[.:][^/]+)/)?(?P<namespace>[^:@]+)(?::(?P<tag>[a-zA-Z0-9-_.]{1,128}))?(?:@(?P<digest>.+))?$`)
 
+// portPathRegexp matches the rest of a reference like "oci:5000/team/app",
+// where the apparent transport prefix is really a registry host with a port.
+var portPathRegexp = regexp.MustCompile(`^[0-9]+/`)
+
 func Parse(s string) (Image, error) {
+	if transport, rest, ok := strings.Cut(s, ":"); ok && !portPathRegexp.MatchString(rest) {
+		switch Transport(transport) {
+		case OCILayoutTransport:
+			return parseLayout(s, rest)
+		case DockerArchiveTransport:
+			return parseArchive(s, rest)
+		case RegistryStorageTransport:
+			return parseStorage(s, rest)
+		}
+	}
+
 	match := imageRegexp.FindStringSubmatch(s)
 	if len(match) == 0 {
 		return Image{}, fmt.Errorf("image reference %q does not match expected format", s)
@@ -84,6 +136,115 @@ func Parse(s string) (Image, error) {
 	return img, nil
 }
 
+var tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9-_.]{1,128}$`)
+
+// parseLayout parses the part of an OCI layout reference s following the
+// "oci:" transport prefix, which has the form "path[:tag][@digest]". As in
+// registry references, the tag defaults to "latest" without a digest, and
+// the tag is stored in the layout as an org.opencontainers.image.ref.name
+// annotation. The path must not contain a colon.
+func parseLayout(s, rest string) (Image, error) {
+	var img Image
+	rest, rawDigest, _ := strings.Cut(rest, "@")
+	path, tag, _ := strings.Cut(rest, ":")
+	if path == "" {
+		return Image{}, fmt.Errorf("layout reference %q has no path", s)
+	}
+	if tag != "" && !tagRegexp.MatchString(tag) {
+		return Image{}, fmt.Errorf("layout reference %q has an invalid tag", s)
+	}
+	if tag == "" && rawDigest == "" {
+		tag = "latest"
+	}
+
+	img.Repository = Repository{
+		Transport: OCILayoutTransport,
+		Registry:  Registry(filepath.Clean(path)),
+	}
+	img.Tag = tag
+	if rawDigest != "" {
+		img.Digest = digest.Digest(rawDigest)
+		if err := img.Digest.Validate(); err != nil {
+			return Image{}, fmt.Errorf("invalid digest in %q: %w", s, err)
+		}
+	}
+	return img, nil
+}
+
+// parseArchive parses the part of a Docker archive reference s following the
+// "docker-archive:" transport prefix, which has the form "path[:name[:tag]]".
+// The name and tag are stored together in the Tag field of the result, and are
+// optional for archives that contain a single image. Docker archives do not
+// support digest references, and the path must not contain a colon.
+func parseArchive(s, rest string) (Image, error) {
+	path, ref, _ := strings.Cut(rest, ":")
+	if path == "" {
+		return Image{}, fmt.Errorf("docker archive reference %q has no path", s)
+	}
+	if ref != "" {
+		if _, err := name.NewTag(ref); err != nil || strings.Contains(ref, "@") {
+			return Image{}, fmt.Errorf("docker archive reference %q has an invalid image name", s)
+		}
+	}
+	return Image{
+		Repository: Repository{
+			Transport: DockerArchiveTransport,
+			Registry:  Registry(filepath.Clean(path)),
+		},
+		Tag: ref,
+	}, nil
+}
+
+var (
+	storageRefRegexp     = regexp.MustCompile(`^(?P<namespace>[^:@]+)(?::(?P<tag>[a-zA-Z0-9-_.]{1,128}))?(?:@(?P<digest>.+))?$`)
+	repositoryNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+)
+
+// parseStorage parses the part of a registry storage reference s following
+// the "registry-fs:" transport prefix, which has the form
+// "path:namespace[:tag][@digest]". As in registry references, the tag defaults
+// to "latest" without a digest. The path must not contain a colon.
+func parseStorage(s, rest string) (Image, error) {
+	path, ref, _ := strings.Cut(rest, ":")
+	if path == "" {
+		return Image{}, fmt.Errorf("registry storage reference %q has no path", s)
+	}
+	match := storageRefRegexp.FindStringSubmatch(ref)
+	if len(match) == 0 {
+		return Image{}, fmt.Errorf("registry storage reference %q does not match expected format", s)
+	}
+
+	var (
+		namespace = match[1]
+		tag       = match[2]
+		rawDigest = match[3]
+	)
+	// The namespace becomes part of a filesystem path, so it must strictly follow
+	// the rules for repository names.
+	if !repositoryNameRegexp.MatchString(namespace) {
+		return Image{}, fmt.Errorf("invalid repository name in %q", s)
+	}
+	if tag == "" && rawDigest == "" {
+		tag = "latest"
+	}
+
+	img := Image{
+		Repository: Repository{
+			Transport: RegistryStorageTransport,
+			Registry:  Registry(filepath.Clean(path)),
+			Namespace: namespace,
+		},
+		Tag: tag,
+	}
+	if rawDigest != "" {
+		img.Digest = digest.Digest(rawDigest)
+		if err := img.Digest.Validate(); err != nil {
+			return Image{}, fmt.Errorf("invalid digest in %q: %w", s, err)
+		}
+	}
+	return img, nil
+}
+
 func (i Image) String() string {
 	result := i.Repository.String()
 	if i.Tag != "" {
@@ -0,0 +1,82 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDigest = digest.Digest("sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+
+func TestParseLocalTransports(t *testing.T) {
+	testCases := []struct {
+		ref  string
+		want Image
+	}{
+		// OCI layouts
+		{"oci:./mirror", Image{Repository: Repository{Transport: OCILayoutTransport, Registry: "mirror"}, Tag: "latest"}},
+		{"oci:/srv/mirror:v1.2.3", Image{Repository: Repository{Transport: OCILayoutTransport, Registry: "/srv/mirror"}, Tag: "v1.2.3"}},
+		{"oci:mirror@" + string(testDigest), Image{Repository: Repository{Transport: OCILayoutTransport, Registry: "mirror"}, Digest: testDigest}},
+		{"oci:mirror:v1@" + string(testDigest), Image{Repository: Repository{Transport: OCILayoutTransport, Registry: "mirror"}, Tag: "v1", Digest: testDigest}},
+		{"oci:./5000/team/app", Image{Repository: Repository{Transport: OCILayoutTransport, Registry: "5000/team/app"}, Tag: "latest"}},
+
+		// Docker archives
+		{"docker-archive:images.tar", Image{Repository: Repository{Transport: DockerArchiveTransport, Registry: "images.tar"}}},
+		{"docker-archive:./images.tar:alpine:3.19", Image{Repository: Repository{Transport: DockerArchiveTransport, Registry: "images.tar"}, Tag: "alpine:3.19"}},
+		{"docker-archive:/tmp/images.tar:example.com:5000/app:v1", Image{Repository: Repository{Transport: DockerArchiveTransport, Registry: "/tmp/images.tar"}, Tag: "example.com:5000/app:v1"}},
+
+		// Registry storage
+		{"registry-fs:/var/lib/registry:library/alpine", Image{Repository: Repository{Transport: RegistryStorageTransport, Registry: "/var/lib/registry", Namespace: "library/alpine"}, Tag: "latest"}},
+		{"registry-fs:/var/lib/registry:library/alpine:3.19", Image{Repository: Repository{Transport: RegistryStorageTransport, Registry: "/var/lib/registry", Namespace: "library/alpine"}, Tag: "3.19"}},
+		{"registry-fs:storage:app@" + string(testDigest), Image{Repository: Repository{Transport: RegistryStorageTransport, Registry: "storage", Namespace: "app"}, Digest: testDigest}},
+
+		// Registry hosts that share a name with a transport
+		{"oci:5000/team/app", Image{Repository: Repository{Registry: "oci:5000", Namespace: "team/app"}, Tag: "latest"}},
+		{"oci:5000/team/app:v1", Image{Repository: Repository{Registry: "oci:5000", Namespace: "team/app"}, Tag: "v1"}},
+		{"docker-archive:443/app@" + string(testDigest), Image{Repository: Repository{Registry: "docker-archive:443", Namespace: "app"}, Digest: testDigest}},
+		{"registry-fs:5000/team/app", Image{Repository: Repository{Registry: "registry-fs:5000", Namespace: "team/app"}, Tag: "latest"}},
+	}
+	for _, tc := range testCases {
+		got, err := Parse(tc.ref)
+		if assert.NoError(t, err, tc.ref) {
+			assert.Equal(t, tc.want, got, tc.ref)
+		}
+	}
+}
+
+func TestParseLocalTransportsInvalid(t *testing.T) {
+	testCases := []string{
+		"oci:",
+		"oci::v1",
+		"oci:mirror:bad/tag",
+		"oci:mirror@sha256:short",
+		"docker-archive:",
+		"docker-archive::alpine",
+		"docker-archive:images.tar:Bad_Name",
+		"docker-archive:images.tar:alpine@" + string(testDigest),
+		"registry-fs:",
+		"registry-fs:/var/lib/registry",
+		"registry-fs::library/alpine",
+		"registry-fs:/var/lib/registry:../escape",
+		"registry-fs:/var/lib/registry:Upper/case",
+		"registry-fs:/var/lib/registry:app@sha256:short",
+	}
+	for _, ref := range testCases {
+		_, err := Parse(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestParseLocalTransportsRoundTrip(t *testing.T) {
+	for _, ref := range []string{
+		"oci:mirror:v1",
+		"docker-archive:images.tar:alpine:3.19",
+		"registry-fs:/var/lib/registry:library/alpine:3.19",
+	} {
+		img, err := Parse(ref)
+		require.NoError(t, err, ref)
+		assert.Equal(t, ref, img.String())
+	}
+}
@@ -0,0 +1,255 @@
+// Package layout reads and writes images in OCI Image Layout directories.
+//
+// A layout stores every blob and manifest under blobs/<algorithm>/<encoded>,
+// and records tagged manifests in its top-level index.json using the
+// org.opencontainers.image.ref.name annotation. Blobs are written to a
+// temporary file and renamed into place, so that readers never observe partial
+// content. Updates to index.json are serialized within the process, and are
+// likewise atomic on the filesystem.
+package layout
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/atomicfile"
+)
+
+const (
+	layoutFile = "oci-layout"
+	indexFile  = "index.json"
+	blobsDir   = "blobs"
+)
+
+// Layout provides access to the content of an OCI Image Layout directory.
+type Layout struct {
+	path    string
+	indexMu sync.Mutex
+}
+
+var (
+	layouts   = make(map[string]*Layout)
+	layoutsMu sync.Mutex
+)
+
+// Open returns the Layout for the directory at path, which need not exist yet.
+// The directory is initialized on the first write. All calls with the same
+// cleaned path share a Layout, so that concurrent writers within this process
+// don't lose each other's updates to index.json.
+func Open(path string) *Layout {
+	path = filepath.Clean(path)
+
+	layoutsMu.Lock()
+	defer layoutsMu.Unlock()
+	if l, ok := layouts[path]; ok {
+		return l
+	}
+	l := &Layout{path: path}
+	layouts[path] = l
+	return l
+}
+
+// HasBlob returns whether the layout contains the blob with the provided digest.
+func (l *Layout) HasBlob(dgst digest.Digest) (bool, error) {
+	path, err := l.blobPath(dgst)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetBlob opens the blob with the provided digest, and returns its size.
+func (l *Layout) GetBlob(dgst digest.Digest) (r io.ReadCloser, size int64, err error) {
+	path, err := l.blobPath(dgst)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+// PutBlob writes the content of r to the layout as the blob with the provided
+// digest, failing if the content does not match the digest.
+func (l *Layout) PutBlob(dgst digest.Digest, r io.Reader) error {
+	if err := l.init(); err != nil {
+		return err
+	}
+
+	path, err := l.blobPath(dgst)
+	if err != nil {
+		return err
+	}
+	verifier := dgst.Verifier()
+	return atomicfile.Write(path, func(w io.Writer) error {
+		if _, err := io.Copy(io.MultiWriter(w, verifier), r); err != nil {
+			return err
+		}
+		if !verifier.Verified() {
+			return fmt.Errorf("content of blob %s does not match its digest", dgst)
+		}
+		return nil
+	})
+}
+
+// GetManifest returns the content and media type of the manifest with the
+// provided tag or digest. When the manifest is referenced by a digest, the
+// media type is empty unless index.json happens to list the manifest.
+//
+// When the layout has no manifest for a tag, the error wraps fs.ErrNotExist.
+func (l *Layout) GetManifest(reference string) (body []byte, mediaType string, err error) {
+	index, err := l.readIndex()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var desc v1.Descriptor
+	if dgst, err := digest.Parse(reference); err == nil {
+		desc.Digest = dgst
+		for _, m := range index.Manifests {
+			if m.Digest == dgst {
+				desc = m
+				break
+			}
+		}
+	} else {
+		for _, m := range index.Manifests {
+			if m.Annotations[v1.AnnotationRefName] == reference {
+				desc = m
+				break
+			}
+		}
+		if desc.Digest == "" {
+			return nil, "", fmt.Errorf("tag %s in layout %s: %w", reference, l.path, fs.ErrNotExist)
+		}
+	}
+
+	path, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err = os.ReadFile(path)
+	return body, desc.MediaType, err
+}
+
+// PutManifest writes a manifest to the layout as a blob. When tag is not empty,
+// it also points the tag at the manifest in index.json, replacing any previous
+// manifest with that tag.
+func (l *Layout) PutManifest(tag string, body []byte, desc v1.Descriptor) error {
+	if err := l.PutBlob(desc.Digest, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	if tag == "" {
+		return nil
+	}
+
+	l.indexMu.Lock()
+	defer l.indexMu.Unlock()
+
+	index, err := l.readIndex()
+	if err != nil {
+		return err
+	}
+	var manifests []v1.Descriptor
+	for _, m := range index.Manifests {
+		if m.Annotations[v1.AnnotationRefName] != tag {
+			manifests = append(manifests, m)
+		}
+	}
+	manifests = append(manifests, v1.Descriptor{
+		MediaType:   desc.MediaType,
+		Digest:      desc.Digest,
+		Size:        desc.Size,
+		Annotations: map[string]string{v1.AnnotationRefName: tag},
+	})
+	index.Manifests = manifests
+
+	encoded, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(filepath.Join(l.path, indexFile), func(w io.Writer) error {
+		_, err := w.Write(encoded)
+		return err
+	})
+}
+
+// Tags returns the tags of all manifests that the layout's index.json records.
+func (l *Layout) Tags() ([]string, error) {
+	index, err := l.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, m := range index.Manifests {
+		if tag, ok := m.Annotations[v1.AnnotationRefName]; ok {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// readIndex returns the content of index.json, or an empty index if the layout
+// does not exist yet.
+func (l *Layout) readIndex() (v1.Index, error) {
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+	}
+	body, err := os.ReadFile(filepath.Join(l.path, indexFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return v1.Index{}, err
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return v1.Index{}, fmt.Errorf("invalid index in layout %s: %w", l.path, err)
+	}
+	return index, nil
+}
+
+// init creates the layout directory and its oci-layout file if necessary.
+func (l *Layout) init() error {
+	path := filepath.Join(l.path, layoutFile)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(path, func(w io.Writer) error {
+		_, err := w.Write(encoded)
+		return err
+	})
+}
+
+func (l *Layout) blobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.path, blobsDir, dgst.Algorithm().String(), dgst.Encoded()), nil
+}
@@ -1,7 +1,11 @@
 package image
 
 import (
+	// go-digest leaves the registration of hash functions to its users, and
+	// only SHA-256 is registered by default.
+	_ "crypto/sha512"
 	"encoding/json"
+	"slices"
 
 	"github.com/mitchellh/copystructure"
 	"github.com/opencontainers/go-digest"
@@ -29,9 +33,18 @@ var (
 	_ Index = ParsedIndex{}
 )
 
+// RawIndex is an index with the exact encoding in Raw, whose descriptor uses
+// the digest algorithm in Algorithm (or the canonical algorithm if empty).
 type RawIndex struct {
 	ParsedIndex
-	Raw json.RawMessage
+	Raw       json.RawMessage
+	Algorithm digest.Algorithm
+}
+
+// NewRawIndex returns a RawIndex for the standard encoding of i, whose
+// descriptor uses the provided digest algorithm.
+func NewRawIndex(i ParsedIndex, alg digest.Algorithm) RawIndex {
+	return RawIndex{ParsedIndex: i, Raw: i.Encoded(), Algorithm: alg}
 }
 
 func (ri RawIndex) Parsed() ParsedIndex { return ri.ParsedIndex }
@@ -40,9 +53,10 @@ func (ri RawIndex) Encoded() json.RawMessage { return ri.Raw }
 
 func (ri RawIndex) Descriptor() v1.Descriptor {
 	return v1.Descriptor{
-		MediaType: ri.ParsedIndex.MediaType,
-		Digest:    digest.Canonical.FromBytes(ri.Raw),
-		Size:      int64(len(ri.Raw)),
+		MediaType:    ri.ParsedIndex.MediaType,
+		ArtifactType: ri.ParsedIndex.ArtifactType,
+		Digest:       algorithmOrCanonical(ri.Algorithm).FromBytes(ri.Raw),
+		Size:         int64(len(ri.Raw)),
 	}
 }
 
@@ -69,13 +83,11 @@ func (i ParsedIndex) Encoded() json.RawMessage {
 	return content
 }
 
+// Descriptor returns a descriptor for the standard encoding of the index. A
+// ParsedIndex has no requested digest to take an algorithm from, so it uses the
+// canonical algorithm; use NewRawIndex to describe it with another.
 func (i ParsedIndex) Descriptor() v1.Descriptor {
-	body := i.Encoded()
-	return v1.Descriptor{
-		MediaType: i.MediaType,
-		Digest:    digest.Canonical.FromBytes(body),
-		Size:      int64(len(body)),
-	}
+	return NewRawIndex(i, digest.Canonical).Descriptor()
 }
 
 func (i ParsedIndex) Validate() error {
@@ -84,7 +96,7 @@ func (i ParsedIndex) Validate() error {
 			return err
 		}
 	}
-	return nil
+	return validateSubject(i.Subject)
 }
 
 type Manifest interface {
@@ -97,9 +109,18 @@ var (
 	_ Manifest = ParsedManifest{}
 )
 
+// RawManifest is a manifest with the exact encoding in Raw, whose descriptor
+// uses the digest algorithm in Algorithm (or the canonical algorithm if empty).
 type RawManifest struct {
 	ParsedManifest
-	Raw json.RawMessage
+	Raw       json.RawMessage
+	Algorithm digest.Algorithm
+}
+
+// NewRawManifest returns a RawManifest for the standard encoding of m, whose
+// descriptor uses the provided digest algorithm.
+func NewRawManifest(m ParsedManifest, alg digest.Algorithm) RawManifest {
+	return RawManifest{ParsedManifest: m, Raw: m.Encoded(), Algorithm: alg}
 }
 
 func (rm RawManifest) Parsed() ParsedManifest { return rm.ParsedManifest }
@@ -108,9 +129,10 @@ func (rm RawManifest) Encoded() json.RawMessage { return rm.Raw }
 
 func (rm RawManifest) Descriptor() v1.Descriptor {
 	return v1.Descriptor{
-		MediaType: rm.ParsedManifest.MediaType,
-		Digest:    digest.Canonical.FromBytes(rm.Raw),
-		Size:      int64(len(rm.Raw)),
+		MediaType:    rm.ParsedManifest.MediaType,
+		ArtifactType: rm.ParsedManifest.ArtifactType,
+		Digest:       algorithmOrCanonical(rm.Algorithm).FromBytes(rm.Raw),
+		Size:         int64(len(rm.Raw)),
 	}
 }
 
@@ -137,15 +159,16 @@ func (m ParsedManifest) Encoded() json.RawMessage {
 	return content
 }
 
+// Descriptor returns a descriptor for the standard encoding of the manifest. A
+// ParsedManifest has no requested digest to take an algorithm from, so it uses
+// the canonical algorithm; use NewRawManifest to describe it with another.
 func (m ParsedManifest) Descriptor() v1.Descriptor {
-	body := m.Encoded()
-	return v1.Descriptor{
-		MediaType: m.MediaType,
-		Digest:    digest.Canonical.FromBytes(body),
-		Size:      int64(len(body)),
-	}
+	return NewRawManifest(m, digest.Canonical).Descriptor()
 }
 
+// Validate checks the digests of all descriptors in the manifest. It does not
+// restrict the media types of the config or layers, so that it accepts OCI
+// artifacts (such as Helm charts) as well as container images.
 func (m ParsedManifest) Validate() error {
 	if err := m.Config.Digest.Validate(); err != nil {
 		return err
@@ -155,5 +178,27 @@ func (m ParsedManifest) Validate() error {
 			return err
 		}
 	}
-	return nil
+	return validateSubject(m.Subject)
+}
+
+// Blobs returns the descriptors of all blobs that the manifest references,
+// with the config last.
+func (m ParsedManifest) Blobs() []v1.Descriptor {
+	return append(slices.Clip(m.Layers), m.Config)
+}
+
+// validateSubject validates the digest of the optional subject descriptor that
+// links an artifact to another manifest.
+func validateSubject(subject *v1.Descriptor) error {
+	if subject == nil {
+		return nil
+	}
+	return subject.Digest.Validate()
+}
+
+func algorithmOrCanonical(alg digest.Algorithm) digest.Algorithm {
+	if alg == "" {
+		return digest.Canonical
+	}
+	return alg
 }
@@ -1,6 +1,11 @@
 package image
 
-import v1 "github.com/opencontainers/image-spec/specs-go/v1"
+import (
+	"encoding/json"
+	"mime"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
 
 type MediaType string
 
@@ -10,13 +15,36 @@ const (
 
 	OCIManifestMediaType    = MediaType(v1.MediaTypeImageManifest)
 	DockerManifestMediaType = MediaType("application/vnd.docker.distribution.manifest.v2+json")
+
+	DockerSchema1MediaType       = MediaType("application/vnd.docker.distribution.manifest.v1+json")
+	DockerSchema1SignedMediaType = MediaType("application/vnd.docker.distribution.manifest.v1+prettyjws")
+
+	DockerConfigMediaType    = MediaType("application/vnd.docker.container.image.v1+json")
+	DockerLayerMediaType     = MediaType("application/vnd.docker.image.rootfs.diff.tar")
+	DockerLayerGzipMediaType = MediaType("application/vnd.docker.image.rootfs.diff.tar.gzip")
+
+	DockerForeignLayerMediaType = MediaType("application/vnd.docker.image.rootfs.foreign.diff.tar.gzip")
 )
 
+// foreignLayerTypes maps the media types of foreign (non-distributable) layers
+// to the equivalent types for regular layers.
+var foreignLayerTypes = map[MediaType]MediaType{
+	DockerForeignLayerMediaType:                           DockerLayerGzipMediaType,
+	MediaType(v1.MediaTypeImageLayerNonDistributable):     MediaType(v1.MediaTypeImageLayer),
+	MediaType(v1.MediaTypeImageLayerNonDistributableGzip): MediaType(v1.MediaTypeImageLayerGzip),
+	MediaType(v1.MediaTypeImageLayerNonDistributableZstd): MediaType(v1.MediaTypeImageLayerZstd),
+}
+
+// AllManifestMediaTypes lists the media types that we accept from registries,
+// in order of preference. Legacy schema1 types come last, so that registries
+// only serve them for images that have no other representation.
 var AllManifestMediaTypes = []string{
 	string(OCIIndexMediaType),
 	string(DockerIndexMediaType),
 	string(OCIManifestMediaType),
 	string(DockerManifestMediaType),
+	string(DockerSchema1SignedMediaType),
+	string(DockerSchema1MediaType),
 }
 
 func (mt MediaType) IsIndex() bool {
@@ -26,3 +54,54 @@ func (mt MediaType) IsIndex() bool {
 func (mt MediaType) IsManifest() bool {
 	return mt == OCIManifestMediaType || mt == DockerManifestMediaType
 }
+
+func (mt MediaType) IsSchema1() bool {
+	return mt == DockerSchema1MediaType || mt == DockerSchema1SignedMediaType
+}
+
+// IsForeignLayer returns true if mt is the type of a foreign layer, which
+// registries are not expected to store, and which images instead reference by
+// a list of URLs.
+func (mt MediaType) IsForeignLayer() bool {
+	_, ok := foreignLayerTypes[mt]
+	return ok
+}
+
+// DistributableLayer returns the type of a regular layer with the same format
+// as the foreign layer type mt, or mt itself if it is not a foreign layer type.
+func (mt MediaType) DistributableLayer() MediaType {
+	if distributable, ok := foreignLayerTypes[mt]; ok {
+		return distributable
+	}
+	return mt
+}
+
+// DetectManifestMediaType determines the media type of a manifest from the
+// Content-Type of the response that served it, ignoring any parameters. If the
+// Content-Type is not a known manifest type, as when registries serve artifacts
+// with a generic type, DetectManifestMediaType falls back to the mediaType and
+// schemaVersion fields of the manifest body.
+func DetectManifestMediaType(contentType string, body []byte) MediaType {
+	if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+		mt := MediaType(parsed)
+		if mt.IsIndex() || mt.IsManifest() || mt.IsSchema1() {
+			return mt
+		}
+	}
+	var fields struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     MediaType       `json:"mediaType"`
+		Signatures    json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal(body, &fields); err == nil {
+		switch {
+		case fields.MediaType != "":
+			return fields.MediaType
+		case fields.SchemaVersion == 1 && fields.Signatures != nil:
+			return DockerSchema1SignedMediaType
+		case fields.SchemaVersion == 1:
+			return DockerSchema1MediaType
+		}
+	}
+	return MediaType(contentType)
+}
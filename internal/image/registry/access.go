@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+// CheckAccess obtains credentials for repo, then makes a request that requires
+// them without changing the repository's content, to find out whether the
+// client may pull from (or, if push is true, push to) repo. Obtaining
+// credentials alone proves nothing, since token services may issue tokens
+// without the requested scope, and clients for registries with endpoints don't
+// contact anything until their first request.
+//
+// Pull checks list a single tag, and fail only if the registry refuses the
+// request, since a source repository that doesn't exist (or a registry that
+// can't list tags) is not an access problem. Push checks start a blob upload
+// and then cancel it.
+func CheckAccess(repo image.Repository, push bool) error {
+	if !push {
+		client, err := GetClient(repo, PullScope)
+		if err != nil {
+			return err
+		}
+		u := APIURL(repo.Registry, fmt.Sprintf("/v2/%s/tags/list", repo.Namespace))
+		u.RawQuery = "n=1"
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		_, err = client.DoExpectingNoBody(req, http.StatusOK)
+		var regErr *Error
+		if errors.As(err, &regErr) && regErr.StatusCode != http.StatusUnauthorized && regErr.StatusCode != http.StatusForbidden {
+			return nil
+		}
+		return err
+	}
+
+	client, err := GetClient(repo, PushScope)
+	if err != nil {
+		return err
+	}
+	u := APIURL(repo.Registry, fmt.Sprintf("/v2/%s/blobs/uploads/", repo.Namespace))
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.DoExpectingNoBody(req, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+
+	// Registries expire abandoned uploads on their own, so failing to cancel
+	// this one is harmless.
+	if location, err := ResolveLocation(repo.Registry, u, resp.Header.Get("Location")); err == nil {
+		CancelUpload(client, location)
+	}
+	return nil
+}
+
+// CancelUpload makes a best-effort attempt to cancel the blob upload session
+// at location, ignoring any errors.
+func CancelUpload(client Client, location *url.URL) {
+	req, err := http.NewRequest(http.MethodDelete, location.String(), nil)
+	if err == nil {
+		client.DoExpectingNoBody(req, http.StatusNoContent, http.StatusAccepted, http.StatusOK)
+	}
+}
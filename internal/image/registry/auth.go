@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// tokenTransport authenticates requests to a registry with a single
+// Authorization header shared by all requests, so that any number of requests
+// can proceed in parallel. When the registry rejects a request's credentials,
+// tokenTransport obtains a new header (exchanging credentials for a new bearer
+// token if the registry requires it) and retries the request once. Requests
+// that fail with the same header wait for a single refresh rather than each
+// starting their own.
+type tokenTransport struct {
+	inner    http.RoundTripper
+	registry name.Registry
+	hosts    []string
+	scheme   string
+	scopes   []string
+
+	// auth and challenge are owned by the refresh in progress, if any.
+	auth      authn.Authenticator
+	challenge *transport.Challenge
+
+	mu      sync.Mutex
+	header  string
+	refresh *tokenRefresh
+}
+
+// tokenRefresh is an attempt to obtain a new Authorization header that other
+// requests may wait on.
+type tokenRefresh struct {
+	done   chan struct{}
+	header string
+	err    error
+}
+
+// newTokenTransport returns a tokenTransport for requests with the provided
+// scopes to reg, which may be known by an alias like "docker.io" in addition to
+// its canonical name. It contacts reg to learn how to authenticate, and obtains
+// an initial token when necessary.
+func newTokenTransport(ctx context.Context, reg name.Registry, alias string, auth authn.Authenticator, inner http.RoundTripper, scopes []string) (*tokenTransport, error) {
+	challenge, err := transport.Ping(ctx, reg, inner)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tokenTransport{
+		inner:     inner,
+		registry:  reg,
+		hosts:     []string{reg.RegistryStr(), alias},
+		scheme:    "https",
+		scopes:    scopes,
+		auth:      auth,
+		challenge: challenge,
+	}
+	if challenge.Insecure {
+		t.scheme = "http"
+	}
+	if challenge.Scheme != "" {
+		if t.header, err = t.fetchHeader(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// http.Client follows redirects above the RoundTripper, so requests to
+	// other hosts (like blob storage) must not carry the registry's credentials.
+	if !t.matchesHost(req) {
+		return t.inner.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	header := t.header
+	t.mu.Unlock()
+
+	resp, err := t.send(req, header, false)
+	canReplay := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !canReplay {
+		return resp, err
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	header, err = t.refreshAfter(req.Context(), header)
+	if err != nil {
+		return nil, fmt.Errorf("authenticating to %s: %w", t.registry, err)
+	}
+	return t.send(req, header, true)
+}
+
+func (t *tokenTransport) matchesHost(req *http.Request) bool {
+	for _, host := range t.hosts {
+		if req.URL.Host == host || req.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a copy of req with the provided Authorization header, replaying
+// the body of req if it was already sent once.
+func (t *tokenTransport) send(req *http.Request, header string, replay bool) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	if replay && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	out.URL.Scheme = t.scheme
+	if header != "" {
+		out.Header.Set("Authorization", header)
+	}
+	return t.inner.RoundTrip(out)
+}
+
+// refreshAfter returns a new Authorization header to replace stale, which the
+// registry rejected. If another request has already replaced stale, or is in
+// the process of replacing it, refreshAfter returns that request's result.
+func (t *tokenTransport) refreshAfter(ctx context.Context, stale string) (string, error) {
+	t.mu.Lock()
+	if t.header != stale {
+		header := t.header
+		t.mu.Unlock()
+		return header, nil
+	}
+	if refresh := t.refresh; refresh != nil {
+		t.mu.Unlock()
+		select {
+		case <-refresh.done:
+			return refresh.header, refresh.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	refresh := &tokenRefresh{done: make(chan struct{})}
+	t.refresh = refresh
+	t.mu.Unlock()
+
+	// Other requests share the result, so the refresh must outlive this one.
+	refresh.header, refresh.err = t.fetchHeader(context.WithoutCancel(ctx))
+
+	t.mu.Lock()
+	if refresh.err == nil {
+		t.header = refresh.header
+	}
+	t.refresh = nil
+	t.mu.Unlock()
+	close(refresh.done)
+	return refresh.header, refresh.err
+}
+
+// fetchHeader obtains a new Authorization header for the registry, following
+// the conventions of go-containerregistry: registry tokens are sent directly,
+// bearer challenges exchange credentials for a token, and basic challenges send
+// credentials directly.
+func (t *tokenTransport) fetchHeader(ctx context.Context) (string, error) {
+	if t.challenge.Scheme == "" {
+		// The registry didn't require authentication when we first contacted it,
+		// so we need to find out how it wants us to authenticate now.
+		challenge, err := transport.Ping(ctx, t.registry, t.inner)
+		if err != nil {
+			return "", err
+		}
+		t.challenge = challenge
+	}
+
+	cfg, err := authn.Authorization(ctx, t.auth)
+	if err != nil {
+		return "", err
+	}
+	if cfg.RegistryToken != "" {
+		return "Bearer " + cfg.RegistryToken, nil
+	}
+
+	if !strings.EqualFold(t.challenge.Scheme, "bearer") {
+		switch {
+		case cfg.Username != "" && cfg.Password != "":
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password)), nil
+		case cfg.Auth != "":
+			return "Basic " + cfg.Auth, nil
+		default:
+			return "", nil
+		}
+	}
+
+	token, err := transport.Exchange(ctx, t.registry, t.auth, t.inner, t.scopes, t.challenge)
+	if err != nil {
+		return "", err
+	}
+	if token.RefreshToken != "" {
+		// Later refreshes can use the OAuth refresh token in place of the
+		// original credentials.
+		t.auth = authn.FromConfig(authn.AuthConfig{IdentityToken: token.RefreshToken})
+	}
+	if token.AccessToken != "" {
+		// Some registries set access_token instead of token.
+		return "Bearer " + token.AccessToken, nil
+	}
+	return "Bearer " + token.Token, nil
+}
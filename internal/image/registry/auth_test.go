@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+// tokenRegistry is a fake registry that requires bearer tokens from its own
+// token endpoint, and only accepts the token it issued most recently.
+type tokenRegistry struct {
+	*httptest.Server
+	delay time.Duration
+
+	mu          sync.Mutex
+	issued      int
+	current     string
+	scopes      []string
+	inFlight    int
+	maxInFlight int
+}
+
+func newTokenRegistry(delay time.Duration) *tokenRegistry {
+	r := &tokenRegistry{delay: delay}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+func (r *tokenRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.mu.Lock()
+		r.issued++
+		r.current = fmt.Sprintf("token-%d", r.issued)
+		r.scopes = req.URL.Query()["scope"]
+		token := r.current
+		r.mu.Unlock()
+		fmt.Fprintf(w, `{"token": %q}`, token)
+		return
+	}
+
+	r.mu.Lock()
+	authorized := r.current != "" && req.Header.Get("Authorization") == "Bearer "+r.current
+	if authorized {
+		r.inFlight++
+		r.maxInFlight = max(r.maxInFlight, r.inFlight)
+	}
+	r.mu.Unlock()
+	if !authorized {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+	io.WriteString(w, "ok")
+}
+
+// revoke invalidates the current token, as if it expired.
+func (r *tokenRegistry) revoke() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = ""
+}
+
+func (r *tokenRegistry) newTransport(t testing.TB) *tokenTransport {
+	host := strings.TrimPrefix(r.URL, "http://")
+	reg, err := name.NewRegistry(host)
+	require.NoError(t, err)
+	rt, err := newTokenTransport(context.Background(), reg, host, authn.Anonymous, http.DefaultTransport, []string{"repository:app:pull"})
+	require.NoError(t, err)
+	return rt
+}
+
+// getConcurrently performs n concurrent GET requests to a blob through rt.
+func (r *tokenRegistry) getConcurrently(rt http.RoundTripper, n int) error {
+	client := Client{http.Client{Transport: rt}}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, r.URL+"/v2/app/blobs/sha256:abc", nil)
+			if err == nil {
+				_, err = client.DoExpectingNoBody(req, http.StatusOK)
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTokenTransportConcurrency(t *testing.T) {
+	registry := newTokenRegistry(20 * time.Millisecond)
+	defer registry.Close()
+
+	rt := registry.newTransport(t)
+	require.Equal(t, 1, registry.issued, "no initial token")
+
+	require.NoError(t, registry.getConcurrently(rt, 10))
+	assert.Equal(t, 1, registry.issued, "token was refreshed unnecessarily")
+	assert.Greater(t, registry.maxInFlight, 1, "requests did not run in parallel")
+
+	registry.revoke()
+	require.NoError(t, registry.getConcurrently(rt, 10))
+	assert.Equal(t, 2, registry.issued, "concurrent requests did not share a single refresh")
+}
+
+func BenchmarkTokenTransport(b *testing.B) {
+	registry := newTokenRegistry(time.Millisecond)
+	defer registry.Close()
+
+	transports := map[string]http.RoundTripper{
+		"Serialized":  &serializedTransport{RoundTripper: registry.newTransport(b)},
+		"SharedToken": registry.newTransport(b),
+	}
+	for _, name := range []string{"Serialized", "SharedToken"} {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				if err := registry.getConcurrently(transports[name], 10); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// serializedTransport performs one request at a time, like the per-client
+// lock that preceded tokenTransport.
+type serializedTransport struct {
+	http.RoundTripper
+	mu sync.Mutex
+}
+
+func (t *serializedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestMountClientScopes(t *testing.T) {
+	registry := newTokenRegistry(0)
+	defer registry.Close()
+	t.Cleanup(func() { clients = make(map[clientKey]Client) })
+
+	reg := image.Registry(strings.TrimPrefix(registry.URL, "http://"))
+	dst := image.Repository{Registry: reg, Namespace: "dst"}
+	src := image.Repository{Registry: reg, Namespace: "src"}
+	client, err := GetMountClient(dst, src)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"repository:dst:push,pull", "repository:src:pull"}, registry.scopes)
+
+	again, err := GetMountClient(dst, src)
+	require.NoError(t, err)
+	assert.Same(t, client.Transport, again.Transport, "mount client was not cached")
+	pushOnly, err := GetClient(dst, PushScope)
+	require.NoError(t, err)
+	assert.NotSame(t, client.Transport, pushOnly.Transport, "mount client shared with push-only client")
+
+	_, err = GetMountClient(dst, image.Repository{Registry: "other.example", Namespace: "src"})
+	assert.Error(t, err, "mount client allowed across registries")
+}
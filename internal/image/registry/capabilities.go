@@ -0,0 +1,305 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+// Capability is an optional part of the registry API.
+type Capability string
+
+const (
+	// MountCapability is support for cross-repository blob mounts. Probing
+	// mounts would require writing to the registry, so support is instead
+	// learned from the results of mount attempts reported to [ObserveMount],
+	// and it is not among [AllCapabilities].
+	MountCapability Capability = "mounts"
+
+	// ChunkedUploadCapability is support for uploading blobs in multiple PATCH
+	// requests. Probing it starts an upload that the probe then cancels.
+	ChunkedUploadCapability Capability = "chunked-uploads"
+
+	// ReferrersCapability is support for the referrers API.
+	ReferrersCapability Capability = "referrers"
+
+	// TagListCapability is support for listing the tags in a repository.
+	TagListCapability Capability = "tag-list"
+
+	// CatalogCapability is support for listing the repositories in a registry.
+	CatalogCapability Capability = "catalog"
+
+	// DeleteCapability is support for deleting manifests. Probing it deletes a
+	// manifest that does not exist.
+	DeleteCapability Capability = "deletes"
+)
+
+// AllCapabilities lists every [Capability] that can be probed without
+// copying anything, in a stable order.
+var AllCapabilities = []Capability{
+	ChunkedUploadCapability,
+	ReferrersCapability,
+	TagListCapability,
+	CatalogCapability,
+	DeleteCapability,
+}
+
+// PushCapabilities lists the capabilities whose probes require push access.
+var PushCapabilities = []Capability{ChunkedUploadCapability, DeleteCapability}
+
+// Support is the result of probing a [Capability].
+type Support int
+
+const (
+	// SupportUnknown means that a probe could not determine whether the
+	// registry supports a capability.
+	SupportUnknown Support = iota
+	// Supported means that the registry supports a capability.
+	Supported
+	// Unsupported means that the registry does not support a capability.
+	Unsupported
+	// Denied means that the registry refused to let the client use a
+	// capability, whether or not it supports it.
+	Denied
+)
+
+func (s Support) String() string {
+	switch s {
+	case Supported:
+		return "yes"
+	case Unsupported:
+		return "no"
+	case Denied:
+		return "denied"
+	default:
+		return "unknown"
+	}
+}
+
+// mountDeclineLimit is the number of declined mounts, without any successful
+// ones, after which a registry is assumed not to support mounts.
+const mountDeclineLimit = 3
+
+type capabilityKey struct {
+	registry   image.Registry
+	capability Capability
+}
+
+type capabilityProbe struct {
+	once    sync.Once
+	support Support
+	err     error
+}
+
+type mountObservations struct {
+	mounted, declined int
+}
+
+var (
+	probes   = make(map[capabilityKey]*capabilityProbe)
+	mounts   = make(map[image.Registry]mountObservations)
+	probesMu sync.Mutex
+)
+
+// Probe returns whether the registry containing repo supports capability, by
+// probing the registry through repo with requests that do not change its
+// content. Once a probe finds that the registry does or does not support the
+// capability, later calls for the same registry return that result without
+// probing again. Other results may depend on repo (for instance, whether it
+// exists, or whether the client may access it), so they are never cached.
+// Probes of [PushCapabilities] require push access to repo.
+func Probe(repo image.Repository, capability Capability) (Support, error) {
+	if capability == MountCapability {
+		return mountSupport(repo.Registry), nil
+	}
+
+	key := capabilityKey{repo.Registry, capability}
+	probesMu.Lock()
+	probe, ok := probes[key]
+	if !ok {
+		probe = &capabilityProbe{}
+		probes[key] = probe
+	}
+	probesMu.Unlock()
+
+	probe.once.Do(func() {
+		probe.support, probe.err = probeCapability(repo, capability)
+	})
+	if probe.support != Supported && probe.support != Unsupported {
+		probesMu.Lock()
+		if probes[key] == probe {
+			delete(probes, key)
+		}
+		probesMu.Unlock()
+	}
+	return probe.support, probe.err
+}
+
+// ObserveMount records the result of a mount attempt in reg, which determines
+// its support for [MountCapability]. A registry supports mounts once any mount
+// succeeds, and is assumed not to support them after several mounts are
+// declined without any succeeding.
+func ObserveMount(reg image.Registry, mounted bool) {
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	obs := mounts[reg]
+	if mounted {
+		obs.mounted++
+	} else {
+		obs.declined++
+	}
+	mounts[reg] = obs
+}
+
+func mountSupport(reg image.Registry) Support {
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	switch obs := mounts[reg]; {
+	case obs.mounted > 0:
+		return Supported
+	case obs.declined >= mountDeclineLimit:
+		return Unsupported
+	default:
+		return SupportUnknown
+	}
+}
+
+// probeDigest is a digest that no real content will have, for probes that
+// must name some blob or manifest.
+var probeDigest = digest.FromString("magic-mirror capability probe")
+
+func probeCapability(repo image.Repository, capability Capability) (Support, error) {
+	scope := PullScope
+	if slices.Contains(PushCapabilities, capability) {
+		scope = PushScope
+	}
+	client, err := GetClient(repo, scope)
+	if err != nil {
+		return SupportUnknown, err
+	}
+
+	switch capability {
+	case ReferrersCapability:
+		u := APIURL(repo.Registry, fmt.Sprintf("/v2/%s/referrers/%s", repo.Namespace, probeDigest))
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return SupportUnknown, err
+		}
+		req.Header.Add("Accept", v1.MediaTypeImageIndex)
+		return classify(client.DoExpectingNoBody(req, http.StatusOK))
+
+	case TagListCapability:
+		u := APIURL(repo.Registry, fmt.Sprintf("/v2/%s/tags/list", repo.Namespace))
+		u.RawQuery = "n=1"
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return SupportUnknown, err
+		}
+		resp, err := client.DoExpectingNoBody(req, http.StatusOK)
+		if hasErrorCode(err, transport.NameUnknownErrorCode) {
+			// The repository doesn't exist yet, but the API does.
+			return Supported, nil
+		}
+		return classify(resp, err)
+
+	case CatalogCapability:
+		u := APIURL(repo.Registry, "/v2/_catalog")
+		u.RawQuery = "n=1"
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return SupportUnknown, err
+		}
+		return classify(client.DoExpectingNoBody(req, http.StatusOK))
+
+	case DeleteCapability:
+		u := APIURL(repo.Registry, fmt.Sprintf("/v2/%s/manifests/%s", repo.Namespace, probeDigest))
+		req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+		if err != nil {
+			return SupportUnknown, err
+		}
+		resp, err := client.DoExpectingNoBody(req, http.StatusAccepted)
+		if hasErrorCode(err, transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode) {
+			return Supported, nil
+		}
+		return classify(resp, err)
+
+	case ChunkedUploadCapability:
+		return probeChunkedUpload(client, repo)
+
+	default:
+		return SupportUnknown, fmt.Errorf("unknown capability %q", capability)
+	}
+}
+
+// probeChunkedUpload starts a blob upload, sends it an empty chunk, and then
+// cancels it.
+func probeChunkedUpload(client Client, repo image.Repository) (Support, error) {
+	u := APIURL(repo.Registry, fmt.Sprintf("/v2/%s/blobs/uploads/", repo.Namespace))
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return SupportUnknown, err
+	}
+	resp, err := client.DoExpectingNoBody(req, http.StatusAccepted)
+	if err != nil {
+		return classify(resp, err)
+	}
+	location, err := ResolveLocation(repo.Registry, u, resp.Header.Get("Location"))
+	if err != nil {
+		return SupportUnknown, err
+	}
+	defer CancelUpload(client, location)
+
+	req, err = http.NewRequest(http.MethodPatch, location.String(), http.NoBody)
+	if err != nil {
+		return SupportUnknown, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return classify(client.DoExpectingNoBody(req, http.StatusAccepted, http.StatusNoContent))
+}
+
+// classify interprets the result of a probe request, whose expected status
+// codes indicate support.
+func classify(_ *http.Response, err error) (Support, error) {
+	if err == nil {
+		return Supported, nil
+	}
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return SupportUnknown, err
+	}
+	if hasErrorCode(err, transport.NameUnknownErrorCode) {
+		// The probed repository doesn't exist, which says nothing about the
+		// registry's support for the capability.
+		return SupportUnknown, nil
+	}
+	switch terr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return Denied, nil
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusRequestedRangeNotSatisfiable, http.StatusNotImplemented:
+		return Unsupported, nil
+	default:
+		return SupportUnknown, err
+	}
+}
+
+func hasErrorCode(err error, codes ...transport.ErrorCode) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	for _, diag := range terr.Errors {
+		if slices.Contains(codes, diag.Code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+func TestProbe(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(r.URL.Path, "/v2/missing/"):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": [{"code": "NAME_UNKNOWN", "message": "repository name not known to registry"}]}`))
+		case strings.Contains(r.URL.Path, "/referrers/"):
+			w.Write([]byte(`{"schemaVersion": 2, "manifests": []}`))
+		case strings.HasSuffix(r.URL.Path, "/tags/list"):
+			w.Write([]byte(`{"name": "app", "tags": ["latest"]}`))
+		case r.URL.Path == "/v2/_catalog":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodDelete && strings.Contains(r.URL.Path, "/manifests/"):
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+			w.Header().Set("Location", "/v2/app/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPatch:
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	t.Cleanup(func() {
+		probes = make(map[capabilityKey]*capabilityProbe)
+		mounts = make(map[image.Registry]mountObservations)
+		clients = make(map[clientKey]Client)
+	})
+
+	reg := image.Registry(strings.TrimPrefix(server.URL, "http://"))
+	repo := image.Repository{Registry: reg, Namespace: "app"}
+
+	// A repository that doesn't exist can't show whether the registry supports
+	// referrers, and must not decide the result for other repositories.
+	missing := image.Repository{Registry: reg, Namespace: "missing"}
+	support, err := Probe(missing, ReferrersCapability)
+	require.NoError(t, err)
+	assert.Equal(t, SupportUnknown, support, "missing repository decided referrers support")
+
+	want := map[Capability]Support{
+		ReferrersCapability:     Supported,
+		TagListCapability:       Supported,
+		CatalogCapability:       Denied,
+		DeleteCapability:        Unsupported,
+		ChunkedUploadCapability: Supported,
+		MountCapability:         SupportUnknown,
+	}
+	for capability, support := range want {
+		got, err := Probe(repo, capability)
+		require.NoError(t, err, capability)
+		assert.Equal(t, support, got, capability)
+	}
+
+	before := requests.Load()
+	for capability, support := range want {
+		if support == Supported || support == Unsupported {
+			Probe(repo, capability)
+		}
+	}
+	assert.Equal(t, before, requests.Load(), "probe results were not cached")
+	Probe(repo, CatalogCapability)
+	assert.Greater(t, requests.Load(), before, "denied probe result was cached")
+
+	for range mountDeclineLimit {
+		ObserveMount(reg, false)
+	}
+	support, _ = Probe(repo, MountCapability)
+	assert.Equal(t, Unsupported, support, "repeated declines did not rule out mounts")
+	ObserveMount(reg, true)
+	support, _ = Probe(repo, MountCapability)
+	assert.Equal(t, Supported, support, "successful mount did not establish support")
+}
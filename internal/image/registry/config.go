@@ -0,0 +1,277 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+// registriesFile is the JSON form of a registries config, which describes how
+// to reach each logical registry named in image references:
+//
+//	{"registries": {
+//	  "docker.io": {"endpoints": ["mirror.internal:5000", "docker.io"]},
+//	  "mirror.internal:5000": {"tls": {"caFile": "corp-ca.pem"}},
+//	  "artifacts.corp": {"pathPrefix": "/artifactory/api/docker/repo"}
+//	}}
+//
+// Relative file paths are resolved against the directory containing the
+// registries config.
+type registriesFile struct {
+	Registries map[image.Registry]registryConfig `json:"registries"`
+}
+
+// registryConfig describes how to reach a single logical registry.
+//
+// Endpoints lists the hosts (with optional ports) that serve pulls from the
+// registry, in order of preference. A pull moves on to the next endpoint when
+// an endpoint can't be reached or responds with an error, and the last
+// endpoint's response is final. The logical registry itself is only contacted
+// for pulls when it appears in the list. Pushes always go to the logical
+// registry. Each endpoint takes its own TLS settings from its own entry.
+//
+// PlainHTTP contacts the registry over unencrypted HTTP, which is otherwise
+// only used for local addresses like "localhost".
+//
+// PathPrefix is the path under which the registry serves its API, for
+// registries that serve the API at "<host>/<prefix>/v2/" rather than
+// "<host>/v2/".
+type registryConfig struct {
+	Endpoints  []image.Registry `json:"endpoints,omitempty"`
+	PlainHTTP  bool             `json:"plainHTTP,omitempty"`
+	PathPrefix string           `json:"pathPrefix,omitempty"`
+	TLS        *tlsFile         `json:"tls,omitempty"`
+
+	tlsConfig *tls.Config
+}
+
+// tlsFile is the JSON form of the TLS settings for a registry.
+type tlsFile struct {
+	// CAFile holds PEM certificates to trust in addition to the system's roots.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile hold a PEM client certificate and private key.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// InsecureSkipVerify disables verification of the registry's certificate.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+var (
+	registries     map[image.Registry]registryConfig
+	baseTransports map[image.Registry]http.RoundTripper
+	registriesMu   sync.Mutex
+)
+
+// ConfigureRegistries loads the registries config in the file at path, which
+// applies to all clients created afterward.
+func ConfigureRegistries(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file registriesFile
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("invalid registries config %s: %w", path, err)
+	}
+
+	var errs []error
+	for reg, config := range file.Registries {
+		if _, err := name.NewRegistry(string(reg), name.StrictValidation); err != nil {
+			errs = append(errs, fmt.Errorf("registry %q: %w", reg, err))
+		}
+		for _, endpoint := range config.Endpoints {
+			if _, err := name.NewRegistry(string(endpoint), name.StrictValidation); err != nil {
+				errs = append(errs, fmt.Errorf("registry %q: endpoint %q: %w", reg, endpoint, err))
+			}
+		}
+		if config.PathPrefix != "" {
+			config.PathPrefix, err = cleanPathPrefix(config.PathPrefix)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("registry %q: %w", reg, err))
+			}
+		}
+		if config.TLS != nil {
+			config.tlsConfig, err = config.TLS.load(filepath.Dir(path))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("registry %q: %w", reg, err))
+			}
+		}
+		file.Registries[reg] = config
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid registries config %s: %w", path, err)
+	}
+
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+	registries = file.Registries
+	baseTransports = nil
+	return nil
+}
+
+// cleanPathPrefix returns the canonical form of an API path prefix, which
+// starts with a slash and does not end with one (so that the root path becomes
+// the empty prefix).
+func cleanPathPrefix(prefix string) (string, error) {
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#") {
+		return "", fmt.Errorf("path prefix %q must be an absolute path without a query or fragment", prefix)
+	}
+	prefix = strings.TrimSuffix(path.Clean(prefix), "/")
+	if prefix == "/v2" || strings.HasSuffix(prefix, "/v2") {
+		return "", fmt.Errorf("path prefix %q must not include the /v2 API root", prefix)
+	}
+	return prefix, nil
+}
+
+func (f *tlsFile) load(dir string) (*tls.Config, error) {
+	resolve := func(path string) string {
+		if path != "" && !filepath.IsAbs(path) {
+			return filepath.Join(dir, path)
+		}
+		return path
+	}
+
+	config := &tls.Config{InsecureSkipVerify: f.InsecureSkipVerify}
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(resolve(f.CAFile))
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", f.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return nil, errors.New("certFile and keyFile must be set together")
+	}
+	if f.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(resolve(f.CertFile), resolve(f.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// getRegistryConfig returns the configuration for the logical registry reg.
+func getRegistryConfig(reg image.Registry) registryConfig {
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+	return registries[reg]
+}
+
+// APIBaseURL returns the base URL for API requests to reg, taking the
+// registries config into account. Its path is the registry's path prefix, if
+// any, without a trailing slash.
+func APIBaseURL(reg image.Registry) *url.URL {
+	u := reg.APIBaseURL()
+	config := getRegistryConfig(reg)
+	if config.PlainHTTP {
+		u.Scheme = "http"
+	}
+	u.Path = config.PathPrefix
+	return u
+}
+
+// APIURL returns the URL for the API path apiPath in reg, which starts with
+// "/v2/", under the registry's path prefix.
+func APIURL(reg image.Registry, apiPath string) *url.URL {
+	u := APIBaseURL(reg)
+	u.Path += apiPath
+	return u
+}
+
+// ResolveLocation resolves location, a URL that reg returned in a Location or
+// Link header in response to a request to base, against base. Registries
+// behind proxies that add their path prefix sometimes return paths without it,
+// so an absolute path to the API root on the registry's own host gains the
+// prefix if it lacks one.
+func ResolveLocation(reg image.Registry, base *url.URL, location string) (*url.URL, error) {
+	u, err := base.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	prefix := getRegistryConfig(reg).PathPrefix
+	if prefix != "" && u.Host == base.Host && strings.HasPrefix(u.Path, "/v2/") {
+		u.Path = prefix + u.Path
+		u.RawPath = ""
+	}
+	return u, nil
+}
+
+// nameOptions returns the options for parsing names in reg with
+// go-containerregistry, so that it reaches reg the same way as APIBaseURL.
+func nameOptions(reg image.Registry) []name.Option {
+	if getRegistryConfig(reg).PlainHTTP {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+// baseTransport returns the unauthenticated transport for connections to reg,
+// which shares connections with all other clients for reg.
+func baseTransport(reg image.Registry) http.RoundTripper {
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+
+	config := registries[reg]
+	if config.tlsConfig == nil && config.PathPrefix == "" {
+		return http.DefaultTransport
+	}
+	if rt, ok := baseTransports[reg]; ok {
+		return rt
+	}
+	rt := http.DefaultTransport
+	if config.tlsConfig != nil {
+		tlsTransport := http.DefaultTransport.(*http.Transport).Clone()
+		tlsTransport.TLSClientConfig = config.tlsConfig.Clone()
+		rt = tlsTransport
+	}
+	if config.PathPrefix != "" {
+		rt = &pingTransport{inner: rt, prefix: config.PathPrefix}
+	}
+	if baseTransports == nil {
+		baseTransports = make(map[image.Registry]http.RoundTripper)
+	}
+	baseTransports[reg] = rt
+	return rt
+}
+
+// pingTransport moves requests for the API root "/v2/", which
+// go-containerregistry makes to learn how to authenticate to a registry, under
+// the registry's path prefix.
+type pingTransport struct {
+	inner  http.RoundTripper
+	prefix string
+}
+
+func (t *pingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/v2/" {
+		req = req.Clone(req.Context())
+		req.URL.Path = t.prefix + "/v2/"
+		req.URL.RawPath = ""
+	}
+	return t.inner.RoundTrip(req)
+}
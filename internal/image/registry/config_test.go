@@ -0,0 +1,61 @@
+package registry
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+func TestRegistryTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	serverHost := image.Registry(strings.TrimPrefix(server.URL, "https://"))
+
+	dir := t.TempDir()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), caPEM, 0o644))
+	path := filepath.Join(dir, "registries.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"registries": {
+		"`+string(serverHost)+`": {"tls": {"caFile": "ca.pem"}},
+		"lab.example": {"plainHTTP": true}
+	}}`), 0o644))
+	require.NoError(t, ConfigureRegistries(path))
+	t.Cleanup(func() { registries, baseTransports = nil, nil })
+
+	client := http.Client{Transport: baseTransport(serverHost)}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err, "custom CA was not trusted")
+	resp.Body.Close()
+
+	client = http.Client{Transport: baseTransport("other.example")}
+	_, err = client.Get(server.URL)
+	assert.Error(t, err, "custom CA was trusted for another registry")
+
+	assert.Equal(t, "http", APIBaseURL("lab.example").Scheme)
+	assert.Equal(t, "https", APIBaseURL("other.example").Scheme)
+}
+
+func TestConfigureRegistriesInvalid(t *testing.T) {
+	testCases := map[string]string{
+		"bad endpoint":    `{"registries": {"docker.io": {"endpoints": ["https://mirror.example"]}}}`,
+		"missing CA":      `{"registries": {"docker.io": {"tls": {"caFile": "missing.pem"}}}}`,
+		"cert only":       `{"registries": {"docker.io": {"tls": {"certFile": "client.pem"}}}}`,
+		"relative prefix": `{"registries": {"artifacts.example": {"pathPrefix": "artifactory/api"}}}`,
+		"prefix with v2":  `{"registries": {"artifacts.example": {"pathPrefix": "/artifactory/api/v2"}}}`,
+		"unknown field":   `{"registries": {"docker.io": {"endpoint": ["mirror.example"]}}}`,
+	}
+	for name, content := range testCases {
+		path := filepath.Join(t.TempDir(), "registries.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		assert.Error(t, ConfigureRegistries(path), name)
+	}
+}
@@ -0,0 +1,221 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+// CredentialsEnv is the environment variable that may hold a credentials
+// config in the same JSON form as a credentials file, for environments like CI
+// jobs that inject secrets through the environment.
+const CredentialsEnv = "MAGIC_MIRROR_CREDENTIALS"
+
+// credentialsFile is the JSON form of a credentials config:
+//
+//	{"credentials": [
+//	  {"scope": "ghcr.io/example", "username": "bot", "password": "..."},
+//	  {"scope": "registry.example.com", "access": "push", "tokenFile": "/run/secrets/token"}
+//	]}
+type credentialsFile struct {
+	Credentials []credentialEntry `json:"credentials"`
+}
+
+// credentialEntry provides one identity for the repositories in a scope. A
+// scope is a registry name, a repository name prefix, or a full repository
+// name, as in "ghcr.io/example". An entry with an access of "pull" or "push"
+// applies only to requests with that scope; otherwise, it applies to both.
+type credentialEntry struct {
+	Scope     string `json:"scope"`
+	Access    string `json:"access,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+
+	scope Scope // derived from Access, or empty to apply to both
+	auth  authn.Authenticator
+}
+
+var (
+	credentials   []credentialEntry
+	credentialsMu sync.Mutex
+)
+
+// ConfigureCredentials loads the credentials config in the file at path (if
+// path is not empty) and in the CredentialsEnv environment variable (if set),
+// which take precedence over credentials from the Docker config for all
+// clients created afterward. An entry in the environment replaces any entry in
+// the file with the same scope and access, so that a job can override a shared
+// file without editing it.
+func ConfigureCredentials(path string) error {
+	var entries []credentialEntry
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		entries, err = parseCredentials(content)
+		if err != nil {
+			return fmt.Errorf("invalid credentials file %s: %w", path, err)
+		}
+	}
+	if env := os.Getenv(CredentialsEnv); env != "" {
+		envEntries, err := parseCredentials([]byte(env))
+		if err != nil {
+			return fmt.Errorf("invalid credentials in $%s: %w", CredentialsEnv, err)
+		}
+		entries = slices.DeleteFunc(entries, func(entry credentialEntry) bool {
+			return slices.ContainsFunc(envEntries, entry.sameKey)
+		})
+		entries = append(entries, envEntries...)
+	}
+
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	credentials = entries
+	return nil
+}
+
+func parseCredentials(content []byte) ([]credentialEntry, error) {
+	var file credentialsFile
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for i := range file.Credentials {
+		entry := &file.Credentials[i]
+		if err := entry.init(); err != nil {
+			errs = append(errs, fmt.Errorf("scope %q: %w", entry.Scope, err))
+		} else if slices.ContainsFunc(file.Credentials[:i], entry.sameKey) {
+			errs = append(errs, fmt.Errorf("duplicate credentials for scope %q (access %q)", entry.Scope, entry.Access))
+		}
+	}
+	return file.Credentials, errors.Join(errs...)
+}
+
+// sameKey returns whether e and other apply to the same scope and access, so
+// that only one of them can ever be used.
+func (e credentialEntry) sameKey(other credentialEntry) bool {
+	return e.Scope == other.Scope && e.scope == other.scope
+}
+
+func (e *credentialEntry) init() error {
+	if e.Scope == "" || strings.HasSuffix(e.Scope, "/") {
+		return errors.New("scope must be a registry or repository name")
+	}
+	switch e.Access {
+	case "":
+	case "pull":
+		e.scope = PullScope
+	case "push":
+		e.scope = PushScope
+	default:
+		return fmt.Errorf(`access must be "pull" or "push", not %q`, e.Access)
+	}
+
+	var kinds int
+	for _, set := range []bool{e.Username != "" || e.Password != "", e.Token != "", e.TokenFile != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("must set exactly one of username and password, token, or tokenFile")
+	}
+
+	switch {
+	case e.TokenFile != "":
+		e.auth = &tokenFileAuthenticator{path: e.TokenFile}
+	case e.Token != "":
+		e.auth = &authn.Bearer{Token: e.Token}
+	default:
+		if e.Username == "" || e.Password == "" {
+			return errors.New("must set both username and password")
+		}
+		e.auth = &authn.Basic{Username: e.Username, Password: e.Password}
+	}
+	return nil
+}
+
+// lookupCredentials returns the authenticator from the configured credentials
+// for requests with the provided scope to repo, if any. The entry with the
+// longest scope containing repo wins, and an entry specific to the requested
+// access wins over one for both kinds of access with the same scope.
+func lookupCredentials(repo image.Repository, scope Scope) (authn.Authenticator, bool) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	var (
+		best      *credentialEntry
+		repoName  = repo.String()
+		bestScore = -1
+	)
+	for i := range credentials {
+		entry := &credentials[i]
+		if entry.scope != "" && entry.scope != scope {
+			continue
+		}
+		if repoName != entry.Scope && !strings.HasPrefix(repoName, entry.Scope+"/") {
+			continue
+		}
+		score := 2 * len(entry.Scope)
+		if entry.scope != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = entry, score
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	return best.auth, true
+}
+
+// tokenFileAuthenticator provides a bearer token from a file, which it reads
+// again whenever the file's modification time or size changes, so that tokens
+// rotated by an external process take effect on the next authentication.
+type tokenFileAuthenticator struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+func (a *tokenFileAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stat, err := os.Stat(a.path)
+	if err != nil {
+		return nil, err
+	}
+	if a.token == "" || !stat.ModTime().Equal(a.modTime) || stat.Size() != a.size {
+		content, err := os.ReadFile(a.path)
+		if err != nil {
+			return nil, err
+		}
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return nil, fmt.Errorf("token file %s is empty", a.path)
+		}
+		a.token, a.modTime, a.size = token, stat.ModTime(), stat.Size()
+	}
+	return &authn.AuthConfig{RegistryToken: a.token}, nil
+}
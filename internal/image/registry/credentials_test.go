@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+func TestLookupCredentials(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"credentials": [
+		{"scope": "ghcr.io", "username": "registry", "password": "secret"},
+		{"scope": "ghcr.io/org", "token": "org"},
+		{"scope": "ghcr.io/org", "access": "push", "token": "org-push"}
+	]}`), 0o600))
+	t.Setenv(CredentialsEnv, `{"credentials": [
+		{"scope": "example.com/app", "access": "pull", "token": "env"},
+		{"scope": "ghcr.io/org", "access": "push", "token": "env-push"}
+	]}`)
+	require.NoError(t, ConfigureCredentials(path))
+	t.Cleanup(func() { credentials = nil })
+
+	testCases := []struct {
+		repo  string
+		scope Scope
+		want  *authn.AuthConfig
+	}{
+		{"ghcr.io/other", PullScope, &authn.AuthConfig{Username: "registry", Password: "secret"}},
+		{"ghcr.io/org/app", PullScope, &authn.AuthConfig{RegistryToken: "org"}},
+		{"ghcr.io/org/app", PushScope, &authn.AuthConfig{RegistryToken: "env-push"}},
+		{"ghcr.io/organization", PushScope, &authn.AuthConfig{Username: "registry", Password: "secret"}},
+		{"example.com/app", PullScope, &authn.AuthConfig{RegistryToken: "env"}},
+		{"example.com/app", PushScope, nil},
+		{"quay.io/org/app", PullScope, nil},
+	}
+	for _, tc := range testCases {
+		img, err := image.Parse(tc.repo)
+		require.NoError(t, err)
+		auth, ok := lookupCredentials(img.Repository, tc.scope)
+		if tc.want == nil {
+			assert.False(t, ok, "unexpected credentials for %s (%s)", tc.repo, tc.scope)
+			continue
+		}
+		require.True(t, ok, "no credentials for %s (%s)", tc.repo, tc.scope)
+		got, err := auth.Authorization()
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got, "wrong credentials for %s (%s)", tc.repo, tc.scope)
+	}
+}
+
+func TestConfigureCredentialsInvalid(t *testing.T) {
+	testCases := map[string]string{
+		"no identity":   `{"credentials": [{"scope": "ghcr.io"}]}`,
+		"two kinds":     `{"credentials": [{"scope": "ghcr.io", "token": "a", "tokenFile": "b"}]}`,
+		"no password":   `{"credentials": [{"scope": "ghcr.io", "username": "a"}]}`,
+		"bad access":    `{"credentials": [{"scope": "ghcr.io", "access": "delete", "token": "a"}]}`,
+		"unknown field": `{"credentials": [{"scope": "ghcr.io", "tokn": "a"}]}`,
+		"duplicate":     `{"credentials": [{"scope": "ghcr.io", "token": "a"}, {"scope": "ghcr.io", "token": "b"}]}`,
+	}
+	for name, content := range testCases {
+		t.Setenv(CredentialsEnv, content)
+		assert.Error(t, ConfigureCredentials(""), name)
+	}
+}
+
+func TestTokenFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+	auth := &tokenFileAuthenticator{path: path}
+
+	cfg, err := auth.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "first", cfg.RegistryToken)
+
+	require.NoError(t, os.WriteFile(path, []byte("second\n"), 0o600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	cfg, err = auth.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "second", cfg.RegistryToken)
+}
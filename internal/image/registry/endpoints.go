@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+	"github.com/ahamlinman/magic-mirror/internal/log"
+)
+
+// endpointTransport routes pull requests addressed to a logical registry to
+// the registry's endpoints in order, moving on from each endpoint that can't
+// be reached or responds with an error.
+//
+// Each endpoint has its own authenticating transport for the same repository
+// namespace, which endpointTransport creates the first time it needs it, since
+// creating a transport contacts the endpoint. Requests addressed to one of the
+// endpoints directly, such as those following absolute Location or Link
+// headers, go straight to that endpoint's transport.
+type endpointTransport struct {
+	logical   image.Registry
+	namespace string
+	scope     Scope
+	endpoints []image.Registry
+
+	mu         sync.Mutex
+	transports map[image.Registry]http.RoundTripper
+}
+
+func newEndpointTransport(repo image.Repository, scope Scope, endpoints []image.Registry) *endpointTransport {
+	return &endpointTransport{
+		logical:    repo.Registry,
+		namespace:  repo.Namespace,
+		scope:      scope,
+		endpoints:  endpoints,
+		transports: make(map[image.Registry]http.RoundTripper),
+	}
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := image.Registry(req.URL.Host)
+	for _, endpoint := range t.endpoints {
+		if host == endpoint && host != t.logical {
+			rt, err := t.endpoint(endpoint)
+			if err != nil {
+				return nil, err
+			}
+			return rt.RoundTrip(req)
+		}
+	}
+	if host != t.logical {
+		// Requests to unrelated hosts, such as redirects to blob storage, pass
+		// through the transport of any endpoint; those transports don't attach
+		// credentials to other hosts.
+		return t.anyEndpoint(req)
+	}
+
+	// Requests with bodies can't be retried on another endpoint unless they
+	// can be replayed.
+	canRetry := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	var errs []error
+	for i, endpoint := range t.endpoints {
+		last := i == len(t.endpoints)-1 || !canRetry
+		resp, err := t.tryEndpoint(req, endpoint)
+		if err == nil && (resp.StatusCode < 400 || last) {
+			return resp, nil
+		}
+		if err != nil && req.Context().Err() != nil {
+			return nil, err
+		}
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			err = errors.New(resp.Status)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", endpoint, err))
+		if last {
+			break
+		}
+		log.Verbosef("[registry]\t%s %s failed at %s (%v), trying %s", req.Method, req.URL.Path, endpoint, err, t.endpoints[i+1])
+	}
+	return nil, fmt.Errorf("no endpoint for %s could serve %s %s: %w", t.logical, req.Method, req.URL.Path, errors.Join(errs...))
+}
+
+// tryEndpoint sends req to endpoint in place of the logical registry.
+func (t *endpointTransport) tryEndpoint(req *http.Request, endpoint image.Registry) (*http.Response, error) {
+	rt, err := t.endpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if endpointReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	base := APIBaseURL(endpoint)
+	endpointReq.URL.Scheme, endpointReq.URL.Host = base.Scheme, base.Host
+	if prefix := APIBaseURL(t.logical).Path; strings.HasPrefix(req.URL.Path, prefix+"/") {
+		// The endpoint may serve the API under a different path prefix.
+		endpointReq.URL.Path = base.Path + strings.TrimPrefix(req.URL.Path, prefix)
+		endpointReq.URL.RawPath = ""
+	}
+	endpointReq.Host = ""
+	return rt.RoundTrip(endpointReq)
+}
+
+// anyEndpoint sends req through the transport of the first endpoint that has
+// or can create one.
+func (t *endpointTransport) anyEndpoint(req *http.Request) (*http.Response, error) {
+	var errs []error
+	for _, endpoint := range t.endpoints {
+		rt, err := t.endpoint(endpoint)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return rt.RoundTrip(req)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// endpoint returns the transport for endpoint, creating it if necessary. A
+// failed attempt to create a transport is retried on the next request.
+func (t *endpointTransport) endpoint(endpoint image.Registry) (http.RoundTripper, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rt, ok := t.transports[endpoint]; ok {
+		return rt, nil
+	}
+	rt, err := getTransport(image.Repository{Registry: endpoint, Namespace: t.namespace}, t.scope, "")
+	if err != nil {
+		return nil, err
+	}
+	t.transports[endpoint] = rt
+	return rt, nil
+}
@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ahamlinman/magic-mirror/internal/image"
+)
+
+func TestEndpointFallback(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	var mirrorHosts []string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorHosts = append(mirrorHosts, r.Host)
+		switch r.URL.Path {
+		case "/v2/":
+		case "/v2/app/manifests/v1":
+			io.WriteString(w, "from mirror")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mirror.Close()
+
+	failingHost := strings.TrimPrefix(failing.URL, "http://")
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+	path := filepath.Join(t.TempDir(), "registries.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"registries": {
+		"logical.example": {"endpoints": ["127.0.0.1:1", "`+failingHost+`", "`+mirrorHost+`"]}
+	}}`), 0o644))
+	require.NoError(t, ConfigureRegistries(path))
+	t.Cleanup(func() { registries, clients = nil, make(map[clientKey]Client) })
+
+	repo := image.Repository{Registry: "logical.example", Namespace: "app"}
+	client, err := GetClient(repo, PullScope)
+	require.NoError(t, err)
+
+	u := APIBaseURL(repo.Registry)
+	u.Path = "/v2/app/manifests/v1"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	require.NoError(t, err)
+	resp, err := client.DoExpecting(req, http.StatusOK)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "from mirror", string(body))
+	assert.Contains(t, mirrorHosts, mirrorHost, "request did not address the mirror endpoint")
+
+	req, err = http.NewRequest(http.MethodGet, u.String()+"-missing", nil)
+	require.NoError(t, err)
+	_, err = client.DoExpecting(req, http.StatusOK)
+	assert.Error(t, err, "last endpoint's error response was not final")
+}
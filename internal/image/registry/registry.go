@@ -2,6 +2,7 @@ package registry
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"sync"
@@ -47,7 +48,9 @@ func (c Client) DoExpectingNoBody(req *http.Request, codes ...int) (resp *http.R
 		io.Copy(io.Discard, resp.Body)
 		resp.Body.Close()
 	}
-	resp.Body = nil
+	if resp != nil {
+		resp.Body = nil
+	}
 	return
 }
 
@@ -67,6 +70,9 @@ const (
 type clientKey struct {
 	repo  image.Repository
 	scope Scope
+	// mountFrom is the namespace of another repository in the same registry that
+	// the client may also pull from, for cross-repository blob mounts.
+	mountFrom string
 }
 
 var (
@@ -79,15 +85,40 @@ var (
 // returned client is safe for concurrent use by multiple goroutines, and may be
 // shared with other callers.
 func GetClient(repo image.Repository, scope Scope) (Client, error) {
+	return getClient(clientKey{repo: repo, scope: scope})
+}
+
+// GetMountClient returns an HTTP client like [GetClient] that may push to repo
+// and pull from the repository from in the same registry, as a registry
+// requires to mount blobs from one repository into another. Each distinct
+// pair of repositories gets its own client.
+func GetMountClient(repo, from image.Repository) (Client, error) {
+	if from.Registry != repo.Registry || from.Namespace == "" {
+		return Client{}, fmt.Errorf("cannot mount from %s to %s", from, repo)
+	}
+	if from.Namespace == repo.Namespace {
+		return GetClient(repo, PushScope)
+	}
+	return getClient(clientKey{repo: repo, scope: PushScope, mountFrom: from.Namespace})
+}
+
+func getClient(key clientKey) (Client, error) {
 	clientsMu.Lock()
 	defer clientsMu.Unlock()
 
-	key := clientKey{repo, scope}
 	if client, ok := clients[key]; ok {
 		return client, nil
 	}
 
-	transport, err := getTransport(repo, string(scope))
+	var (
+		transport http.RoundTripper
+		err       error
+	)
+	if endpoints := getRegistryConfig(key.repo.Registry).Endpoints; key.scope == PullScope && len(endpoints) > 0 {
+		transport = newEndpointTransport(key.repo, key.scope, endpoints)
+	} else {
+		transport, err = getTransport(key.repo, key.scope, key.mountFrom)
+	}
 	client := Client{http.Client{Transport: transport}}
 	if err == nil {
 		clients[key] = client
@@ -95,83 +126,35 @@ func GetClient(repo image.Repository, scope Scope) (Client, error) {
 	return client, err
 }
 
-func getTransport(repo image.Repository, scope string) (http.RoundTripper, error) {
-	gRepo, err := name.NewRepository(repo.String())
+// getTransport returns an authenticating transport for requests with the
+// provided scope to repo, which may also pull from the mountFrom namespace in
+// the same registry if it is not empty.
+func getTransport(repo image.Repository, scope Scope, mountFrom string) (http.RoundTripper, error) {
+	gRepo, err := name.NewRepository(repo.String(), nameOptions(repo.Registry)...)
 	if err != nil {
 		return nil, err
 	}
-	authenticator, err := authn.DefaultKeychain.Resolve(gRepo)
-	if err != nil {
-		authenticator = authn.Anonymous
+	authenticator, ok := lookupCredentials(repo, scope)
+	if !ok {
+		authenticator, err = authn.DefaultKeychain.Resolve(gRepo)
+		if err != nil {
+			authenticator = authn.Anonymous
+		}
 	}
-	gTransport, err := transport.NewWithContext(
+	scopes := []string{gRepo.Scope(string(scope))}
+	if mountFrom != "" {
+		scopes = append(scopes, gRepo.Registry.Repo(mountFrom).Scope(transport.PullScope))
+	}
+	t, err := newTokenTransport(
 		context.TODO(),
 		gRepo.Registry,
+		string(repo.Registry),
 		authenticator,
-		http.DefaultTransport,
-		[]string{gRepo.Scope(scope)},
+		baseTransport(repo.Registry),
+		scopes,
 	)
-	return newLockedTransport(gTransport), err
-}
-
-// lockedTransport works around the non-thread-safety of the underlying
-// RoundTripper from go-containerregistry.
-type lockedTransport struct {
-	http.RoundTripper
-	mu ctxLock
-}
-
-func newLockedTransport(rt http.RoundTripper) *lockedTransport {
-	return &lockedTransport{
-		RoundTripper: rt,
-	}
-}
-
-func (t *lockedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if err := t.mu.LockWithContext(req.Context()); err != nil {
+	if err != nil {
 		return nil, err
 	}
-	defer t.mu.Unlock()
-	return t.RoundTripper.RoundTrip(req)
-}
-
-// ctxLock is a mutex that supports canceling a lock attempt with a
-// [context.Context]. The zero value for a ctxLock is an unlocked mutex.
-type ctxLock struct {
-	ch   chan struct{}
-	init sync.Once
-}
-
-func (l *ctxLock) ensureInit() {
-	l.init.Do(func() {
-		l.ch = make(chan struct{}, 1)
-		l.ch <- struct{}{}
-	})
-}
-
-// LockWithContext blocks the calling goroutine until the mutex is available, in
-// which case it returns a nil error, or until ctx is canceled, in which case it
-// returns ctx.Err().
-//
-// When LockWithContext returns a non-nil error, the caller must not attempt to
-// unlock the mutex or violate any invariant that it protects.
-func (l *ctxLock) LockWithContext(ctx context.Context) error {
-	l.ensureInit()
-	select {
-	case <-l.ch:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-}
-
-// Unlock unlocks the locked mutex, or panics if the mutex is already unlocked.
-func (l *ctxLock) Unlock() {
-	l.ensureInit()
-	select {
-	case l.ch <- struct{}{}:
-		return
-	default:
-		panic("unlock of unlocked ctxLock")
-	}
+	return t, nil
 }
@@ -0,0 +1,236 @@
+// Package registryfs reads and writes images directly in the storage layout
+// of the docker/distribution filesystem driver, as used by the registry:2
+// image, so that an unmodified registry can serve them afterward.
+//
+// The layout keeps the content of every blob (including manifests) once under
+// docker/registry/v2/blobs. Each repository links to the blobs that it
+// contains: layers and configs under _layers, manifests under
+// _manifests/revisions, and tags under _manifests/tags. Content and links are
+// written to a temporary file and renamed into place, so that a registry
+// serving the same directory never observes partial writes.
+package registryfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/ahamlinman/magic-mirror/internal/atomicfile"
+)
+
+const rootDir = "docker/registry/v2"
+
+// Storage provides access to the content of a registry storage directory.
+type Storage struct {
+	root string
+}
+
+var (
+	storages   = make(map[string]*Storage)
+	storagesMu sync.Mutex
+)
+
+// Open returns the Storage for the registry storage directory at root, which
+// is the root directory of the filesystem driver (the directory containing
+// "docker"), and need not exist yet. All calls with the same cleaned path share
+// a Storage.
+func Open(root string) *Storage {
+	root = filepath.Clean(root)
+
+	storagesMu.Lock()
+	defer storagesMu.Unlock()
+	if s, ok := storages[root]; ok {
+		return s
+	}
+	s := &Storage{root: root}
+	storages[root] = s
+	return s
+}
+
+// HasBlob returns whether the repository with the provided name contains the
+// blob with the provided digest.
+func (s *Storage) HasBlob(namespace string, dgst digest.Digest) (bool, error) {
+	linked, err := s.readLink(s.layerLinkPath(namespace, dgst))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.hasData(linked)
+}
+
+// GetBlob opens the blob with the provided digest in the repository with the
+// provided name, and returns its size.
+func (s *Storage) GetBlob(namespace string, dgst digest.Digest) (r io.ReadCloser, size int64, err error) {
+	linked, err := s.readLink(s.layerLinkPath(namespace, dgst))
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.dataPath(linked))
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+// PutBlob writes the content of r as the blob with the provided digest, and
+// links it into the repository with the provided name. It fails if the content
+// does not match the digest.
+func (s *Storage) PutBlob(namespace string, dgst digest.Digest, r io.Reader) error {
+	if err := s.putData(dgst, r); err != nil {
+		return err
+	}
+	return s.writeLink(s.layerLinkPath(namespace, dgst), dgst)
+}
+
+// MountBlob links the blob with the provided digest into the repository with
+// the provided name if any repository in the storage directory has the blob,
+// and returns whether it did so.
+func (s *Storage) MountBlob(namespace string, dgst digest.Digest) (bool, error) {
+	ok, err := s.hasData(dgst)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, s.writeLink(s.layerLinkPath(namespace, dgst), dgst)
+}
+
+// GetManifest returns the content of the manifest with the provided tag or
+// digest in the repository with the provided name. The storage layout does not
+// record the media types of manifests, so the caller must detect the type from
+// the content.
+//
+// When the repository has no manifest for the reference, the error wraps
+// fs.ErrNotExist.
+func (s *Storage) GetManifest(namespace, reference string) ([]byte, error) {
+	dgst, err := digest.Parse(reference)
+	if err != nil {
+		dgst, err = s.readLink(s.tagPath(namespace, reference, "current", "link"))
+		if err != nil {
+			return nil, fmt.Errorf("tag %s in %s: %w", reference, namespace, err)
+		}
+	}
+	if _, err := s.readLink(s.revisionLinkPath(namespace, dgst)); err != nil {
+		return nil, fmt.Errorf("manifest %s in %s: %w", dgst, namespace, err)
+	}
+	return os.ReadFile(s.dataPath(dgst))
+}
+
+// PutManifest writes a manifest with the provided digest to the repository with
+// the provided name. When tag is not empty, it also points the tag at the
+// manifest.
+func (s *Storage) PutManifest(namespace, tag string, body []byte, dgst digest.Digest) error {
+	if err := s.putData(dgst, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	if err := s.writeLink(s.revisionLinkPath(namespace, dgst), dgst); err != nil {
+		return err
+	}
+	if tag == "" {
+		return nil
+	}
+	indexPath := s.tagPath(namespace, tag, "index", dgst.Algorithm().String(), dgst.Encoded(), "link")
+	if err := s.writeLink(indexPath, dgst); err != nil {
+		return err
+	}
+	return s.writeLink(s.tagPath(namespace, tag, "current", "link"), dgst)
+}
+
+// Tags returns the tags in the repository with the provided name.
+func (s *Storage) Tags(namespace string) ([]string, error) {
+	entries, err := os.ReadDir(s.tagPath(namespace, ""))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			tags = append(tags, entry.Name())
+		}
+	}
+	return tags, nil
+}
+
+func (s *Storage) hasData(dgst digest.Digest) (bool, error) {
+	_, err := os.Stat(s.dataPath(dgst))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Storage) putData(dgst digest.Digest, r io.Reader) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	if ok, err := s.hasData(dgst); err != nil || ok {
+		return err
+	}
+
+	verifier := dgst.Verifier()
+	return atomicfile.Write(s.dataPath(dgst), func(w io.Writer) error {
+		if _, err := io.Copy(io.MultiWriter(w, verifier), r); err != nil {
+			return err
+		}
+		if !verifier.Verified() {
+			return fmt.Errorf("content of blob %s does not match its digest", dgst)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) readLink(path string) (digest.Digest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	dgst, err := digest.Parse(strings.TrimSpace(string(content)))
+	if err != nil {
+		return "", fmt.Errorf("invalid link at %s: %w", path, err)
+	}
+	return dgst, nil
+}
+
+func (s *Storage) writeLink(path string, dgst digest.Digest) error {
+	return atomicfile.Write(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, dgst.String())
+		return err
+	})
+}
+
+func (s *Storage) dataPath(dgst digest.Digest) string {
+	encoded := dgst.Encoded()
+	return filepath.Join(s.root, rootDir, "blobs", dgst.Algorithm().String(), encoded[:2], encoded, "data")
+}
+
+func (s *Storage) layerLinkPath(namespace string, dgst digest.Digest) string {
+	return filepath.Join(s.repoPath(namespace), "_layers", dgst.Algorithm().String(), dgst.Encoded(), "link")
+}
+
+func (s *Storage) revisionLinkPath(namespace string, dgst digest.Digest) string {
+	return filepath.Join(s.repoPath(namespace), "_manifests", "revisions", dgst.Algorithm().String(), dgst.Encoded(), "link")
+}
+
+func (s *Storage) tagPath(namespace, tag string, elems ...string) string {
+	return filepath.Join(append([]string{s.repoPath(namespace), "_manifests", "tags", tag}, elems...)...)
+}
+
+func (s *Storage) repoPath(namespace string) string {
+	return filepath.Join(s.root, rootDir, "repositories", filepath.FromSlash(namespace))
+}
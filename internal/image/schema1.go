@@ -0,0 +1,196 @@
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ ManifestKind = Schema1Manifest{}
+
+// Schema1Manifest is a legacy Docker image manifest, using schema version 1
+// with or without a JWS signature. It can't be copied as-is to most modern
+// registries, but can be converted to a schema2 manifest by synthesizing a
+// config from its history. Its descriptor uses the digest algorithm in
+// Algorithm (or the canonical algorithm if empty).
+type Schema1Manifest struct {
+	ParsedSchema1Manifest
+	Raw       json.RawMessage
+	MediaType MediaType
+	Algorithm digest.Algorithm
+}
+
+// ParsedSchema1Manifest holds the fields of a schema1 manifest that are
+// relevant to conversion.
+type ParsedSchema1Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	Tag           string `json:"tag"`
+	Architecture  string `json:"architecture"`
+	FSLayers      []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+	Signatures []struct {
+		Protected string `json:"protected"`
+	} `json:"signatures,omitempty"`
+}
+
+func (m *Schema1Manifest) UnmarshalJSON(text []byte) error {
+	*m = Schema1Manifest{Raw: text, MediaType: DockerSchema1MediaType}
+	if err := json.Unmarshal(text, &m.ParsedSchema1Manifest); err != nil {
+		return err
+	}
+	if len(m.Signatures) > 0 {
+		m.MediaType = DockerSchema1SignedMediaType
+	}
+	return nil
+}
+
+func (m Schema1Manifest) Encoded() json.RawMessage { return m.Raw }
+
+func (m Schema1Manifest) GetMediaType() MediaType { return m.MediaType }
+
+// Descriptor returns a descriptor for the manifest. Like registries do, it
+// computes the digest of a signed manifest from its payload without the JWS
+// signatures.
+func (m Schema1Manifest) Descriptor() v1.Descriptor {
+	payload, err := m.Payload()
+	if err != nil {
+		payload = m.Raw
+	}
+	return v1.Descriptor{
+		MediaType: string(m.MediaType),
+		Digest:    algorithmOrCanonical(m.Algorithm).FromBytes(payload),
+		Size:      int64(len(payload)),
+	}
+}
+
+// Payload returns the content of the manifest without any JWS signatures.
+func (m Schema1Manifest) Payload() ([]byte, error) {
+	if len(m.Signatures) == 0 {
+		return m.Raw, nil
+	}
+
+	// Each signature's protected header describes how to reconstruct the
+	// original payload: keep formatLength bytes of the signed manifest, then
+	// append formatTail (typically the closing brace that the signatures field
+	// displaced).
+	protected, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(m.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema1 signature header: %w", err)
+	}
+	var header struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, fmt.Errorf("invalid schema1 signature header: %w", err)
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.FormatTail, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema1 signature format tail: %w", err)
+	}
+	if header.FormatLength < 0 || header.FormatLength > len(m.Raw) {
+		return nil, errors.New("invalid schema1 signature format length")
+	}
+	return append(m.Raw[:header.FormatLength:header.FormatLength], tail...), nil
+}
+
+func (m Schema1Manifest) Validate() error {
+	if m.SchemaVersion != 1 {
+		return fmt.Errorf("unexpected schema version %d in schema1 manifest", m.SchemaVersion)
+	}
+	if len(m.FSLayers) == 0 || len(m.FSLayers) != len(m.History) {
+		return errors.New("schema1 manifest has mismatched fsLayers and history")
+	}
+	for _, layer := range m.FSLayers {
+		if err := layer.BlobSum.Validate(); err != nil {
+			return err
+		}
+	}
+	_, err := m.Payload()
+	return err
+}
+
+// Schema1Layer is a single layer of a schema1 manifest. Layers marked as
+// Throwaway contain no filesystem changes, and do not appear in the layers of
+// a converted manifest.
+type Schema1Layer struct {
+	BlobSum digest.Digest
+	v1Compatibility
+}
+
+type v1Compatibility struct {
+	Created         string `json:"created,omitempty"`
+	Author          string `json:"author,omitempty"`
+	Comment         string `json:"comment,omitempty"`
+	Throwaway       bool   `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+// Layers returns all layers of the manifest in application order (the reverse
+// of schema1 order), including empty "throwaway" layers.
+func (m Schema1Manifest) Layers() ([]Schema1Layer, error) {
+	layers := make([]Schema1Layer, len(m.FSLayers))
+	for i := range m.FSLayers {
+		j := len(m.FSLayers) - 1 - i
+		layers[i].BlobSum = m.FSLayers[j].BlobSum
+		if err := json.Unmarshal([]byte(m.History[j].V1Compatibility), &layers[i].v1Compatibility); err != nil {
+			return nil, fmt.Errorf("invalid v1Compatibility entry in schema1 manifest: %w", err)
+		}
+	}
+	return layers, nil
+}
+
+// Config synthesizes an image config for the manifest, in the same way that
+// the Docker daemon does when it pulls a schema1 image. diffIDs must contain
+// the uncompressed digest of every non-empty layer, in application order.
+func (m Schema1Manifest) Config(diffIDs []digest.Digest) ([]byte, error) {
+	layers, err := m.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	// The newest v1Compatibility entry holds the full legacy config of the image,
+	// along with some v1-specific fields that have no place in a modern config.
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &config); err != nil {
+		return nil, fmt.Errorf("invalid v1Compatibility entry in schema1 manifest: %w", err)
+	}
+	for _, field := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"} {
+		delete(config, field)
+	}
+
+	history := make([]v1.History, len(layers))
+	for i, layer := range layers {
+		history[i] = v1.History{
+			Author:     layer.Author,
+			CreatedBy:  strings.Join(layer.ContainerConfig.Cmd, " "),
+			Comment:    layer.Comment,
+			EmptyLayer: layer.Throwaway,
+		}
+		if created, err := time.Parse(time.RFC3339Nano, layer.Created); err == nil {
+			history[i].Created = &created
+		}
+	}
+
+	rootfs := v1.RootFS{Type: "layers", DiffIDs: diffIDs}
+	if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+	if config["history"], err = json.Marshal(history); err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
@@ -0,0 +1,290 @@
+// Package signature creates and verifies cosign-compatible image signatures
+// with keys stored in local files, without contacting a transparency log or
+// any other online service.
+//
+// A cosign signature is a small "simple signing" JSON payload naming the
+// digest of the signed manifest, stored as a layer of a signature manifest.
+// The layer's annotations carry the base64-encoded signature of the payload.
+// Cosign publishes signature manifests either under a companion tag in the
+// signed image's repository ("sha256-<hex>.sig"), or as referrers of the
+// signed manifest with the artifact type [ArtifactType].
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// PayloadMediaType is the media type of the layers in a signature manifest
+	// that contain simple signing payloads.
+	PayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// ArtifactType is the artifact type of signature manifests that cosign
+	// attaches to images as referrers.
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+	// Annotation is the layer annotation holding the base64-encoded signature
+	// of a simple signing payload.
+	Annotation = "dev.cosignproject.cosign/signature"
+
+	payloadType = "cosign container image signature"
+)
+
+// Payload is the simple signing payload that a cosign signature covers.
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// Verify checks that sig is a valid signature of payload under one of keys,
+// and that payload is a simple signing payload for the manifest with the
+// provided digest. The signature is base64-encoded, as in [Annotation].
+func Verify(keys []crypto.PublicKey, payload []byte, sig string, dgst digest.Digest) error {
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	verified := false
+	for _, key := range keys {
+		if verifyWithKey(key, payload, rawSig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("signature does not match any trusted key")
+	}
+
+	// Only a verified payload is worth parsing, since its content is otherwise
+	// under the control of whoever published the signature.
+	var p Payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("invalid signature payload: %w", err)
+	}
+	if p.Critical.Type != payloadType {
+		return fmt.Errorf("unknown signature payload type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != dgst {
+		return fmt.Errorf("signature covers %s, not %s", p.Critical.Image.DockerManifestDigest, dgst)
+	}
+	return nil
+}
+
+// NewPayload returns a simple signing payload for the manifest with the
+// provided digest in the repository with the provided name (like
+// "ghcr.io/example/app"), with optional annotations. The payload is
+// deterministic for the same arguments.
+func NewPayload(repo string, dgst digest.Digest, optional map[string]any) ([]byte, error) {
+	var p Payload
+	p.Critical.Identity.DockerReference = repo
+	p.Critical.Image.DockerManifestDigest = dgst
+	p.Critical.Type = payloadType
+	p.Optional = optional
+	return json.Marshal(p)
+}
+
+// Sign returns the base64-encoded signature of payload under key, as Verify
+// expects it.
+func Sign(key crypto.Signer, payload []byte) (string, error) {
+	var (
+		sig []byte
+		err error
+	)
+	switch key.Public().(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		hash := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		err = fmt.Errorf("unsupported private key type %T", key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyWithKey follows the conventions of cosign: ECDSA and RSA keys sign the
+// SHA-256 hash of the payload (with ASN.1 and PKCS #1 v1.5 encoding
+// respectively), while Ed25519 keys sign the payload directly.
+func verifyWithKey(key crypto.PublicKey, payload, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	default:
+		return false
+	}
+}
+
+// ParsePublicKey parses a PEM-encoded ECDSA, RSA, or Ed25519 public key in
+// PKIX form, as written by "cosign generate-key-pair".
+func ParsePublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM-encoded public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// Policy assigns trusted public keys to scopes of repositories. A scope is
+// either a registry name ("ghcr.io"), a repository name prefix
+// ("ghcr.io/example"), or a full repository name ("ghcr.io/example/app"). The
+// keys for a repository are those of the longest scope that contains it. The
+// special scope "*" contains every repository not covered by another scope.
+type Policy struct {
+	scopes map[string][]crypto.PublicKey
+}
+
+// policyFile is the JSON form of a Policy. Relative key paths are resolved
+// against the directory containing the policy file.
+//
+//	{"scopes": {"ghcr.io/example": {"keys": ["example.pub"]}}}
+type policyFile struct {
+	Scopes map[string]struct {
+		Keys []string `json:"keys"`
+	} `json:"scopes"`
+}
+
+// LoadPolicy reads a Policy from the JSON file at path, along with every key
+// that it references.
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file policyFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid signature policy %s: %w", path, err)
+	}
+
+	policy := &Policy{scopes: make(map[string][]crypto.PublicKey)}
+	var errs []error
+	for scope, entry := range file.Scopes {
+		if len(entry.Keys) == 0 {
+			errs = append(errs, fmt.Errorf("scope %q in signature policy %s has no keys", scope, path))
+			continue
+		}
+		for _, keyPath := range entry.Keys {
+			if !filepath.IsAbs(keyPath) {
+				keyPath = filepath.Join(filepath.Dir(path), keyPath)
+			}
+			key, err := loadPublicKey(keyPath)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			policy.scopes[scope] = append(policy.scopes[scope], key)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// LoadPrivateKey reads an unencrypted PEM-encoded ECDSA, RSA, or Ed25519
+// private key from the file at path, in PKCS #8 form or in the SEC 1 or
+// PKCS #1 forms specific to ECDSA and RSA keys.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM-encoded private key found", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q (encrypted keys are not supported)", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey, *rsa.PrivateKey, ed25519.PrivateKey:
+		return key.(crypto.Signer), nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePublicKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// KeysFor returns the trusted keys for the repository with the provided name
+// (like "ghcr.io/example/app"), along with the scope that they belong to. It
+// returns false if no scope contains the repository.
+func (p *Policy) KeysFor(repo string) (scope string, keys []crypto.PublicKey, ok bool) {
+	for candidate := repo; ; {
+		if keys, ok := p.scopes[candidate]; ok {
+			return candidate, keys, true
+		}
+		i := strings.LastIndexByte(candidate, '/')
+		if i < 0 {
+			break
+		}
+		candidate = candidate[:i]
+	}
+	if keys, ok := p.scopes["*"]; ok {
+		return "*", keys, true
+	}
+	return "", nil, false
+}
@@ -0,0 +1,130 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeysFor(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"registry", "org", "app", "fallback"} {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		writePublicKey(t, filepath.Join(dir, name+".pub"), pub)
+	}
+	policyPath := filepath.Join(dir, "policy.json")
+	require.NoError(t, os.WriteFile(policyPath, []byte(`{"scopes": {
+		"ghcr.io": {"keys": ["registry.pub"]},
+		"ghcr.io/org": {"keys": ["org.pub"]},
+		"ghcr.io/org/app": {"keys": ["app.pub"]},
+		"*": {"keys": ["fallback.pub"]}
+	}}`), 0o644))
+	policy, err := LoadPolicy(policyPath)
+	require.NoError(t, err)
+
+	testCases := map[string]string{
+		"ghcr.io/org/app":          "ghcr.io/org/app",
+		"ghcr.io/org/app/child":    "ghcr.io/org/app",
+		"ghcr.io/org/application":  "ghcr.io/org",
+		"ghcr.io/other/app":        "ghcr.io",
+		"docker.io/library/alpine": "*",
+	}
+	for repo, want := range testCases {
+		scope, keys, ok := policy.KeysFor(repo)
+		assert.True(t, ok, "no scope for %s", repo)
+		assert.Equal(t, want, scope, "wrong scope for %s", repo)
+		assert.Len(t, keys, 1, "wrong keys for %s", repo)
+	}
+}
+
+func TestVerifyKeyTypes(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	payload := fmt.Appendf(nil,
+		`{"critical":{"identity":{"docker-reference":"example.com/app"},"image":{"docker-manifest-digest":%q},"type":%q},"optional":null}`,
+		dgst, payloadType,
+	)
+	hash := sha256.Sum256(payload)
+
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaPriv, crypto.SHA256, hash[:])
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		key crypto.PublicKey
+		sig []byte
+	}{
+		"ed25519": {edPub, ed25519.Sign(edPriv, payload)},
+		"rsa":     {&rsaPriv.PublicKey, rsaSig},
+	}
+	for name, tc := range testCases {
+		path := filepath.Join(t.TempDir(), name+".pub")
+		writePublicKey(t, path, tc.key)
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		key, err := ParsePublicKey(content)
+		require.NoError(t, err)
+
+		sig := base64.StdEncoding.EncodeToString(tc.sig)
+		assert.NoError(t, Verify([]crypto.PublicKey{key}, payload, sig, dgst), "%s signature rejected", name)
+		assert.Error(t, Verify([]crypto.PublicKey{key}, payload, sig, digest.FromString("other")), "%s signature accepted for wrong digest", name)
+		tampered := append([]byte(nil), payload...)
+		tampered[len(tampered)-2] = ' '
+		assert.Error(t, Verify([]crypto.PublicKey{key}, tampered, sig, dgst), "%s signature accepted for tampered payload", name)
+	}
+}
+
+func writePublicKey(t *testing.T, path string, key crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644))
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	payload, err := NewPayload("example.com/app", dgst, map[string]any{"source": "example.org/app:v1"})
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	testCases := map[string]*pem.Block{
+		"ecdsa":   {Type: "EC PRIVATE KEY", Bytes: ecDER},
+		"ed25519": {Type: "PRIVATE KEY", Bytes: edDER},
+	}
+	for name, block := range testCases {
+		path := filepath.Join(t.TempDir(), name+".key")
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+		key, err := LoadPrivateKey(path)
+		require.NoError(t, err)
+
+		sig, err := Sign(key, payload)
+		require.NoError(t, err)
+		assert.NoError(t, Verify([]crypto.PublicKey{key.Public()}, payload, sig, dgst), "%s signature rejected", name)
+	}
+}
@@ -1,14 +1,14 @@
 package parka
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"math"
 	"runtime"
-	"slices"
 	"sync"
 	"sync/atomic"
-
-	"github.com/gammazero/deque"
+	"time"
 
 	"github.com/ahamlinman/magic-mirror/internal/parka/catch"
 )
@@ -21,6 +21,10 @@ var ErrHandlerGoexit = errors.New("parka: handler executed runtime.Goexit")
 // the corresponding handler run was canceled.
 var ErrTaskEjected = errors.New("task ejected from queue")
 
+// errTaskDiscarded is returned by [task.Wait] for a task whose result the map
+// discarded, so that the waiter can retry its key.
+var errTaskDiscarded = errors.New("parka: task discarded")
+
 // Map runs a handler function once per key in a distinct goroutine and caches
 // the result, while supporting dynamic concurrency limits on handlers.
 //
@@ -35,7 +39,27 @@ var ErrTaskEjected = errors.New("task ejected from queue")
 // the concurrency limit for the remainder of its own lifetime, or until it
 // calls [Handle.Reattach]. In particular, [KeyMutex] helps handlers detach from
 // the limit while awaiting exclusive use of a shared resource, typically one
-// identified by a subset of the handler's current key.
+// identified by a subset of the handler's current key. New keys that the limit
+// prevents the map from handling immediately wait in a queue, which
+// [Map.InformPriority] can order by priority.
+//
+// [Handle.Context] provides each handler with a context that the map cancels
+// when no caller remains interested in the handler's result, or when
+// [Map.Cleanup] cleans up the map. Callers of [Map.GetContext] and
+// [Map.CollectContext] lose interest in their keys once they stop waiting on
+// them, while all other retrievals, along with [Map.Inform],
+// [Map.InformFront], and [Map.InformPriority], express permanent interest. If
+// a handler returns an error or calls [runtime.Goexit] after losing every
+// interested caller, the map discards its result rather than caching it, and a
+// later retrieval of the key runs the handler again.
+//
+// Map caches every result permanently by default. [Map.Forget] removes the
+// result of a single key, and [Map.ForgetErrors] sets a policy for removing
+// error results automatically, so that later retrievals of those keys run
+// their handlers again. For long-lived maps, [Map.LimitEntries] and
+// [Map.ExpireAfter] evict cached results to bound the map's size, and
+// [Map.Evict] evicts the results of individual keys. Eviction never affects
+// pending keys or handlers in flight.
 type Map[K comparable, V any] struct {
 	handle func(*Handle, K) (V, error)
 
@@ -46,6 +70,24 @@ type Map[K comparable, V any] struct {
 	tasksMu      sync.RWMutex // 1st in locking order.
 	tasksHandled atomic.Uint64
 
+	// ctx is the parent of the contexts of new tasks, which Cleanup cancels and
+	// replaces. It is protected by tasksMu.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// forgetErrorsAfter is the time for which error results remain cached, or
+	// a negative value to cache them permanently. It is protected by tasksMu.
+	forgetErrorsAfter time.Duration
+
+	// lru orders the keys of cached results from most to least recently
+	// retrieved, for eviction beyond maxEntries (if positive). Results are also
+	// evicted expireAfter (if positive) after their handlers finish. These are
+	// protected by tasksMu.
+	lru         list.List
+	maxEntries  int
+	expireAfter time.Duration
+	evicted     atomic.Uint64
+
 	// See [workState].
 	state    workState[K]
 	stateMu  sync.Mutex // 2nd in locking order.
@@ -73,7 +115,7 @@ type workState[K comparable] struct {
 	grants      int
 	grantLimit  int
 	reattachers int
-	keys        deque.Deque[K]
+	keys        keyQueue[K]
 
 	// emptied may be non-nil if there are outstanding work grants.
 	// If so, it must be closed as soon as all work grants are retired.
@@ -96,6 +138,24 @@ func (rq reattachQueue) ReceiveGrant() { rq <- struct{}{} }
 type task[V any] struct {
 	gate   gate
 	result catch.Result[V]
+
+	// ctx is the handler's context, which is canceled once the handler finishes
+	// if not before.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The following are protected by the map's tasksMu. pinned indicates
+	// permanent interest in the result, and waiters counts the callers that may
+	// lose interest. A task is abandoned once it has neither, and its result is
+	// discarded if the handler does not return successfully after that. A
+	// forgotten task is removed from the map once its handler finishes.
+	pinned    bool
+	waiters   int
+	abandoned bool
+	discarded bool
+	forgotten bool
+	finished  bool
+	lruElem   *list.Element
 }
 
 // gate keeps multiple waiters blocked until a [task] is finished.
@@ -106,8 +166,35 @@ func (g *gate) Init()   { *g = make(gate) }
 func (g *gate) Wait()   { <-*g }
 func (g *gate) Unlock() { close(*g) }
 
-func (t *task[V]) Wait() (V, error) {
-	t.gate.Wait()
+// WaitContext is like Wait, but returns false if ctx is done before the gate
+// is unlocked. A nil ctx is never done.
+func (g *gate) WaitContext(ctx context.Context) bool {
+	if ctx == nil {
+		g.Wait()
+		return true
+	}
+	select {
+	case <-*g:
+		return true // Prefer the result if both are ready.
+	default:
+	}
+	select {
+	case <-*g:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Wait blocks until the task is finished or ctx (if not nil) is done, and
+// returns the task's result, ctx's error, or errTaskDiscarded.
+func (t *task[V]) Wait(ctx context.Context) (V, error) {
+	if !t.gate.WaitContext(ctx) {
+		return *new(V), ctx.Err()
+	}
+	if t.discarded {
+		return *new(V), errTaskDiscarded
+	}
 	if !t.result.Returned() {
 		panic(ErrHandlerGoexit) // Must be Goexit, since wg isn't done when the handler panics.
 	}
@@ -116,11 +203,16 @@ func (t *task[V]) Wait() (V, error) {
 
 // NewMap creates a [Map] with the provided handler.
 func NewMap[K comparable, V any](handle func(*Handle, K) (V, error)) *Map[K, V] {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Map[K, V]{
 		handle:   handle,
 		state:    workState[K]{grantLimit: math.MaxInt},
 		tasks:    make(map[K]*task[V]),
+		ctx:      ctx,
+		cancel:   cancel,
 		reattach: make(reattachQueue),
+
+		forgetErrorsAfter: -1,
 	}
 }
 
@@ -130,12 +222,15 @@ type Stats struct {
 	Handled uint64
 	// Total is the count of all pending and handled keys in the map.
 	Total uint64
+	// Evicted is the count of cached results that the map has evicted.
+	Evicted uint64
 }
 
 // Stats returns statistics for a map's handler executions.
 func (m *Map[K, V]) Stats() Stats {
 	var stats Stats
 	stats.Handled = m.tasksHandled.Load()
+	stats.Evicted = m.evicted.Load()
 	m.tasksMu.RLock()
 	stats.Total = uint64(len(m.tasks))
 	m.tasksMu.RUnlock()
@@ -147,19 +242,35 @@ func (m *Map[K, V]) Stats() Stats {
 //
 // Inform has no effect on keys already handled or pending. When concurrency
 // limits prohibit immediate handling of all keys, the new keys among those
-// provided are enqueued at the back of a work queue, in the order given,
-// without interleaving the keys of any other enqueue operation. A future
-// [Map.InformFront] call may interpose new keys between those enqueued in a
-// single Inform call.
+// provided are enqueued in a work queue with priority 0, behind all other keys
+// of the same priority, in the order given, without interleaving the keys of
+// any other enqueue operation. A future [Map.InformFront] call may interpose
+// new keys between those enqueued in a single Inform call.
 func (m *Map[K, V]) Inform(keys ...K) {
-	m.getTasks(pushAllBack, keys...)
+	m.getTasks(pushAllBack, false, keys...)
 }
 
-// InformFront behaves like [Map.Inform], but enqueues new keys at the front of
-// the map's work queue rather than the back. Like Inform, it does not affect
-// the order of keys already pending.
+// InformFront behaves like [Map.Inform], but enqueues new keys ahead of all
+// other keys of priority 0 rather than behind them. Like Inform, it does not
+// affect the order of keys already pending.
 func (m *Map[K, V]) InformFront(keys ...K) {
-	m.getTasks(pushAllFront, keys...)
+	m.getTasks(pushAllFront, false, keys...)
+}
+
+// InformPriority behaves like [Map.Inform], but enqueues new keys with the
+// provided priority rather than priority 0. The map handles queued keys with
+// higher priorities first. Unlike Inform, InformPriority raises the priority
+// of keys already queued with lower priorities, moving them behind all other
+// keys of the provided priority. It has no effect on keys already handled or
+// in flight, or on keys queued with equal or higher priorities.
+func (m *Map[K, V]) InformPriority(priority int, keys ...K) {
+	m.getTasks(pushAllPriority[K](priority), false, keys...)
+
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	for _, key := range keys {
+		m.state.keys.Raise(key, priority)
+	}
 }
 
 // Get informs the map of the key as if by [Map.Inform], blocks until it has
@@ -167,7 +278,23 @@ func (m *Map[K, V]) InformFront(keys ...K) {
 //
 // If the key's handler called [runtime.Goexit], Get panics with [ErrHandlerGoexit].
 func (m *Map[K, V]) Get(key K) (V, error) {
-	return m.getTasks(pushAllBack, key)[0].Wait()
+	values, err := m.collect(nil, key)
+	if err != nil {
+		return *new(V), err
+	}
+	return values[0], nil
+}
+
+// GetContext is like [Map.Get], but returns the zero value of V and ctx's
+// error if ctx is done before the map handles the key. The key's handler keeps
+// running unless every caller interested in its result stops waiting for it;
+// see [Handle.Context].
+func (m *Map[K, V]) GetContext(ctx context.Context, key K) (V, error) {
+	values, err := m.collect(ctx, key)
+	if err != nil {
+		return *new(V), err
+	}
+	return values[0], nil
 }
 
 // Collect informs the map of the keys as if by [Map.Inform], then coalesces
@@ -176,11 +303,34 @@ func (m *Map[K, V]) Get(key K) (V, error) {
 // for the map to handle subsequent keys. Otherwise, Collect returns a slice of
 // values corresponding to the keys.
 func (m *Map[K, V]) Collect(keys ...K) ([]V, error) {
+	return m.collect(nil, keys...)
+}
+
+// CollectContext is like [Map.Collect], but returns ctx's error if ctx is done
+// before the map handles every key. Once CollectContext returns, it no longer
+// counts as interested in any of the keys, including those that it did not
+// wait for after an earlier key's error.
+func (m *Map[K, V]) CollectContext(ctx context.Context, keys ...K) ([]V, error) {
+	return m.collect(ctx, keys...)
+}
+
+// collect implements the Get and Collect variants, where a nil ctx expresses
+// permanent interest in the keys.
+func (m *Map[K, V]) collect(ctx context.Context, keys ...K) ([]V, error) {
+	waiting := ctx != nil
+	tasks := m.getTasks(pushAllBack, waiting, keys...)
+	if waiting {
+		defer func() { m.release(tasks) }()
+	}
+
 	var err error
-	tasks := m.getTasks(pushAllBack, keys...)
 	values := make([]V, len(tasks))
-	for i, task := range tasks {
-		values[i], err = task.Wait()
+	for i := range tasks {
+		values[i], err = tasks[i].Wait(ctx)
+		for err == errTaskDiscarded {
+			tasks[i] = m.getTasks(pushAllBack, waiting, keys[i])[0]
+			values[i], err = tasks[i].Wait(ctx)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -188,6 +338,20 @@ func (m *Map[K, V]) Collect(keys ...K) ([]V, error) {
 	return values, nil
 }
 
+// release withdraws the interest of a caller that was waiting on tasks, and
+// cancels the contexts of those that lose every interested caller.
+func (m *Map[K, V]) release(tasks []*task[V]) {
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+	for _, task := range tasks {
+		task.waiters--
+		if task.waiters == 0 && !task.pinned && !task.abandoned {
+			task.abandoned = true
+			task.cancel()
+		}
+	}
+}
+
 // Limit updates the map's concurrency limit for handling pending keys,
 // guaranteeing a limit of at least 1 regardless of the limit provided.
 //
@@ -236,17 +400,96 @@ func (m *Map[K, V]) Limit(limit int) {
 	}
 }
 
+// Forget removes the cached result of key, if any, so that the next retrieval
+// of key runs its handler again. If the key is pending or its handler is in
+// flight, Forget takes effect once the handler finishes, and every retrieval
+// that is already waiting on the handler receives its result.
+func (m *Map[K, V]) Forget(key K) {
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+
+	task, ok := m.tasks[key]
+	if !ok {
+		return
+	}
+	if !task.finished {
+		task.forgotten = true
+		return
+	}
+	m.dropResult(key, task)
+}
+
+// ForgetErrors sets the map's policy for caching results with non-nil errors,
+// which applies to handlers that finish after ForgetErrors returns. A negative
+// duration caches error results permanently, as new maps do. Otherwise, the
+// map forgets each error result (as if by [Map.Forget]) the provided duration
+// after its handler returns, or as soon as it returns for a zero duration.
+// Retrievals already waiting on a handler always receive its result. The
+// policy does not affect successful results, which remain cached.
+func (m *Map[K, V]) ForgetErrors(after time.Duration) {
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+	m.forgetErrorsAfter = after
+}
+
+// LimitEntries sets the maximum number of cached results that the map retains,
+// evicting the results of the least recently retrieved keys beyond that number
+// (including immediately, if the map already holds more). Pending keys and
+// handlers in flight do not count toward the limit. A limit of 0 or less
+// retains every result, as new maps do.
+func (m *Map[K, V]) LimitEntries(n int) {
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+	m.maxEntries = n
+	m.evictExcess()
+}
+
+// ExpireAfter sets the time for which the map retains each result, starting
+// when its handler finishes. It applies to handlers that finish after
+// ExpireAfter returns. A duration of 0 or less retains results indefinitely,
+// as new maps do.
+func (m *Map[K, V]) ExpireAfter(ttl time.Duration) {
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+	m.expireAfter = ttl
+}
+
+// Evict removes the cached result of key, so that the next retrieval of key
+// runs its handler again, and returns true if there was such a result. Unlike
+// [Map.Forget], Evict has no effect on pending keys or handlers in flight.
+func (m *Map[K, V]) Evict(key K) bool {
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+
+	task, ok := m.tasks[key]
+	if !ok || !task.finished {
+		return false
+	}
+	m.dropResult(key, task)
+	m.evicted.Add(1)
+	return true
+}
+
 // Cleanup terminates a map's work by dequeueing pending keys, calling an
-// optional cancel function, and waiting for handlers to finish.
+// optional cancel function, canceling the contexts of handlers in flight (see
+// [Handle.Context]), and waiting for handlers to finish. Handlers that start
+// after Cleanup receive fresh contexts.
 //
 // To terminate a map's work when returning early, it is recommended to defer
-// a Cleanup call with the cancel function for a [context.Context] in the
-// handler's scope. See the Context example in [Map] for details.
+// a Cleanup call. Handlers can observe cancellation through Handle.Context, or
+// through a [context.Context] in the handler's scope whose cancel function is
+// provided to Cleanup. See the Context example in [Map] for details.
 func (m *Map[K, V]) Cleanup(cancel func()) {
 	m.DequeueAll()
 	if cancel != nil {
 		cancel()
 	}
+	func() {
+		m.tasksMu.Lock()
+		defer m.tasksMu.Unlock()
+		m.cancel()
+		m.ctx, m.cancel = context.WithCancel(context.Background())
+	}()
 	m.Wait()
 }
 
@@ -269,19 +512,17 @@ func (m *Map[K, V]) DequeueAll() []K {
 		m.stateMu.Lock()
 		defer m.stateMu.Unlock()
 
-		var swapped deque.Deque[K]
-		swapped, m.state.keys = m.state.keys, swapped
-
-		keys = make([]K, swapped.Len())
-		tasks = make([]*task[V], swapped.Len())
-		for i := range swapped.Len() {
-			keys[i] = swapped.At(i)
+		keys = make([]K, m.state.keys.Len())
+		tasks = make([]*task[V], len(keys))
+		for i := range keys {
+			keys[i] = m.state.keys.PopFront()
 			tasks[i] = m.tasks[keys[i]]
 			delete(m.tasks, keys[i])
 		}
 	}()
 
 	for _, task := range tasks {
+		task.cancel()
 		task.result = catch.Return(*new(V), ErrTaskEjected)
 		task.gate.Unlock()
 	}
@@ -312,28 +553,39 @@ func (m *Map[K, V]) Wait() {
 	}
 }
 
-func (m *Map[K, V]) getTasks(enqueue enqueueFunc[K], keys ...K) []*task[V] {
-	tasks, newKeys := m.getOrCreateTasks(keys)
+// getTasks returns the tasks for keys, creating and scheduling new tasks as
+// necessary. Callers that are waiting must release the tasks when they stop
+// waiting; all other callers express permanent interest in the tasks.
+func (m *Map[K, V]) getTasks(enqueue enqueueFunc[K], waiting bool, keys ...K) []*task[V] {
+	tasks, newKeys := m.getOrCreateTasks(keys, waiting)
 	m.scheduleNewKeys(enqueue, newKeys)
 	return tasks
 }
 
-func (m *Map[K, V]) getOrCreateTasks(keys []K) (tasks []*task[V], newKeys []K) {
+func (m *Map[K, V]) getOrCreateTasks(keys []K, waiting bool) (tasks []*task[V], newKeys []K) {
 	tasks = make([]*task[V], len(keys))
 
 	m.tasksMu.Lock()
 	defer m.tasksMu.Unlock()
 
 	for i, key := range keys {
-		if task, ok := m.tasks[key]; ok {
-			tasks[i] = task
-			continue
+		t, ok := m.tasks[key]
+		if ok && t.lruElem != nil {
+			m.lru.MoveToFront(t.lruElem)
 		}
-		task := &task[V]{}
-		task.gate.Init()
-		m.tasks[key] = task
-		tasks[i] = task
-		newKeys = append(newKeys, key)
+		if !ok {
+			t = &task[V]{}
+			t.gate.Init()
+			t.ctx, t.cancel = context.WithCancel(m.ctx)
+			m.tasks[key] = t
+			newKeys = append(newKeys, key)
+		}
+		if waiting {
+			t.waiters++
+		} else {
+			t.pinned = true
+		}
+		tasks[i] = t
 	}
 	return
 }
@@ -365,17 +617,19 @@ func (m *Map[K, V]) scheduleNewKeys(enqueue enqueueFunc[K], keys []K) {
 	}
 }
 
-type enqueueFunc[T any] func(*deque.Deque[T], []T)
+type enqueueFunc[K comparable] func(*keyQueue[K], []K)
 
-func pushAllBack[T any](d *deque.Deque[T], all []T) {
-	for _, v := range all {
-		d.PushBack(v)
-	}
+func pushAllBack[K comparable](q *keyQueue[K], all []K) {
+	q.PushBack(0, all)
 }
 
-func pushAllFront[T any](d *deque.Deque[T], all []T) {
-	for _, v := range slices.Backward(all) {
-		d.PushFront(v)
+func pushAllFront[K comparable](q *keyQueue[K], all []K) {
+	q.PushFront(0, all)
+}
+
+func pushAllPriority[K comparable](priority int) enqueueFunc[K] {
+	return func(q *keyQueue[K], all []K) {
+		q.PushBack(priority, all)
 	}
 }
 
@@ -413,6 +667,7 @@ var workPanic = func(v any) { panic(v) }
 // key, which may relinquish the work grant if it detaches.
 func (m *Map[K, V]) completeTask(key K, task *task[V]) (detached bool) {
 	h := &Handle{ // Loan our work grant to the handler.
+		ctx:      task.ctx,
 		detach:   m.handleDetach,
 		reattach: m.handleReattach,
 	}
@@ -425,7 +680,7 @@ func (m *Map[K, V]) completeTask(key K, task *task[V]) (detached bool) {
 			// or in transferring any work grant we have.
 			workPanic(rv)
 		}
-		m.tasksHandled.Add(1)
+		m.finishTask(key, task)
 		task.gate.Unlock()
 		if !detached && !task.result.Returned() {
 			// We have a work grant and are (likely) Goexiting, so must transfer it.
@@ -441,6 +696,89 @@ func (m *Map[K, V]) completeTask(key K, task *task[V]) (detached bool) {
 	return
 }
 
+// finishTask cancels the context of a task whose handler has finished, then
+// caches, discards, or forgets its result. It must be called before the task's
+// gate is unlocked.
+func (m *Map[K, V]) finishTask(key K, task *task[V]) {
+	task.cancel()
+
+	failed := true
+	if task.result.Returned() {
+		_, err := task.result.Unwrap()
+		failed = err != nil
+	}
+
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+
+	task.finished = true
+	switch {
+	case task.abandoned && failed:
+		// Nobody wanted this result, and it's probably just the product of the
+		// handler's canceled context. Anyone new who wants it should try again.
+		task.discarded = true
+		m.removeTask(key, task)
+	case task.forgotten || failed && task.result.Returned() && m.forgetErrorsAfter == 0:
+		m.removeTask(key, task)
+	default:
+		m.tasksHandled.Add(1)
+		task.lruElem = m.lru.PushFront(key)
+		m.evictExcess()
+		if failed && task.result.Returned() && m.forgetErrorsAfter > 0 {
+			time.AfterFunc(m.forgetErrorsAfter, func() { m.forgetTask(key, task, false) })
+		}
+		if m.expireAfter > 0 {
+			time.AfterFunc(m.expireAfter, func() { m.forgetTask(key, task, true) })
+		}
+	}
+}
+
+// forgetTask removes the cached result of a finished task, if the map still
+// holds it for key, and counts the removal as an eviction if requested.
+func (m *Map[K, V]) forgetTask(key K, task *task[V], evict bool) {
+	m.tasksMu.Lock()
+	defer m.tasksMu.Unlock()
+	if m.tasks[key] == task {
+		m.dropResult(key, task)
+		if evict {
+			m.evicted.Add(1)
+		}
+	}
+}
+
+// evictExcess evicts the least recently retrieved results beyond the map's
+// entry limit. The caller must hold tasksMu.
+func (m *Map[K, V]) evictExcess() {
+	for m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		key := m.lru.Back().Value.(K)
+		m.dropResult(key, m.tasks[key])
+		m.evicted.Add(1)
+	}
+}
+
+// dropResult removes the cached result of a finished task from the map. The
+// caller must hold tasksMu.
+//
+// Only finished tasks have results to drop, so dropping them preserves the
+// invariants of the map's tasks and [workState], which concern only incomplete
+// keys.
+func (m *Map[K, V]) dropResult(key K, task *task[V]) {
+	delete(m.tasks, key)
+	if task.lruElem != nil {
+		m.lru.Remove(task.lruElem)
+		task.lruElem = nil
+	}
+	m.tasksHandled.Add(^uint64(0))
+}
+
+// removeTask removes a task without a cached result from the map, if the map
+// still holds it for key. The caller must hold tasksMu.
+func (m *Map[K, V]) removeTask(key K, task *task[V]) {
+	if m.tasks[key] == task {
+		delete(m.tasks, key)
+	}
+}
+
 // tryGetQueuedKey, when called with a work grant held, either relinquishes the
 // work grant (returning ok == false) or returns a key (ok == true) whose work
 // the caller must execute.
@@ -536,6 +874,7 @@ func (m *Map[K, V]) handleReattach() {
 // handler's own. In the terminology of the Go memory model, the return of every
 // Handle call must be synchronized before the handler's termination.
 type Handle struct {
+	ctx      context.Context
 	detach   func()
 	reattach func()
 
@@ -551,6 +890,14 @@ type Handle struct {
 	terminated bool
 }
 
+// Context returns a context that the [Map] cancels when no caller remains
+// interested in the handler's result, when [Map.Cleanup] cleans up the map, or
+// when the handler finishes. Once canceled, the context stays canceled even if
+// new callers become interested in the result.
+func (h *Handle) Context() context.Context {
+	return h.ctx
+}
+
 // Detach unbounds the calling handler from the concurrency limit of the [Map]
 // that invoked it, allowing the map to immediately handle other keys.
 // It returns true if this call detached the handler, or false if the handler
@@ -38,22 +38,23 @@ func ExampleMap_context() {
 		timeout     = 10 * time.Second
 	)
 
-	// Create a parent context to support canceling in-flight handlers.
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Use that context in a map's handler, making child contexts as needed.
-	codes := parka.NewMap(func(_ *parka.Handle, url string) (int, error) {
-		ctx, cancel := context.WithTimeout(ctx, timeout)
+	// Use the handle's context in a map's handler, making child contexts as
+	// needed. The map cancels it when nobody is waiting for the result anymore.
+	codes := parka.NewMap(func(ph *parka.Handle, url string) (int, error) {
+		ctx, cancel := context.WithTimeout(ph.Context(), timeout)
 		defer cancel()
 		return headResponseCode(ctx, url)
 	})
 
-	// If Collect returns early on error, use Cleanup to dequeue pending work,
-	// cancel the context, and wait for in-flight handlers.
-	defer codes.Cleanup(cancel)
+	// If CollectContext returns early on error, use Cleanup to dequeue pending
+	// work, cancel the contexts of in-flight handlers, and wait for them.
+	defer codes.Cleanup(nil)
 
+	// Stop waiting for results if the caller's context is canceled. Handlers
+	// for keys that no other caller is waiting for are canceled in turn.
+	ctx := context.Background()
 	codes.Limit(concurrency)
-	codes.Collect(
+	codes.CollectContext(ctx,
 		"https://www.example.com/",
 		"https://www.example.net/",
 		// ...
@@ -325,6 +326,54 @@ func TestMapOrdering(t *testing.T) {
 	})
 }
 
+func TestMapPriority(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var handledOrder []int
+		unblock := make(chan struct{})
+		s := parka.NewSet(func(_ *parka.Handle, x int) error {
+			<-unblock
+			handledOrder = append(handledOrder, x)
+			return nil
+		})
+		s.Limit(1)
+
+		// Start a new blocked handler to force the queueing of subsequent keys.
+		s.Inform(0)
+		synctest.Wait()
+
+		// Queue keys at a mix of priorities, then raise some of them.
+		s.Inform(1, 2)
+		s.InformPriority(2, 20, 21)
+		s.InformPriority(-1, -10)
+		s.InformPriority(1, 10)
+		s.InformFront(-1)
+		s.InformPriority(2, 22)
+		s.InformPriority(1, 2)   // Raised behind 10.
+		s.InformPriority(-5, 1)  // Already queued with a higher priority.
+		s.InformPriority(2, 0)   // Already in flight.
+		s.InformPriority(1, -10) // Raised behind 2.
+
+		// Unblock all the handlers, and ensure they were queued in the right order.
+		close(unblock)
+		wantOrder := []int{
+			// The initial blocked handler.
+			0,
+			// Priority 2 keys, in the order queued.
+			20, 21,
+			22,
+			// Priority 1 keys, with raised keys behind those queued before them.
+			10,
+			2,
+			-10,
+			// Priority 0 keys, with the front-queued key first.
+			-1,
+			1,
+		}
+		s.Collect(wantOrder...)
+		assert.Equal(t, wantOrder, handledOrder)
+	})
+}
+
 func TestMapReattachPriority(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		const (
@@ -1016,3 +1065,245 @@ func TestMapCleanup(t *testing.T) {
 		assert.ErrorIs(t, <-errCh, context.Canceled)
 	})
 }
+
+func TestMapGetContext(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			calls    atomic.Int32
+			canceled = make(chan struct{})
+		)
+		m := parka.NewMap(func(ph *parka.Handle, x int) (int, error) {
+			if calls.Add(1) > 1 {
+				return x, nil
+			}
+			<-ph.Context().Done()
+			close(canceled)
+			return 0, ph.Context().Err()
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() { _, err := m.GetContext(ctx, 1); errCh <- err }()
+		synctest.Wait()
+		select {
+		case <-errCh:
+			assert.Fail(t, "GetContext returned before handler finished")
+		default:
+		}
+
+		cancel()
+		assert.ErrorIs(t, <-errCh, context.Canceled)
+		<-canceled // The handler's context must be canceled after its only waiter leaves.
+		synctest.Wait()
+
+		got, err := m.Get(1)
+		assert.NoError(t, err, "Abandoned handler's error was cached")
+		assert.Equal(t, 1, got)
+		assert.Equal(t, int32(2), calls.Load())
+		assert.Equal(t, parka.Stats{Handled: 1, Total: 1}, m.Stats())
+	})
+}
+
+func TestMapContextInterest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		unblock := make(chan struct{})
+		m := parka.NewMap(func(ph *parka.Handle, x int) (int, error) {
+			select {
+			case <-unblock:
+				return x, nil
+			case <-ph.Context().Done():
+				return 0, ph.Context().Err()
+			}
+		})
+
+		// Inform expresses permanent interest, so a waiter that gives up doesn't
+		// cancel the handler.
+		m.Inform(1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := m.GetContext(ctx, 1)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// One of two waiters giving up doesn't cancel the handler either.
+		ctx, cancel = context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() { _, err := m.CollectContext(context.Background(), 2); errCh <- err }()
+		go func() { _, err := m.CollectContext(ctx, 2); errCh <- err }()
+		synctest.Wait()
+		cancel()
+		assert.ErrorIs(t, <-errCh, context.Canceled)
+
+		close(unblock)
+		assert.NoError(t, <-errCh)
+		got, err := m.Collect(1, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 2}, got)
+	})
+}
+
+func TestMapCleanupContext(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		s := parka.NewSet(func(ph *parka.Handle, _ int) error {
+			<-ph.Context().Done()
+			return ph.Context().Err()
+		})
+
+		s.Inform(1)
+		synctest.Wait()
+		s.Cleanup(nil)
+		assert.ErrorIs(t, s.Get(1), context.Canceled)
+	})
+}
+
+func TestMapForget(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			calls   atomic.Int32
+			unblock = make(chan struct{})
+		)
+		m := parka.NewMap(func(_ *parka.Handle, x int) (int, error) {
+			n := calls.Add(1)
+			if n == 2 {
+				<-unblock
+			}
+			return int(n), nil
+		})
+
+		got, _ := m.Get(1)
+		assert.Equal(t, 1, got)
+		got, _ = m.Get(1)
+		assert.Equal(t, 1, got, "Result was not cached")
+
+		m.Forget(1)
+		assert.Equal(t, parka.Stats{Handled: 0, Total: 0}, m.Stats())
+
+		// Waiters on an in-flight handler share its result even when the key is
+		// forgotten in the meantime.
+		results := make(chan int, 2)
+		for range 2 {
+			go func() { got, _ := m.Get(1); results <- got }()
+		}
+		synctest.Wait()
+		m.Forget(1)
+		close(unblock)
+		assert.Equal(t, 2, <-results)
+		assert.Equal(t, 2, <-results)
+
+		got, _ = m.Get(1)
+		assert.Equal(t, 3, got, "Forgotten in-flight result was cached")
+		m.Forget(2) // Unknown keys have no effect.
+		assert.Equal(t, parka.Stats{Handled: 1, Total: 1}, m.Stats())
+	})
+}
+
+func TestMapForgetErrors(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var calls atomic.Int32
+		m := parka.NewMap(func(_ *parka.Handle, x int) (int, error) {
+			calls.Add(1)
+			if x < 0 {
+				return 0, errors.New("negative")
+			}
+			return x, nil
+		})
+
+		m.ForgetErrors(0)
+		_, err := m.Get(-1)
+		assert.Error(t, err)
+		_, err = m.Get(-1)
+		assert.Error(t, err)
+		assert.Equal(t, int32(2), calls.Load(), "Error result was cached")
+
+		m.ForgetErrors(time.Minute)
+		m.Get(-2)
+		m.Get(-2)
+		assert.Equal(t, int32(3), calls.Load(), "Error result was not cached before the delay")
+		time.Sleep(time.Minute)
+		synctest.Wait()
+		m.Get(-2)
+		assert.Equal(t, int32(4), calls.Load(), "Error result was cached after the delay")
+
+		m.Get(1)
+		time.Sleep(time.Hour)
+		m.Get(1)
+		assert.Equal(t, int32(5), calls.Load(), "Successful result was forgotten")
+	})
+}
+
+func TestMapLimitEntries(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var (
+			calls   atomic.Int32
+			unblock = make(chan struct{})
+		)
+		m := parka.NewMap(func(_ *parka.Handle, x int) (int, error) {
+			calls.Add(1)
+			if x == 0 {
+				<-unblock
+			}
+			return x, nil
+		})
+		m.LimitEntries(2)
+
+		m.Inform(0) // In flight, so never evicted.
+		m.Collect(1, 2)
+		m.Get(1) // 1 is now more recently retrieved than 2.
+		m.Get(3)
+		assert.Equal(t, parka.Stats{Handled: 2, Total: 3, Evicted: 1}, m.Stats())
+
+		m.Get(1)
+		assert.Equal(t, int32(4), calls.Load(), "Evicted the most recently retrieved result")
+		m.Get(2)
+		assert.Equal(t, int32(5), calls.Load(), "Did not evict the least recently retrieved result")
+
+		close(unblock)
+		m.Get(0)
+		assert.Equal(t, uint64(2), m.Stats().Handled, "Retained too many results")
+		m.LimitEntries(1)
+		assert.Equal(t, uint64(1), m.Stats().Handled, "Did not evict after lowering the limit")
+	})
+}
+
+func TestMapExpireAfter(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var calls atomic.Int32
+		m := parka.NewMap(func(_ *parka.Handle, x int) (int, error) {
+			calls.Add(1)
+			return x, nil
+		})
+		m.ExpireAfter(time.Minute)
+
+		m.Get(1)
+		time.Sleep(30 * time.Second)
+		m.Get(1)
+		assert.Equal(t, int32(1), calls.Load(), "Result expired early")
+
+		time.Sleep(30 * time.Second)
+		synctest.Wait()
+		assert.Equal(t, parka.Stats{Handled: 0, Total: 0, Evicted: 1}, m.Stats())
+		m.Get(1)
+		assert.Equal(t, int32(2), calls.Load(), "Result did not expire")
+	})
+}
+
+func TestMapEvict(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		unblock := make(chan struct{})
+		s := parka.NewSet(func(_ *parka.Handle, x int) error {
+			if x == 0 {
+				<-unblock
+			}
+			return nil
+		})
+
+		s.Inform(0)
+		s.Get(1)
+		assert.False(t, s.Evict(0), "Evicted a handler in flight")
+		assert.False(t, s.Evict(2), "Evicted an unknown key")
+		assert.True(t, s.Evict(1))
+		assert.Equal(t, parka.Stats{Handled: 0, Total: 1, Evicted: 1}, s.Stats())
+
+		close(unblock)
+		assert.NoError(t, s.Get(0))
+	})
+}
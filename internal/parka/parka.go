@@ -6,8 +6,9 @@ concurrency into a single mechanism for distributing work across goroutines.
 Maps provide substantial dynamic control over concurrency limits and task
 prioritization, including at the level of individual running handlers.
 
-This version of Parka is suited for work that does not require cache eviction,
-such as a main package running a single batch-type workflow or short-lived maps
-that are disposed of after a single use.
+Maps cache every result permanently by default, which suits a main package
+running a single batch-type workflow or short-lived maps that are disposed of
+after a single use. Long-lived maps can bound their caches with entry limits,
+expiration times, and explicit eviction.
 */
 package parka
@@ -0,0 +1,106 @@
+package parka
+
+import "container/heap"
+
+// keyQueue is a priority queue of distinct keys, which dequeues keys with
+// higher priorities first, and keys with equal priorities in the order that
+// they were pushed to the back of the queue (or the reverse of the order that
+// they were pushed to the front).
+type keyQueue[K comparable] struct {
+	heap  keyHeap[K]
+	items map[K]*queueItem[K]
+
+	// backSeq and frontSeq bound the sequence numbers of the keys in the queue,
+	// which break ties between equal priorities.
+	backSeq, frontSeq int64
+}
+
+type queueItem[K comparable] struct {
+	key      K
+	priority int
+	seq      int64
+	index    int
+}
+
+// Len returns the number of keys in the queue.
+func (q *keyQueue[K]) Len() int {
+	return len(q.heap)
+}
+
+// PushBack enqueues keys in order behind all queued keys of the same priority.
+func (q *keyQueue[K]) PushBack(priority int, keys []K) {
+	for _, key := range keys {
+		q.push(key, priority, q.backSeq)
+		q.backSeq++
+	}
+}
+
+// PushFront enqueues keys in order ahead of all queued keys of the same
+// priority.
+func (q *keyQueue[K]) PushFront(priority int, keys []K) {
+	q.frontSeq -= int64(len(keys))
+	for i, key := range keys {
+		q.push(key, priority, q.frontSeq+int64(i))
+	}
+}
+
+func (q *keyQueue[K]) push(key K, priority int, seq int64) {
+	if q.items == nil {
+		q.items = make(map[K]*queueItem[K])
+	}
+	item := &queueItem[K]{key: key, priority: priority, seq: seq}
+	q.items[key] = item
+	heap.Push(&q.heap, item)
+}
+
+// Raise moves key, if queued with a lower priority, behind all queued keys of
+// the provided priority.
+func (q *keyQueue[K]) Raise(key K, priority int) {
+	item, ok := q.items[key]
+	if !ok || item.priority >= priority {
+		return
+	}
+	item.priority, item.seq = priority, q.backSeq
+	q.backSeq++
+	heap.Fix(&q.heap, item.index)
+}
+
+// PopFront removes and returns the key at the front of the queue, which must
+// not be empty.
+func (q *keyQueue[K]) PopFront() K {
+	item := heap.Pop(&q.heap).(*queueItem[K])
+	delete(q.items, item.key)
+	return item.key
+}
+
+// keyHeap implements [heap.Interface] for keyQueue.
+type keyHeap[K comparable] []*queueItem[K]
+
+func (h keyHeap[K]) Len() int { return len(h) }
+
+func (h keyHeap[K]) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h keyHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *keyHeap[K]) Push(x any) {
+	item := x.(*queueItem[K])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *keyHeap[K]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
@@ -9,13 +9,25 @@ import (
 
 	"github.com/spf13/pflag"
 
+	"github.com/ahamlinman/magic-mirror/internal/bundle"
 	"github.com/ahamlinman/magic-mirror/internal/image/copy"
+	"github.com/ahamlinman/magic-mirror/internal/image/registry"
+	"github.com/ahamlinman/magic-mirror/internal/image/signature"
 	"github.com/ahamlinman/magic-mirror/internal/log"
 )
 
 var (
-	flagConcurrency = pflag.Int("concurrency", 10, "Number of concurrent operations for each task")
-	flagVerbose     = pflag.Bool("verbose", false, "Enable verbose logging of all operations")
+	flagConcurrency     = pflag.Int("concurrency", 10, "Number of concurrent operations for each task")
+	flagVerbose         = pflag.Bool("verbose", false, "Enable verbose logging of all operations")
+	flagExportBundle    = pflag.String("export-bundle", "", "Write the source images of the copy specs to a bundle at this path, instead of copying them")
+	flagPreviousBundle  = pflag.String("previous-bundle", "", "Omit the content of this previous bundle from an exported bundle")
+	flagImportBundle    = pflag.StringArray("import-bundle", nil, "Copy the images in a bundle (repeat for each bundle in a chain, oldest first) to their destinations")
+	flagSignaturePolicy = pflag.String("signature-policy", "", "Refuse to copy source images without a valid signature under the keys in this policy file")
+	flagSignKey         = pflag.String("sign-key", "", "Sign each destination image with the PEM private key in this file")
+	flagSignReferrers   = pflag.Bool("sign-referrers", false, "Attach destination signatures as OCI referrers instead of cosign signature tags")
+	flagRegistries      = pflag.String("registries-config", "", "Reach registries with the endpoints and TLS settings in this registries config file")
+	flagPreflight       = pflag.String("preflight", "abort", "Before copying, check access to every repository, then abort, drop the affected copies, or skip the check (abort|drop|off)")
+	flagCredentials     = pflag.String("credentials", "", "Authenticate to registries with the credentials in this file, ahead of the Docker config (see also $"+registry.CredentialsEnv+")")
 )
 
 func main() {
@@ -25,6 +37,62 @@ func main() {
 		log.Printf("[main] concurrency must be at least 1")
 		os.Exit(2)
 	}
+	if *flagSignKey != "" && (*flagExportBundle != "" || len(*flagImportBundle) > 0) {
+		log.Printf("[main] --sign-key can't be combined with bundle exports or imports")
+		os.Exit(2)
+	}
+	if *flagSignReferrers && *flagSignKey == "" {
+		log.Printf("[main] --sign-referrers requires --sign-key")
+		os.Exit(2)
+	}
+	if *flagPreviousBundle != "" && *flagExportBundle == "" {
+		log.Printf("[main] --previous-bundle requires --export-bundle")
+		os.Exit(2)
+	}
+
+	if *flagRegistries != "" {
+		if err := registry.ConfigureRegistries(*flagRegistries); err != nil {
+			log.Printf("[main] %v", err)
+			os.Exit(2)
+		}
+	}
+	if err := registry.ConfigureCredentials(*flagCredentials); err != nil {
+		log.Printf("[main] invalid credentials: %v", err)
+		os.Exit(2)
+	}
+
+	preflight, err := copy.ParsePreflight(*flagPreflight)
+	if err != nil {
+		log.Printf("[main] invalid --preflight: %v", err)
+		os.Exit(2)
+	}
+
+	if pflag.Arg(0) == "doctor" {
+		if *flagVerbose {
+			log.EnableVerbose()
+		}
+		os.Exit(runDoctor(pflag.Args()[1:]))
+	}
+
+	if len(*flagImportBundle) > 0 {
+		if *flagSignaturePolicy != "" {
+			log.Printf("[main] --signature-policy applies to the original sources of bundles, and can't be combined with --import-bundle")
+			os.Exit(2)
+		}
+		if *flagExportBundle != "" || pflag.NArg() > 0 {
+			log.Printf("[main] --import-bundle reads copy specs from its bundles, and can't be combined with other copy specs")
+			os.Exit(2)
+		}
+		if *flagVerbose {
+			log.EnableVerbose()
+		}
+		opts := copy.Options{Preflight: preflight}
+		if err := bundle.Import(*flagConcurrency, opts, *flagImportBundle); err != nil {
+			log.Printf("[main] bundle import failed:\n%v", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	var specReader io.Reader
 	if pflag.NArg() == 0 {
@@ -44,11 +112,36 @@ func main() {
 		os.Exit(2)
 	}
 
+	opts := copy.Options{Preflight: preflight}
+	if *flagSignaturePolicy != "" {
+		opts.SignaturePolicy, err = signature.LoadPolicy(*flagSignaturePolicy)
+		if err != nil {
+			log.Printf("[main] invalid signature policy: %v", err)
+			os.Exit(2)
+		}
+	}
+	if *flagSignKey != "" {
+		opts.SigningKey, err = signature.LoadPrivateKey(*flagSignKey)
+		if err != nil {
+			log.Printf("[main] invalid signing key: %v", err)
+			os.Exit(2)
+		}
+		opts.SignAsReferrers = *flagSignReferrers
+	}
+
 	if *flagVerbose {
 		log.EnableVerbose()
 	}
 
-	if err := copy.CopyAll(*flagConcurrency, copySpecs...); err != nil {
+	if *flagExportBundle != "" {
+		if err := bundle.Export(*flagConcurrency, opts, *flagExportBundle, *flagPreviousBundle, copySpecs); err != nil {
+			log.Printf("[main] bundle export failed:\n%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := copy.CopyAllWithOptions(*flagConcurrency, opts, copySpecs...); err != nil {
 		log.Printf("[main] some copies failed:\n%v", err)
 		os.Exit(1)
 	}